@@ -0,0 +1,31 @@
+package client
+
+import (
+	"ghostviewer/protocol"
+	"image"
+)
+
+// Capturer grabs the local screen. Frames are BGRA despite the image type.
+type Capturer interface {
+	Capture() (*image.RGBA, error)
+	Bounds() (image.Rectangle, error)
+	Close()
+}
+
+// InputDriver replays input from the viewer on this machine.
+type InputDriver interface {
+	Inject(msg protocol.Message)
+}
+
+// Consent puts a viewer's request to the person at this machine before
+// anything is captured, and shows them the screen is shared for as long as it
+// is.
+type Consent interface {
+	// Ask shows which viewer asks for what access, protocol.AccessView or
+	// protocol.AccessControl, and waits for an answer: the access allowed,
+	// or "" if the request was declined.
+	Ask(viewer string, access string) string
+	// Indicate keeps a notice on screen until hide is called, with a way to
+	// stop sharing that calls stop. Sharing doesn't start if it fails.
+	Indicate(viewer string, access string, stop func()) (hide func(), err error)
+}
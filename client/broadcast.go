@@ -0,0 +1,493 @@
+package client
+
+import (
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Broadcast shares one screen with several viewers at once. Each frame is
+// encoded once and handed to every viewer's own sender, so a viewer that
+// can't keep up skips frames instead of holding up the rest. Only the viewer
+// holding the input token has its input replayed; the first viewer to
+// connect holds it until it lets go or drops. Viewers that connect after
+// consent was asked are asked about on their own before they get anything.
+type Broadcast struct {
+	sessionState
+	Viewers []GClient
+
+	once       sync.Once
+	viewers    []*viewer
+	tokenMutex sync.Mutex // also guards ask and each viewer's consent
+	holder     *viewer
+	viewOnly   bool // nobody may have the token, as only viewing was allowed
+	ask        func(peer protocol.Hello) string
+}
+
+type viewer struct {
+	index     int
+	client    GClient
+	mu        sync.Mutex // held while sending or reconnecting
+	connected int32
+	frames    chan []byte // the latest encoded frame not yet sent
+	approved  bool        // its session was agreed to
+	viewOnly  bool        // it was only allowed to view
+}
+
+// encodedFrameSender is implemented by the clients in this package so a
+// frame marshalled once can be written to each of them.
+type encodedFrameSender interface {
+	sendEncodedFrame(data []byte) error
+}
+
+type messageSender interface {
+	SendMessage(msg protocol.Message) error
+}
+
+type passwordSetter interface {
+	SetPassword(password string)
+}
+
+func (b *Broadcast) init() {
+	b.once.Do(func() {
+		for i, client := range b.Viewers {
+			v := &viewer{index: i, client: client, frames: make(chan []byte, 1)}
+			b.viewers = append(b.viewers, v)
+			go b.send(v)
+		}
+	})
+}
+
+// Connect connects every viewer that isn't connected yet. It succeeds as long
+// as at least one of them is.
+func (b *Broadcast) Connect() error {
+	b.init()
+
+	var lastErr error
+	connected := 0
+	for _, v := range b.viewers {
+		if atomic.LoadInt32(&v.connected) == 1 {
+			connected++
+			continue
+		}
+		if _, ok := ended(v.client); ok {
+			continue
+		}
+
+		v.mu.Lock()
+		err := v.client.Connect()
+		v.mu.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Viewer %d: %s\n", v.index+1, err)
+			lastErr = err
+			continue
+		}
+
+		if b.attach(v) {
+			connected++
+		}
+	}
+
+	if connected == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no viewers")
+		}
+		return lastErr
+	}
+
+	b.link.SetState(transport.StateConnected, nil)
+	return nil
+}
+
+// Receive merges the messages from all viewers into output, reconnecting each
+// one on its own as it drops for up to ResumeTimeout. Input from viewers
+// without the token never reaches output. output is closed once every viewer
+// has given up or said goodbye, and once they all have the broadcast is over.
+func (b *Broadcast) Receive(output chan protocol.Message) {
+	b.init()
+	defer close(output)
+	defer b.link.SetState(transport.StateDisconnected, nil)
+
+	var wg sync.WaitGroup
+	for _, v := range b.viewers {
+		wg.Add(1)
+		go func(v *viewer) {
+			defer wg.Done()
+			b.receive(v, output)
+		}(v)
+	}
+	wg.Wait()
+
+	var bye protocol.Goodbye
+	for _, v := range b.viewers {
+		var ok bool
+		if bye, ok = ended(v.client); !ok {
+			return
+		}
+	}
+	b.hangUp(bye)
+}
+
+func (b *Broadcast) receive(v *viewer, output chan protocol.Message) {
+	for {
+		if atomic.LoadInt32(&v.connected) == 0 {
+			v.mu.Lock()
+			err := connectWithRetry(v.client, 0, time.Now().Add(ResumeTimeout))
+			v.mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Viewer %d: giving up: %s\n", v.index+1, err)
+				// so Connect doesn't try it again, and the broadcast ends
+				// once the last viewer is given up on
+				if e, ok := v.client.(endable); ok {
+					if _, ok := e.goodbye(); !ok {
+						e.hangUp(protocol.Goodbye{Code: protocol.GoodbyeIdleTimeout, Reason: "viewer did not come back"})
+					}
+				}
+				return
+			}
+			if !b.attach(v) {
+				return
+			}
+		}
+
+		messages := make(chan protocol.Message)
+		go v.client.Receive(messages)
+		for msg := range messages {
+			switch m := msg.(type) {
+			case protocol.Control:
+				if b.control(v, m) {
+					continue
+				}
+			case protocol.Pointer, protocol.Key, protocol.Scroll:
+				if !b.holds(v) {
+					continue
+				}
+			}
+
+			output <- msg
+		}
+
+		atomic.StoreInt32(&v.connected, 0)
+		b.release(v)
+		if bye, ok := ended(v.client); ok {
+			fmt.Fprintf(os.Stderr, "Viewer %d ended the session: %s\n", v.index+1, bye)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Lost connection to viewer %d, reconnecting...\n", v.index+1)
+	}
+}
+
+// attach marks v connected, hands it the token if nobody holds it and tells
+// it whether it may send input. Once consent has been asked, a viewer that
+// wasn't part of it is asked about first, and turned away with a goodbye if
+// it is declined, which attach reports.
+func (b *Broadcast) attach(v *viewer) bool {
+	b.tokenMutex.Lock()
+	if !v.approved && b.ask != nil {
+		ask := b.ask
+		b.tokenMutex.Unlock()
+		allowed := ask(v.client.Session().Peer)
+		b.tokenMutex.Lock()
+
+		if allowed == "" {
+			b.tokenMutex.Unlock()
+			fmt.Fprintf(os.Stderr, "Declined to share with viewer %d\n", v.index+1)
+			v.client.Disconnect(protocol.Goodbye{Code: protocol.GoodbyeDeclined})
+			return false
+		}
+		v.approved = true
+		v.viewOnly = allowed != protocol.AccessControl
+	}
+
+	// connected is only set under the lock, so every viewer is either in
+	// consentRequest's list or asked about above
+	atomic.StoreInt32(&v.connected, 1)
+	if b.holder == nil && b.mayHold(v) {
+		b.holder = v
+	}
+	holds := b.holder == v
+	b.tokenMutex.Unlock()
+
+	if holds {
+		b.notify(v, protocol.ControlInputGranted)
+	} else {
+		b.notify(v, protocol.ControlInputRevoked)
+	}
+	return true
+}
+
+// mayHold reports whether v may be given the input token. tokenMutex must be
+// held.
+func (b *Broadcast) mayHold(v *viewer) bool {
+	return !b.viewOnly && !v.viewOnly
+}
+
+// consentRequest lists the viewers connected so far, which the caller puts to
+// the user, and has ask put any that connect later to the user one by one.
+func (b *Broadcast) consentRequest(ask func(peer protocol.Hello) string) []protocol.Hello {
+	b.init()
+
+	b.tokenMutex.Lock()
+	defer b.tokenMutex.Unlock()
+
+	var peers []protocol.Hello
+	for _, v := range b.viewers {
+		if atomic.LoadInt32(&v.connected) == 1 {
+			v.approved = true
+			peers = append(peers, v.client.Session().Peer)
+		}
+	}
+	b.ask = ask
+	return peers
+}
+
+// control handles the token requests from v, reporting whether msg was one.
+func (b *Broadcast) control(v *viewer, msg protocol.Control) bool {
+	switch msg.Code {
+	case protocol.ControlInputRequest:
+		b.tokenMutex.Lock()
+		if b.holder == nil && b.mayHold(v) {
+			b.holder = v
+		}
+		granted := b.holder == v
+		b.tokenMutex.Unlock()
+
+		if granted {
+			b.notify(v, protocol.ControlInputGranted)
+		}
+		return true
+	case protocol.ControlInputRelease:
+		if b.release(v) {
+			b.notify(v, protocol.ControlInputRevoked)
+		}
+		return true
+	case protocol.ControlFrameAck:
+		// the frame rate follows the viewer in control, or the first one
+		// connected; the others skip frames if they are slower
+		return !b.pacing(v)
+	}
+
+	return false
+}
+
+func (b *Broadcast) holds(v *viewer) bool {
+	b.tokenMutex.Lock()
+	defer b.tokenMutex.Unlock()
+	return b.holder == v
+}
+
+// pacing reports whether v's acks drive the frame rate.
+func (b *Broadcast) pacing(v *viewer) bool {
+	b.tokenMutex.Lock()
+	holder := b.holder
+	b.tokenMutex.Unlock()
+
+	if holder != nil {
+		return holder == v
+	}
+
+	for _, other := range b.viewers {
+		if atomic.LoadInt32(&other.connected) == 1 {
+			return other == v
+		}
+	}
+	return false
+}
+
+// release frees the token if v holds it.
+func (b *Broadcast) release(v *viewer) bool {
+	b.tokenMutex.Lock()
+	defer b.tokenMutex.Unlock()
+
+	if b.holder != v {
+		return false
+	}
+
+	b.holder = nil
+	return true
+}
+
+// SetController gives the input token to viewer i, taking it from whoever
+// holds it. i of -1, or a viewer only allowed to view, leaves every viewer
+// view only.
+func (b *Broadcast) SetController(i int) {
+	b.init()
+
+	var next *viewer
+	if i >= 0 && i < len(b.viewers) {
+		next = b.viewers[i]
+	}
+
+	b.tokenMutex.Lock()
+	if next != nil && next.viewOnly {
+		next = nil
+	}
+	prev := b.holder
+	b.holder = next
+	b.tokenMutex.Unlock()
+
+	if prev == next {
+		return
+	}
+	if prev != nil {
+		b.notify(prev, protocol.ControlInputRevoked)
+	}
+	if next != nil {
+		b.notify(next, protocol.ControlInputGranted)
+	}
+}
+
+// setViewOnly takes the token back for good.
+func (b *Broadcast) setViewOnly() {
+	b.tokenMutex.Lock()
+	b.viewOnly = true
+	b.tokenMutex.Unlock()
+	b.SetController(-1)
+}
+
+// Controller returns the index of the viewer holding the input token, or -1.
+func (b *Broadcast) Controller() int {
+	b.tokenMutex.Lock()
+	defer b.tokenMutex.Unlock()
+
+	if b.holder == nil {
+		return -1
+	}
+	return b.holder.index
+}
+
+func (b *Broadcast) notify(v *viewer, code protocol.ControlCode) {
+	sender, ok := v.client.(messageSender)
+	if !ok || atomic.LoadInt32(&v.connected) == 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := sender.SendMessage(protocol.Control{Code: code}); err != nil {
+		fmt.Fprintf(os.Stderr, "Viewer %d: %s\n", v.index+1, err)
+	}
+}
+
+// SendMessage sends msg to the viewer in control, the only one whose input is
+// replayed and so the only one expecting input acks.
+func (b *Broadcast) SendMessage(msg protocol.Message) error {
+	b.tokenMutex.Lock()
+	holder := b.holder
+	b.tokenMutex.Unlock()
+
+	if holder == nil || atomic.LoadInt32(&holder.connected) == 0 {
+		return nil
+	}
+
+	sender, ok := holder.client.(messageSender)
+	if !ok {
+		return nil
+	}
+
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	return sender.SendMessage(msg)
+}
+
+// SendFrame encodes the frame once and queues it for every connected viewer,
+// replacing any frame a viewer hasn't sent yet. It never blocks on a viewer.
+func (b *Broadcast) SendFrame(frame protocol.Frame) error {
+	b.init()
+
+	data, err := protocol.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range b.viewers {
+		if atomic.LoadInt32(&v.connected) == 0 {
+			continue
+		}
+
+		select {
+		case <-v.frames:
+		default:
+		}
+		select {
+		case v.frames <- data:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// send writes v's queued frames for as long as the broadcast runs.
+func (b *Broadcast) send(v *viewer) {
+	for data := range v.frames {
+		v.mu.Lock()
+		if atomic.LoadInt32(&v.connected) == 1 {
+			if err := sendEncoded(v.client, data); err != nil {
+				fmt.Fprintf(os.Stderr, "Viewer %d: send error: %s\n", v.index+1, err)
+			}
+		}
+		v.mu.Unlock()
+	}
+}
+
+func sendEncoded(client GClient, data []byte) error {
+	if sender, ok := client.(encodedFrameSender); ok {
+		return sender.sendEncodedFrame(data)
+	}
+
+	msg, err := protocol.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	return client.SendFrame(msg.(protocol.Frame))
+}
+
+// Session returns the session with the viewer holding the input token, or
+// with any connected viewer if nobody holds it.
+func (b *Broadcast) Session() protocol.Session {
+	b.tokenMutex.Lock()
+	holder := b.holder
+	b.tokenMutex.Unlock()
+
+	if holder != nil {
+		return holder.client.Session()
+	}
+
+	for _, v := range b.viewers {
+		if atomic.LoadInt32(&v.connected) == 1 {
+			return v.client.Session()
+		}
+	}
+
+	return protocol.Session{}
+}
+
+// SetPassword sets the PIN or password to prove to each viewer that asks for
+// one.
+func (b *Broadcast) SetPassword(password string) {
+	for _, client := range b.Viewers {
+		if setter, ok := client.(passwordSetter); ok {
+			setter.SetPassword(password)
+		}
+	}
+}
+
+// Disconnect says goodbye to every connected viewer.
+func (b *Broadcast) Disconnect(bye protocol.Goodbye) {
+	b.hangUp(bye)
+	b.link.SetState(transport.StateDisconnected, nil)
+	for _, v := range b.viewers {
+		if atomic.LoadInt32(&v.connected) == 1 {
+			v.client.Disconnect(bye)
+		} else if e, ok := v.client.(endable); ok {
+			// stops it reconnecting
+			e.hangUp(bye)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"ghostviewer/screenshot"
+	"image"
+)
+
+// ScreenCapturer captures with the desktop duplication API, falling back to
+// BitBlt where it isn't available. It sets up D3D on first use, so Capture
+// must always be called from the same locked OS thread.
+type ScreenCapturer struct {
+	initialized bool
+}
+
+func (c *ScreenCapturer) Capture() (*image.RGBA, error) {
+	if !c.initialized {
+		screenshot.InitializeScreenshotInterface()
+		c.initialized = true
+	}
+
+	return screenshot.CaptureScreen()
+}
+
+func (c *ScreenCapturer) Bounds() (image.Rectangle, error) {
+	return screenshot.ScreenRect()
+}
+
+func (c *ScreenCapturer) Close() {
+	if !c.initialized {
+		return
+	}
+
+	if screenshot.DDUP != nil {
+		screenshot.DDUP.Release()
+		screenshot.DDUP = nil
+	}
+
+	screenshot.Device.Release()
+	screenshot.DeviceCtx.Release()
+	c.initialized = false
+}
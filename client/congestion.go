@@ -0,0 +1,280 @@
+package client
+
+import (
+	"image"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimits bounds what the congestion controller may choose for a session.
+// Scale is the fraction of the captured width and height that is sent.
+// Quality only matters to codecs that have a quality setting; raw-bgra has
+// none.
+type RateLimits struct {
+	MinFPS     float64
+	MaxFPS     float64
+	MinScale   float64
+	MaxScale   float64
+	MinQuality int
+	MaxQuality int
+}
+
+var DefaultRateLimits = RateLimits{MinFPS: 1, MaxFPS: 30, MinScale: 0.25, MaxScale: 1, MinQuality: 20, MaxQuality: 90}
+
+const (
+	// below smoothFPS the controller would rather send smaller frames more
+	// often, and it only scales back up once that still leaves upscaleFPS
+	smoothFPS     = 10
+	upscaleFPS    = 15
+	scaleStep     = 0.75
+	minLossWait   = time.Second
+	maxQueueDelay = 25 * time.Millisecond
+	firstAckWait  = 10 * time.Second
+)
+
+// sentFrame is a frame on its way to the viewer, waiting for its ack.
+type sentFrame struct {
+	seq  uint32
+	size int
+	at   time.Time
+}
+
+// rateController estimates the bandwidth to the viewer from frame acks and
+// picks the frame rate, scale and quality that fit in it. Until it has an
+// estimate it sends one frame at a time at the limits' maximum.
+type rateController struct {
+	limits RateLimits
+	now    func() time.Time
+
+	mu        sync.Mutex
+	inFlight  []sentFrame
+	inBytes   int
+	srtt      time.Duration
+	minDelay  time.Duration // lowest round trip less the time to send the frame itself
+	bandwidth float64       // bytes per second
+	fullSize  float64       // bytes in a frame at full scale
+	acked     int           // bytes acked since sampleAt
+	sampleAt  time.Time
+	congested bool
+	fps       float64
+	scale     float64
+	quality   int
+}
+
+func newRateController(limits RateLimits) *rateController {
+	if limits.MaxFPS <= 0 {
+		limits.MaxFPS = DefaultRateLimits.MaxFPS
+	}
+	if limits.MinFPS <= 0 || limits.MinFPS > limits.MaxFPS {
+		limits.MinFPS = math.Min(DefaultRateLimits.MinFPS, limits.MaxFPS)
+	}
+	if limits.MaxScale <= 0 || limits.MaxScale > 1 {
+		limits.MaxScale = 1
+	}
+	if limits.MinScale <= 0 || limits.MinScale > limits.MaxScale {
+		limits.MinScale = limits.MaxScale
+	}
+	if limits.MaxQuality <= 0 || limits.MaxQuality > 100 {
+		limits.MaxQuality = 100
+	}
+	if limits.MinQuality <= 0 || limits.MinQuality > limits.MaxQuality {
+		limits.MinQuality = limits.MaxQuality
+	}
+
+	return &rateController{limits: limits, now: time.Now, fps: limits.MaxFPS, scale: limits.MaxScale, quality: limits.MaxQuality}
+}
+
+// reset forgets the frames sent on a connection that has gone. The estimates
+// are kept as the next connection most likely takes the same path.
+func (c *rateController) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlight = nil
+	c.inBytes = 0
+	c.acked = 0
+	c.sampleAt = time.Time{}
+}
+
+// ready reports whether another frame fits in the link: what the path holds
+// while a frame crosses it, plus the frame being sent and one waiting behind
+// it. Anything more would only queue up.
+func (c *rateController) ready() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(c.now())
+	if len(c.inFlight) == 0 {
+		return true
+	}
+	if c.bandwidth == 0 {
+		return false
+	}
+
+	return float64(c.inBytes) <= c.bandwidth*c.minDelay.Seconds()+c.fullSize*c.scale*c.scale
+}
+
+// sent records frame seq of size bytes sent at scale.
+func (c *rateController) sent(seq uint32, size int, scale float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fullSize = float64(size) / (scale * scale)
+	c.inFlight = append(c.inFlight, sentFrame{seq: seq, size: size, at: c.now()})
+	c.inBytes += size
+}
+
+// ack records that the viewer received frame seq. Frames sent before it that
+// are still in flight never made it.
+func (c *rateController) ack(seq uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.inFlight) > 0 && int32(c.inFlight[0].seq-seq) < 0 {
+		c.inBytes -= c.inFlight[0].size
+		c.inFlight = c.inFlight[1:]
+		c.congested = true
+	}
+
+	if len(c.inFlight) == 0 || c.inFlight[0].seq != seq {
+		return
+	}
+
+	now := c.now()
+	frame := c.inFlight[0]
+	c.inFlight = c.inFlight[1:]
+	c.inBytes -= frame.size
+
+	rtt := now.Sub(frame.at)
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	if c.bandwidth > 0 {
+		delay := rtt - time.Duration(float64(frame.size)/c.bandwidth*float64(time.Second))
+		if delay < 0 {
+			delay = 0
+		}
+		if c.minDelay == 0 || delay < c.minDelay {
+			c.minDelay = delay
+		}
+
+		// the frame waited behind others somewhere along the path
+		if delay-c.minDelay > maxQueueDelay+c.minDelay/4 {
+			c.congested = true
+		}
+	}
+
+	if c.sampleAt.IsZero() {
+		c.sampleAt = now
+		return
+	}
+
+	// sample the delivery rate about once per round trip
+	c.acked += frame.size
+	elapsed := now.Sub(c.sampleAt)
+	if elapsed < c.srtt || elapsed < 50*time.Millisecond {
+		return
+	}
+
+	c.bandwidth = float64(c.acked) / elapsed.Seconds()
+	c.acked = 0
+	c.sampleAt = now
+	c.adjust()
+}
+
+// expire treats frames that are long overdue as lost, which only happens on
+// unreliable transports. A frame may take a while to arrive behind the ones
+// before it, and without an estimate there's no telling how long.
+func (c *rateController) expire(now time.Time) {
+	wait := firstAckWait
+	if c.bandwidth > 0 {
+		wait = 4*c.srtt + time.Duration(float64(c.inBytes)/c.bandwidth*float64(time.Second))
+		if wait < minLossWait {
+			wait = minLossWait
+		}
+	}
+
+	lost := false
+	for len(c.inFlight) > 0 && now.Sub(c.inFlight[0].at) > wait {
+		c.inBytes -= c.inFlight[0].size
+		c.inFlight = c.inFlight[1:]
+		lost = true
+	}
+
+	if lost && c.bandwidth > 0 {
+		c.bandwidth *= 0.7
+		c.congested = true
+		c.adjust()
+	}
+}
+
+// adjust picks new settings for the current estimate. Without congestion it
+// aims a little above what was delivered so the estimate can grow, as the
+// delivery rate never exceeds what we send.
+func (c *rateController) adjust() {
+	if c.fullSize == 0 {
+		return
+	}
+
+	budget := c.bandwidth * 1.25
+	if c.congested {
+		budget = c.bandwidth * 0.8
+		c.congested = false
+	}
+
+	// frame size goes with the area sent, so halving the scale fits four
+	// times the frames
+	fullFPS := budget / c.fullSize
+	fpsAt := func(scale float64) float64 { return fullFPS / (scale * scale) }
+
+	for c.scale > c.limits.MinScale && fpsAt(c.scale) < smoothFPS {
+		c.scale = math.Max(c.scale*scaleStep, c.limits.MinScale)
+	}
+	for c.scale < c.limits.MaxScale && fpsAt(math.Min(c.scale/scaleStep, c.limits.MaxScale)) >= upscaleFPS {
+		c.scale = math.Min(c.scale/scaleStep, c.limits.MaxScale)
+	}
+
+	c.fps = math.Max(c.limits.MinFPS, math.Min(c.limits.MaxFPS, fpsAt(c.scale)))
+
+	headroom := math.Min(1, fullFPS/c.limits.MaxFPS)
+	c.quality = c.limits.MinQuality + int(headroom*float64(c.limits.MaxQuality-c.limits.MinQuality))
+}
+
+// settings returns the time to wait between captures and the scale and
+// quality to send them at.
+func (c *rateController) settings() (time.Duration, float64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(float64(time.Second) / c.fps), c.scale, c.quality
+}
+
+// scaleFrame shrinks img to scale of its size by sampling the nearest pixel,
+// which is cheap enough to run on every frame. It works on BGRA as well as
+// RGBA since it only moves whole pixels.
+func scaleFrame(img *image.RGBA, scale float64) *image.RGBA {
+	if scale >= 1 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w := int(float64(bounds.Dx()) * scale)
+	h := int(float64(bounds.Dy()) * scale)
+	if w < 1 || h < 1 {
+		return img
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		src := img.Pix[(y*bounds.Dy()/h)*img.Stride:]
+		dst := out.Pix[y*out.Stride:]
+		for x := 0; x < w; x++ {
+			sx := x * bounds.Dx() / w * 4
+			copy(dst[x*4:x*4+4], src[sx:sx+4])
+		}
+	}
+
+	return out
+}
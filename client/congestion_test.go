@@ -0,0 +1,132 @@
+package client
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+const fullFrame = 1920 * 1080 * 4
+
+// simulate runs c against a link that delivers bandwidth bytes per second
+// one frame at a time, with rtt added on top, for d of simulated time. It
+// returns the bytes per second the viewer received over the last quarter.
+func simulate(c *rateController, bandwidth float64, rtt time.Duration, d time.Duration) float64 {
+	clock := time.Unix(0, 0)
+	c.now = func() time.Time { return clock }
+	c.reset()
+
+	type ack struct {
+		seq uint32
+		at  time.Time
+	}
+	var acks []ack
+	var seq uint32
+	var linkFree, nextCapture time.Time
+	delivered := 0
+	end := clock.Add(d)
+	measureFrom := clock.Add(d * 3 / 4)
+
+	for ; clock.Before(end); clock = clock.Add(time.Millisecond) {
+		for len(acks) > 0 && !acks[0].at.After(clock) {
+			c.ack(acks[0].seq)
+			acks = acks[1:]
+		}
+
+		if clock.Before(nextCapture) {
+			continue
+		}
+
+		interval, scale, _ := c.settings()
+		nextCapture = clock.Add(interval)
+		if !c.ready() {
+			continue
+		}
+
+		size := int(fullFrame * scale * scale)
+		seq++
+		c.sent(seq, size, scale)
+
+		if linkFree.Before(clock) {
+			linkFree = clock
+		}
+		linkFree = linkFree.Add(time.Duration(float64(size) / bandwidth * float64(time.Second)))
+		acks = append(acks, ack{seq, linkFree.Add(rtt)})
+		if linkFree.After(measureFrom) && linkFree.Before(end) {
+			delivered += size
+		}
+	}
+
+	return float64(delivered) / (d / 4).Seconds()
+}
+
+func TestRateControllerFastLink(t *testing.T) {
+	c := newRateController(DefaultRateLimits)
+	simulate(c, 1e9, 5*time.Millisecond, 20*time.Second)
+
+	interval, scale, quality := c.settings()
+	if interval != time.Second/30 || scale != 1 || quality != DefaultRateLimits.MaxQuality {
+		t.Fatalf("settled on %s, scale %.2f, quality %d", interval, scale, quality)
+	}
+}
+
+func TestRateControllerSlowLink(t *testing.T) {
+	const bandwidth = 2e6 // 16 Mbit/s, a fraction of a raw 1080p frame
+	c := newRateController(DefaultRateLimits)
+	got := simulate(c, bandwidth, 50*time.Millisecond, 60*time.Second)
+
+	interval, scale, quality := c.settings()
+	t.Logf("settled on %s, scale %.2f, quality %d, %.0f bytes/s", interval, scale, quality, got)
+
+	if scale >= 1 || scale < DefaultRateLimits.MinScale {
+		t.Fatalf("scale %.2f", scale)
+	}
+	if interval > time.Second {
+		t.Fatalf("frame rate fell to one per %s", interval)
+	}
+	if got < bandwidth/2 {
+		t.Fatalf("only used %.0f of %.0f bytes/s", got, float64(bandwidth))
+	}
+	if len(c.inFlight) > 4 {
+		t.Fatalf("%d frames in flight", len(c.inFlight))
+	}
+}
+
+func TestRateControllerLimits(t *testing.T) {
+	limits := RateLimits{MinFPS: 2, MaxFPS: 10, MinScale: 0.5, MaxScale: 0.5}
+	c := newRateController(limits)
+
+	simulate(c, 1e9, 5*time.Millisecond, 10*time.Second)
+	if interval, scale, _ := c.settings(); interval != time.Second/10 || scale != 0.5 {
+		t.Fatalf("fast link: %s, scale %.2f", interval, scale)
+	}
+
+	simulate(c, 1e5, 50*time.Millisecond, 60*time.Second)
+	if interval, scale, _ := c.settings(); interval != time.Second/2 || scale != 0.5 {
+		t.Fatalf("slow link: %s, scale %.2f", interval, scale)
+	}
+}
+
+func TestScaleFrame(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i / 4)
+	}
+
+	out := scaleFrame(img, 0.5)
+	if out.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Fatalf("scaled to %v", out.Bounds())
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			want := byte(y*2*8 + x*2)
+			if p := out.Pix[y*out.Stride+x*4 : y*out.Stride+x*4+4]; p[0] != want || p[3] != want {
+				t.Fatalf("pixel %d,%d is %v, want %d", x, y, p, want)
+			}
+		}
+	}
+
+	if scaleFrame(img, 1) != img {
+		t.Fatal("full scale copied the frame")
+	}
+}
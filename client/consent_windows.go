@@ -0,0 +1,168 @@
+package client
+
+import (
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/win"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	indicatorClass  = "ghostviewerIndicator"
+	indicatorWidth  = 420
+	indicatorHeight = 72
+	stopButtonID    = 1
+	indicatorHide   = win.WM_APP // sent when the session is over
+)
+
+var (
+	indicatorOnce  sync.Once
+	indicatorErr   error
+	indicatorMutex sync.Mutex
+	indicatorStops = map[win.HWND]func(){}
+)
+
+// DesktopConsent asks with a message box on the shared desktop, and keeps a
+// small window with a "Stop sharing" button on top of everything else for as
+// long as the session lasts.
+type DesktopConsent struct{}
+
+func (DesktopConsent) Ask(viewer string, access string) string {
+	text := fmt.Sprintf("%s wants to see your screen.\n\nAllow it?", viewer)
+	flags := uint32(win.MB_YESNO)
+	if access == protocol.AccessControl {
+		text = fmt.Sprintf("%s wants to see your screen and control your mouse and keyboard.\n\n"+
+			"Yes: allow control\nNo: allow viewing only\nCancel: decline", viewer)
+		flags = win.MB_YESNOCANCEL
+	}
+
+	answer, err := win.MessageBox(0, utf16(text), utf16("ghostviewer"), flags|win.MB_ICONQUESTION|win.MB_TOPMOST|win.MB_SETFOREGROUND)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Consent prompt failed: %s\n", err)
+		return ""
+	}
+
+	switch {
+	case answer == win.IDYES:
+		return access
+	case answer == win.IDNO && access == protocol.AccessControl:
+		return protocol.AccessView
+	}
+	return ""
+}
+
+func (DesktopConsent) Indicate(viewer string, access string, stop func()) (func(), error) {
+	text := "Sharing your screen with " + viewer
+	if access == protocol.AccessControl {
+		text = viewer + " can see and control your screen"
+	}
+
+	created := make(chan indicatorResult, 1)
+	go runIndicator(text, stop, created)
+
+	result := <-created
+	if result.err != nil {
+		return nil, fmt.Errorf("can't show the sharing indicator: %w", result.err)
+	}
+	return func() {
+		win.PostMessage(result.hwnd, indicatorHide, 0, 0)
+	}, nil
+}
+
+// indicatorResult is the indicator's window, or why it couldn't be created.
+type indicatorResult struct {
+	hwnd win.HWND
+	err  error
+}
+
+// runIndicator shows the indicator and runs its message loop until it is
+// closed, on a thread of its own as windows belong to the thread that created
+// them.
+func runIndicator(text string, stop func(), created chan<- indicatorResult) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	indicatorOnce.Do(func() {
+		class := win.WNDCLASSEX{
+			LpfnWndProc:   syscall.NewCallback(indicatorProc),
+			HbrBackground: win.HANDLE(win.COLOR_WINDOW + 1),
+			LpszClassName: utf16(indicatorClass),
+		}
+		class.CbSize = uint32(unsafe.Sizeof(class))
+		_, indicatorErr = win.RegisterClassEx(&class)
+	})
+	if indicatorErr != nil {
+		created <- indicatorResult{err: indicatorErr}
+		return
+	}
+
+	x := (win.GetSystemMetrics(win.SM_CXSCREEN) - indicatorWidth) / 2
+	hwnd, err := win.CreateWindowEx(win.WS_EX_TOPMOST|win.WS_EX_TOOLWINDOW, utf16(indicatorClass), utf16("ghostviewer"),
+		win.WS_POPUP|win.WS_CAPTION|win.WS_VISIBLE, x, 0, indicatorWidth, indicatorHeight, 0, 0, 0, 0)
+	if err != nil {
+		created <- indicatorResult{err: err}
+		return
+	}
+
+	indicatorMutex.Lock()
+	indicatorStops[hwnd] = stop
+	indicatorMutex.Unlock()
+
+	win.CreateWindowEx(0, utf16("STATIC"), utf16(text), win.WS_CHILD|win.WS_VISIBLE, 10, 12, 280, 20, hwnd, 0, 0, 0)
+	win.CreateWindowEx(0, utf16("BUTTON"), utf16("Stop sharing"), win.WS_CHILD|win.WS_VISIBLE|win.BS_PUSHBUTTON,
+		300, 6, 100, 30, hwnd, win.HANDLE(stopButtonID), 0, 0)
+	created <- indicatorResult{hwnd: hwnd}
+
+	var msg win.MSG
+	for {
+		if r, err := win.GetMessage(&msg, 0, 0, 0); r == 0 || err != nil {
+			return
+		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
+	}
+}
+
+func indicatorProc(hwnd win.HWND, msg uint32, wParam uintptr, lParam uintptr) uintptr {
+	switch msg {
+	case win.WM_COMMAND, win.WM_CLOSE:
+		// closing the indicator stops sharing too, so it can't be gone
+		// while the session goes on
+		if msg == win.WM_COMMAND && wParam&0xffff != stopButtonID {
+			break
+		}
+
+		indicatorMutex.Lock()
+		stop := indicatorStops[hwnd]
+		indicatorMutex.Unlock()
+		if stop != nil {
+			// saying goodbye may block on the network, which mustn't
+			// freeze the window
+			go stop()
+		}
+		win.DestroyWindow(hwnd)
+		return 0
+	case indicatorHide:
+		win.DestroyWindow(hwnd)
+		return 0
+	case win.WM_DESTROY:
+		indicatorMutex.Lock()
+		delete(indicatorStops, hwnd)
+		indicatorMutex.Unlock()
+		win.PostQuitMessage(0)
+		return 0
+	}
+	return win.DefWindowProc(hwnd, msg, wParam, lParam)
+}
+
+func utf16(s string) *uint16 {
+	p, err := syscall.UTF16PtrFromString(s)
+	if err != nil {
+		p, _ = syscall.UTF16PtrFromString("?")
+	}
+	return p
+}
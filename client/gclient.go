@@ -1,61 +1,458 @@
 package client
 
 import (
+	"errors"
 	"fmt"
-	"ghostviewer/screenshot"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"image"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
-var fps = 30
+// maxHostnameLength is as long as a DNS name gets, which is plenty for a
+// viewer's name in the consent prompt.
+const maxHostnameLength = 253
 
 type GClient interface {
 	Connect() error
-	Receive()
-	Disconnect(string)
-	SendFrame([]byte, int, int) error
+	Receive(chan protocol.Message)
+	Disconnect(protocol.Goodbye)
+	SendFrame(protocol.Frame) error
+	Session() protocol.Session
+	Events() <-chan transport.StateEvent
 }
 
-func ClientCommunicate(ghostclient GClient) {
-	runtime.LockOSThread() // lock so windows/dxgi/d3d11 can use threadlocal caches, if any
-	screenshot.InitializeScreenshotInterface()
-	defer func() {
-		if screenshot.DDUP != nil {
-			screenshot.DDUP.Release()
-			screenshot.DDUP = nil
+// CaptureLostTimeout is how long capture may keep failing before the sharer
+// gives up and tells the viewer the capture device is gone.
+var CaptureLostTimeout = 10 * time.Second
+
+// ResumeTimeout is how long the sharer keeps trying to get back to a viewer
+// it lost. The viewer only keeps the session for as long, so trying any
+// longer would just keep the screen captured for nobody.
+var ResumeTimeout = 2 * time.Minute
+
+// errNotConnected is returned for a frame sent before Connect has succeeded.
+var errNotConnected = errors.New("not connected to a viewer")
+
+// ConnectWithRetry calls Connect until it succeeds, backing off between
+// attempts. It gives up after maxAttempts failures, or never if maxAttempts
+// is 0, and stops early if the viewer or relay refuses the session outright,
+// either side rejects the other's PIN, the viewer's certificate isn't the one
+// trusted, the stream to the viewer can't be reopened or the session has been
+// ended with a goodbye, which it returns.
+func ConnectWithRetry(ghostclient GClient, maxAttempts int) error {
+	return connectWithRetry(ghostclient, maxAttempts, time.Time{})
+}
+
+// connectWithRetry is ConnectWithRetry that also gives up once deadline has
+// passed, unless it is zero.
+func connectWithRetry(ghostclient GClient, maxAttempts int, deadline time.Time) error {
+	backoff := transport.DefaultBackoff
+	for attempt := 1; ; attempt++ {
+		if bye, ok := ended(ghostclient); ok {
+			return bye
+		}
+
+		err := ghostclient.Connect()
+		if err == nil || errors.Is(err, protocol.ErrRefused) || errors.Is(err, protocol.ErrIncompatible) || errors.Is(err, protocol.ErrAuthFailed) ||
+			errors.Is(err, transport.ErrInviteCode) || errors.Is(err, transport.ErrRelayRefused) ||
+			errors.Is(err, transport.ErrStreamClosed) {
+			return err
+		}
+
+		// connecting again would only trust the impostor more
+		var keyErr *transport.HostKeyError
+		if errors.As(err, &keyErr) {
+			return err
+		}
+
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			return err
+		}
+
+		delay := backoff.Next()
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return err
+			}
+			if delay > left {
+				delay = left
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Connect failed: %s, retrying in %s\n", err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// endable is implemented by the clients in this package, which remember a
+// session being ended on purpose.
+type endable interface {
+	hangUp(bye protocol.Goodbye)
+	goodbye() (protocol.Goodbye, bool)
+}
+
+// ended reports why ghostclient's session was ended, by us or the viewer, if
+// it was.
+func ended(ghostclient GClient) (protocol.Goodbye, bool) {
+	if h, ok := ghostclient.(endable); ok {
+		return h.goodbye()
+	}
+	return protocol.Goodbye{}, false
+}
+
+// ClientCommunicate asks consent to share with the connected viewer, then
+// streams the screen from capturer to it and replays its input through input
+// if that was allowed, reconnecting whenever the link drops. Viewers of a
+// broadcast that connect later are asked about one by one, and added to the
+// indicator once allowed. The frame rate and scale adapt to the bandwidth the
+// viewer's acks show, within limits. It returns once either side ends the
+// session with a goodbye, which it sends itself if consent is refused or
+// capture fails for CaptureLostTimeout, or once the viewer has been gone for
+// ResumeTimeout.
+func ClientCommunicate(ghostclient GClient, capturer Capturer, input InputDriver, consent Consent, limits RateLimits) {
+	// one prompt at a time: a viewer joining a broadcast waits for the user
+	// to answer about the others, and for the indicator to list them
+	var prompt sync.Mutex
+	var shown []protocol.Hello // the viewers on the indicator, with the access they got
+	var hide func()
+	control := false
+	stopSharing := func() {
+		ghostclient.Disconnect(protocol.Goodbye{Code: protocol.GoodbyeUserEnded, Reason: "stopped sharing"})
+	}
+	// indicate puts shown on the indicator in place of the one up, if any.
+	// prompt must be held.
+	indicate := func() error {
+		viewer, access := consentRequest(shown)
+		next, err := consent.Indicate(viewer, access, stopSharing)
+		if err != nil {
+			return err
 		}
+		if hide != nil {
+			hide()
+		}
+		hide = next
+		return nil
+	}
+
+	prompt.Lock()
+	peers := []protocol.Hello{ghostclient.Session().Peer}
+	if b, ok := ghostclient.(*Broadcast); ok {
+		peers = b.consentRequest(func(peer protocol.Hello) string {
+			prompt.Lock()
+			defer prompt.Unlock()
+
+			if hide == nil {
+				// sharing was declined or is over
+				return ""
+			}
+			viewer, access := consentRequest([]protocol.Hello{peer})
+			allowed := consent.Ask(viewer, access)
+			if allowed == "" {
+				return ""
+			}
+
+			peer.Access = allowed
+			if !control {
+				peer.Access = protocol.AccessView
+			}
+			shown = append(shown, peer)
+			if err := indicate(); err != nil {
+				fmt.Fprintf(os.Stderr, "Not sharing with %s: %s\n", viewer, err)
+				shown = shown[:len(shown)-1]
+				return ""
+			}
+			return allowed
+		})
+	}
+
+	// heartbeats are only answered while something receives, so the viewer
+	// is listened to while the user makes up their mind, and anything it
+	// sends meanwhile dropped
+	messages := make(chan protocol.Message)
+	go ghostclient.Receive(messages)
+	asked := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case <-asked:
+				return
+			case _, ok := <-messages:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	viewer, access := consentRequest(peers)
+	allowed := ""
+	if consent != nil {
+		allowed = consent.Ask(viewer, access)
+	}
+	close(asked)
+	<-drained
+
+	// the answer can't grant more than was asked
+	control = allowed == protocol.AccessControl && access == protocol.AccessControl
+	if !control {
+		access = protocol.AccessView
+	}
 
-		screenshot.Device.Release()
-		screenshot.DeviceCtx.Release()
+	var err error
+	if allowed != "" {
+		for _, peer := range peers {
+			peer.Access = access
+			shown = append(shown, peer)
+		}
+		err = indicate()
+	}
+	prompt.Unlock()
+	if allowed == "" || err != nil {
+		bye := protocol.Goodbye{Code: protocol.GoodbyeDeclined}
+		if err != nil {
+			// sharing without the user being able to see it isn't sharing
+			// they agreed to
+			fmt.Fprintf(os.Stderr, "Not sharing with %s: %s\n", viewer, err)
+			bye.Reason = "couldn't show the sharing indicator"
+		} else {
+			fmt.Fprintf(os.Stderr, "Declined to share with %s\n", viewer)
+		}
+		ghostclient.Disconnect(bye)
+		for range messages {
+		}
+		return
+	}
+	defer func() {
+		prompt.Lock()
+		hide()
+		hide = nil
+		prompt.Unlock()
 	}()
 
+	rate := newRateController(limits)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var lastMutex sync.Mutex
+	var last *image.RGBA
+	var lastAt time.Time
+	var sentSize image.Point // size of the last frame sent, to map pointers back
+	var seq uint32
+	connected := int32(1)
+
+	send := func(frame *image.RGBA, capturedAt time.Time) {
+		_, scale, _ := rate.settings()
+		scaled := scaleFrame(frame, scale)
+
+		lastMutex.Lock()
+		sentSize = scaled.Bounds().Size()
+		lastMutex.Unlock()
+
+		msg := protocol.Frame{
+			Width:     uint32(scaled.Bounds().Dx()),
+			Height:    uint32(scaled.Bounds().Dy()),
+			Pix:       scaled.Pix,
+			Seq:       atomic.AddUint32(&seq, 1),
+			Timestamp: capturedAt.UnixNano(),
+		}
+		// recorded first, as the ack can be back before SendFrame returns
+		rate.sent(msg.Seq, len(scaled.Pix), float64(scaled.Bounds().Dx())/float64(frame.Bounds().Dx()))
+		if err := ghostclient.SendFrame(msg); err != nil {
+			fmt.Fprintf(os.Stderr, "Send error: %s\n", err)
+		}
+	}
+
+	sendLast := func() {
+		lastMutex.Lock()
+		frame, at := last, lastAt
+		lastMutex.Unlock()
+
+		if frame != nil {
+			send(frame, at)
+		}
+	}
+
+	// the viewer clicks on the frame it was sent, which may be scaled down
+	toScreen := func(p protocol.Pointer) protocol.Pointer {
+		lastMutex.Lock()
+		defer lastMutex.Unlock()
+
+		if last == nil || sentSize.X == 0 || sentSize.Y == 0 {
+			return p
+		}
+		p.X = int32(int(p.X) * last.Bounds().Dx() / sentSize.X)
+		p.Y = int32(int(p.Y) * last.Bounds().Dy() / sentSize.Y)
+		return p
+	}
+
 	go func() {
-		j := 0
-		t := time.Now()
+		runtime.LockOSThread() // lock so windows/dxgi/d3d11 can use threadlocal caches, if any
+		defer capturer.Close()
+
+		var failingSince time.Time
 		for {
-			if time.Since(t) >= time.Second {
-				j = 0
-				t = time.Now()
+			select {
+			case <-stop:
+				return
+			default:
 			}
-			cap, _ := screenshot.CaptureScreen()
-			j++
 
+			start := time.Now()
+			cap, err := capturer.Capture()
+			if err != nil {
+				if failingSince.IsZero() {
+					failingSince = start
+				} else if time.Since(failingSince) > CaptureLostTimeout {
+					fmt.Fprintf(os.Stderr, "Capture failing since %s: %s\n", failingSince.Format(time.TimeOnly), err)
+					ghostclient.Disconnect(protocol.Goodbye{Code: protocol.GoodbyeCaptureLost, Reason: err.Error()})
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			failingSince = time.Time{}
 			if cap == nil {
 				continue
 			}
+			capturedAt := time.Now()
+
+			lastMutex.Lock()
+			last, lastAt = cap, capturedAt
+			lastMutex.Unlock()
 
-			if err := ghostclient.SendFrame(cap.Pix, cap.Bounds().Dx(), cap.Bounds().Dy()); err != nil {
-				fmt.Fprintf(os.Stderr, "Send error: %s\nAttempting reconnect...", err)
-				time.Sleep(5 * time.Second)
-				fmt.Println(err)
-				os.Exit(1)
+			if atomic.LoadInt32(&connected) == 0 {
+				// keep capturing so the viewer gets a current frame on resume
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			// a frame that doesn't fit in the link is skipped rather than
+			// queued, so the viewer always gets the freshest screen
+			if rate.ready() {
+				send(cap, capturedAt)
 			}
-			time.Sleep(time.Millisecond * 0)
+
+			interval, _, _ := rate.settings()
+			time.Sleep(interval - time.Since(start))
 		}
 	}()
 
 	for {
-		ghostclient.Receive()
+		if !control {
+			viewOnly(ghostclient)
+		}
+
+		dispatch(ghostclient, messages, input, control, sendLast, rate, toScreen)
+
+		atomic.StoreInt32(&connected, 0)
+		if bye, ok := ended(ghostclient); ok {
+			fmt.Fprintf(os.Stderr, "Session ended: %s\n", bye)
+			return
+		}
+
+		fmt.Fprintln(os.Stderr, "Lost connection to viewer, reconnecting...")
+		if err := connectWithRetry(ghostclient, 0, time.Now().Add(ResumeTimeout)); err != nil {
+			var bye protocol.Goodbye
+			if errors.As(err, &bye) {
+				fmt.Fprintf(os.Stderr, "Session ended: %s\n", bye)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Reconnect failed: %s\n", err)
+			return
+		}
+		rate.reset()
+		atomic.StoreInt32(&connected, 1)
+		messages = make(chan protocol.Message)
+		go ghostclient.Receive(messages)
+		sendLast()
+	}
+}
+
+// consentRequest names the viewers in peers, and the access they ask for.
+// Control is assumed unless they all only ask to view. The names come from
+// the viewers, so they are quoted and stripped of anything that could make
+// the prompt say something else.
+func consentRequest(peers []protocol.Hello) (string, string) {
+	var names []string
+	access := protocol.AccessView
+	for _, peer := range peers {
+		name := strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, peer.Hostname)
+		if len(name) > maxHostnameLength {
+			name = name[:maxHostnameLength] + "..."
+		}
+		names = append(names, strconv.Quote(name))
+		if peer.Access != protocol.AccessView {
+			access = protocol.AccessControl
+		}
+	}
+	return strings.Join(names, ", "), access
+}
+
+// viewOnly tells the viewer its input won't be replayed.
+func viewOnly(ghostclient GClient) {
+	if b, ok := ghostclient.(*Broadcast); ok {
+		b.setViewOnly()
+		return
+	}
+	if sender, ok := ghostclient.(messageSender); ok {
+		sender.SendMessage(protocol.Control{Code: protocol.ControlInputRevoked})
+	}
+}
+
+// dispatch handles messages from the viewer until the connection drops. Input
+// is only replayed with control.
+func dispatch(ghostclient GClient, messages chan protocol.Message, input InputDriver, control bool, sendLast func(), rate *rateController, toScreen func(protocol.Pointer) protocol.Pointer) {
+	for msg := range messages {
+		var seq uint32
+		switch m := msg.(type) {
+		case protocol.Control:
+			switch m.Code {
+			case protocol.ControlRefresh:
+				// the screen may not have changed since the lost frame, so
+				// resend what we have rather than waiting for a new capture
+				sendLast()
+			case protocol.ControlFrameAck:
+				rate.ack(uint32(m.Value))
+			}
+			continue
+		case protocol.Error:
+			fmt.Fprintf(os.Stderr, "Viewer error: %s\n", m.Reason)
+			continue
+		case protocol.Pointer:
+			seq = m.Seq
+			msg = toScreen(m)
+		case protocol.Key:
+			seq = m.Seq
+		case protocol.Scroll:
+			seq = m.Seq
+		default:
+			continue
+		}
+
+		if !control || !ghostclient.Session().HasChannel(protocol.ChannelInput) {
+			continue
+		}
+
+		input.Inject(msg)
+
+		// lets the viewer time the round trip of its input
+		if sender, ok := ghostclient.(messageSender); ok {
+			sender.SendMessage(protocol.Control{Code: protocol.ControlInputAck, Value: uint64(seq)})
+		}
 	}
 }
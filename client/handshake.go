@@ -0,0 +1,42 @@
+package client
+
+import (
+	"fmt"
+	"ghostviewer/protocol"
+	"time"
+)
+
+// HandshakeTimeout is how long the viewer has to answer our hello and finish
+// the PIN exchange, so one that takes the connection and then says nothing
+// can't hold Connect up forever.
+var HandshakeTimeout = 10 * time.Second
+
+// LocalHello describes this machine to the viewer during the handshake.
+func LocalHello(transport string, capturer Capturer) protocol.Hello {
+	width, height := 0, 0
+	if rect, err := capturer.Bounds(); err == nil {
+		width, height = rect.Dx(), rect.Dy()
+	}
+
+	return protocol.NewHello(transport, width, height)
+}
+
+// handshake sends our hello, waits for the viewer's reply and records the
+// features both sides support. binding is the connection's, for the PIN.
+func (s *sessionState) handshake(r *protocol.PacketReader, w *protocol.PacketWriter, local protocol.Hello, binding []byte) error {
+	data, err := s.hello(local)
+	if err != nil {
+		return err
+	}
+
+	if err := w.WritePacket(data); err != nil {
+		return err
+	}
+
+	data, err = r.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	return s.accept(local, data, binding, r.ReadPacket, w.WritePacket)
+}
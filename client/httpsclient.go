@@ -1,69 +1,135 @@
 package client
 
 import (
-	"bytes"
 	"crypto/tls"
-	"encoding/gob"
 	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"net"
 	"net/url"
-	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type HTTPSGClient struct {
-	Ip   string
-	Port int
-	Conn *websocket.Conn
+	sessionState
+	Ip    string
+	Port  int
+	Path  string // the websocket's path on the server, /ws if empty
+	Plain bool   // ws:// instead of wss://, e.g. to a viewer on localhost
+	// Fingerprint pins the viewer's certificate. Without it the certificate
+	// is trusted on first use and checked against KnownHosts after that.
+	Fingerprint string
+	KnownHosts  *transport.KnownHosts // transport.DefaultKnownHosts if nil
+	TLSConfig   *tls.Config           // overrides KnownHosts when set; Fingerprint is checked too
+	Conn        *websocket.Conn
+	Proxy       *url.URL // overrides HTTPS_PROXY/ALL_PROXY when set
+	Hello       protocol.Hello
+	Heartbeat   transport.Heartbeat
+	writeMutex  sync.Mutex // websocket.Conn allows only one concurrent writer
 }
 
 func (h *HTTPSGClient) Connect() error {
-	u := url.URL{Scheme: "wss", Host: h.Ip + ":" + strconv.Itoa(h.Port), Path: "/ws"}
+	u := url.URL{Scheme: "wss", Host: net.JoinHostPort(h.Ip, strconv.Itoa(h.Port)), Path: h.Path}
+	if h.Plain {
+		u.Scheme = "ws"
+	}
+	if u.Path == "" {
+		u.Path = "/ws"
+	}
 	fmt.Println("Connecting to " + u.String())
 	dialer := *websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	c, _, err := dialer.Dial(u.String(), nil)
-	h.Conn = c
-
+	dialer.TLSClientConfig = transport.PinCertificate(h.TLSConfig, u.Host, h.Fingerprint)
+	if dialer.TLSClientConfig == nil {
+		dialer.TLSClientConfig = transport.PinnedTLSConfig(u.Host, h.Fingerprint, h.KnownHosts)
+	}
+	dialer.Proxy = nil // DialTCP applies the proxy itself
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		return transport.DialTCP(h.Proxy, addr)
+	}
+	conn, _, err := dialer.Dial(u.String(), nil)
 	if err != nil {
-		fmt.Printf("Handshake failed with server: %s", err)
-		os.Exit(1)
+		return fmt.Errorf("websocket handshake failed: %w", err)
 	}
 
+	conn.SetReadLimit(protocol.MaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	if err := h.handshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	h.Conn = conn
+	h.link.SetState(transport.StateConnected, nil)
+	go h.link.RunHeartbeat(h.Heartbeat, h.SendMessage, func() { conn.Close() })
 	return nil
 }
 
-func (h *HTTPSGClient) Receive() {
-	if _, _, err := h.Conn.ReadMessage(); err != nil {
-		fmt.Println(err)
-		return
-	} else {
-		//fmt.Println(messageType)
+func (h *HTTPSGClient) handshake(conn *websocket.Conn) error {
+	data, err := h.hello(h.Hello)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return err
 	}
+
+	_, data, err = conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	return h.accept(h.Hello, data, transport.ChannelBinding(conn), func() ([]byte, error) {
+		_, data, err := conn.ReadMessage()
+		return data, err
+	}, func(data []byte) error {
+		return conn.WriteMessage(websocket.BinaryMessage, data)
+	})
 }
 
-func (h *HTTPSGClient) SendMessage(msg Message) error {
-	bin_buf := new(bytes.Buffer)
-	gobobj := gob.NewEncoder(bin_buf)
-	gobobj.Encode(msg)
-	databytes := bin_buf.Bytes()
-	err := h.Conn.WriteMessage(websocket.BinaryMessage, databytes)
+func (h *HTTPSGClient) Receive(output chan protocol.Message) {
+	defer h.Conn.Close()
+	h.receive(func() ([]byte, error) {
+		_, data, err := h.Conn.ReadMessage()
+		return data, err
+	}, h.SendMessage, output)
+}
+
+func (h *HTTPSGClient) SendMessage(msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	return err
+
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	return h.Conn.WriteMessage(websocket.BinaryMessage, data)
 }
 
-func (h *HTTPSGClient) SendFrame(img []byte, width int, height int) error {
+func (h *HTTPSGClient) SendFrame(frame protocol.Frame) error {
 	if h.Conn == nil {
-		fmt.Println("Invalid connection")
-		os.Exit(1)
+		return errNotConnected
 	}
-	msg := Message{"FRAME:" + strconv.Itoa(width) + ":" + strconv.Itoa(height), img}
-	return h.SendMessage(msg)
+	return h.SendMessage(frame)
+}
+
+func (h *HTTPSGClient) sendEncodedFrame(data []byte) error {
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	return h.Conn.WriteMessage(websocket.BinaryMessage, data)
 }
 
-func (h *HTTPSGClient) Disconnect(message string) {
+func (h *HTTPSGClient) Disconnect(bye protocol.Goodbye) {
+	h.hangUp(bye)
+	h.link.SetState(transport.StateDisconnected, nil)
+	h.SendMessage(bye)
+	h.writeMutex.Lock()
+	h.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, bye.Code.String()), time.Now().Add(time.Second))
+	h.writeMutex.Unlock()
+	h.Conn.Close()
 }
@@ -0,0 +1,19 @@
+package client
+
+import "ghostviewer/transport"
+
+// PipeGClient connects to a PipeGServer in the same process. Past the
+// listener it behaves like TCPGClient.
+type PipeGClient struct {
+	TCPGClient
+	Listener *transport.PipeListener
+}
+
+func (h *PipeGClient) Connect() error {
+	conn, err := h.Listener.Dial()
+	if err != nil {
+		return err
+	}
+
+	return h.start(conn)
+}
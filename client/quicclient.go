@@ -0,0 +1,101 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"net"
+	"strconv"
+	"time"
+)
+
+type QUICGClient struct {
+	sessionState
+	Ip        string
+	Port      int
+	Conn      *transport.QUICConn
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+	TLSConfig *tls.Config // overrides KnownHosts when set; Fingerprint is checked too
+	// Fingerprint pins the viewer's certificate. Without it the certificate
+	// is trusted on first use and checked against KnownHosts after that.
+	Fingerprint string
+	KnownHosts  *transport.KnownHosts // transport.DefaultKnownHosts if nil
+}
+
+func (h *QUICGClient) Connect() error {
+	addr := net.JoinHostPort(h.Ip, strconv.Itoa(h.Port))
+	conf := transport.PinCertificate(h.TLSConfig, addr, h.Fingerprint)
+	if conf == nil {
+		conf = transport.PinnedTLSConfig(addr, h.Fingerprint, h.KnownHosts)
+	}
+
+	conn, err := transport.DialQUIC(addr, conf)
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	if err := h.handshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	h.Conn = conn
+	h.link.SetState(transport.StateConnected, nil)
+	go h.link.RunHeartbeat(h.Heartbeat, h.SendMessage, func() { conn.Close() })
+	return nil
+}
+
+func (h *QUICGClient) handshake(conn *transport.QUICConn) error {
+	data, err := h.hello(h.Hello)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.Write(data); err != nil {
+		return err
+	}
+
+	data, err = conn.Read()
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	return h.accept(h.Hello, data, conn.ChannelBinding(), conn.Read, conn.Write)
+}
+
+func (h *QUICGClient) Receive(output chan protocol.Message) {
+	defer h.Conn.Close()
+	h.receive(h.Conn.Read, h.SendMessage, output)
+}
+
+func (h *QUICGClient) SendMessage(msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return h.Conn.Write(data)
+}
+
+func (h *QUICGClient) SendFrame(frame protocol.Frame) error {
+	if h.Conn == nil {
+		return errNotConnected
+	}
+	return h.SendMessage(frame)
+}
+
+func (h *QUICGClient) sendEncodedFrame(data []byte) error {
+	return h.Conn.Write(data)
+}
+
+func (h *QUICGClient) Disconnect(bye protocol.Goodbye) {
+	h.hangUp(bye)
+	h.link.SetState(transport.StateDisconnected, nil)
+	h.SendMessage(bye)
+	// the viewer hangs up once it has the goodbye
+	h.Conn.Linger(time.Second)
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"ghostviewer/transport"
+	"net"
+	"strconv"
+)
+
+// RelayGClient reaches the viewer through a relay that both sides dial out
+// to, for when neither can accept connections. Past the relay it behaves
+// like TCPGClient over an end to end encrypted stream.
+type RelayGClient struct {
+	TCPGClient
+	InviteCode string
+}
+
+func (h *RelayGClient) Connect() error {
+	conn, err := transport.DialRelay(h.Proxy, net.JoinHostPort(h.Ip, strconv.Itoa(h.Port)), transport.RelaySharer, h.InviteCode)
+	if err != nil {
+		return err
+	}
+
+	return h.start(conn)
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"os"
+	"sync"
+)
+
+// sessionState is embedded by every GClient. It keeps the negotiated session
+// and the resume token across reconnects, and the link state.
+type sessionState struct {
+	mu       sync.Mutex
+	session  protocol.Session
+	token    string
+	password string
+	bye      *protocol.Goodbye // why the session ended for good, if it has
+	link     transport.Link
+}
+
+// SetPassword sets the PIN or password to prove to a viewer that asks for
+// one.
+func (s *sessionState) SetPassword(password string) {
+	s.mu.Lock()
+	s.password = password
+	s.mu.Unlock()
+}
+
+func (s *sessionState) Session() protocol.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session
+}
+
+func (s *sessionState) Events() <-chan transport.StateEvent {
+	return s.link.Events()
+}
+
+// hangUp records that we or the viewer ended the session, so it isn't
+// reconnected.
+func (s *sessionState) hangUp(bye protocol.Goodbye) {
+	s.mu.Lock()
+	s.bye = &bye
+	s.mu.Unlock()
+}
+
+func (s *sessionState) goodbye() (protocol.Goodbye, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bye == nil {
+		return protocol.Goodbye{}, false
+	}
+	return *s.bye, true
+}
+
+// hello encodes local, carrying the resume token from an earlier connection
+// so the viewer picks up the same session.
+func (s *sessionState) hello(local protocol.Hello) ([]byte, error) {
+	s.mu.Lock()
+	local.ResumeToken = s.token
+	s.mu.Unlock()
+
+	return protocol.Marshal(local)
+}
+
+// accept negotiates against the viewer's reply to our hello, then proves we
+// know its password over read and write if it asks. binding is the
+// connection's, from transport.ChannelBinding. Once we have a session, a
+// viewer that doesn't resume it is turned away with a goodbye: consent was
+// given to that session, not to whoever answers next.
+func (s *sessionState) accept(local protocol.Hello, data []byte, binding []byte, read func() ([]byte, error), write func([]byte) error) error {
+	remote, err := protocol.DecodeHello(data)
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	session, err := protocol.Negotiate(local, remote)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+	if token != "" && remote.ResumeToken != token {
+		if bye, err := protocol.Marshal(protocol.Goodbye{Code: protocol.GoodbyeDeclined, Reason: "not the session the sharer agreed to"}); err == nil {
+			write(bye)
+		}
+		return fmt.Errorf("%w: %q didn't resume the session, start sharing again to connect", protocol.ErrRefused, remote.Hostname)
+	}
+
+	if remote.Auth != "" {
+		if err := s.authenticate(remote.Auth, binding, read, write); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	resumed := token != ""
+	s.session = session
+	s.token = remote.ResumeToken
+	s.mu.Unlock()
+
+	verb := "Connected to"
+	if resumed {
+		verb = "Resumed session with"
+	}
+	fmt.Printf("%s %s (codec %s, channels %v)\n", verb, session.Peer.Hostname, session.Codec, session.Channels)
+	return nil
+}
+
+// authenticate runs the password exchange the viewer asked for, which also
+// proves the viewer knows the password. It won't over a link without a
+// channel binding, where someone in the middle could pass the exchange on
+// and keep the session.
+func (s *sessionState) authenticate(method string, binding []byte, read func() ([]byte, error), write func([]byte) error) error {
+	if method != protocol.AuthSRP {
+		return fmt.Errorf("%w: unknown auth method %q", protocol.ErrIncompatible, method)
+	}
+
+	s.mu.Lock()
+	password := s.password
+	s.mu.Unlock()
+	if password == "" {
+		return fmt.Errorf("%w: the viewer asks for a PIN", protocol.ErrAuthFailed)
+	}
+	if binding == nil {
+		return fmt.Errorf("%w: the viewer asks for a PIN over an unencrypted link", protocol.ErrAuthFailed)
+	}
+
+	srp, err := protocol.NewSRPClient(password, binding)
+	if err != nil {
+		return err
+	}
+
+	exchange := func(msg protocol.Auth) (protocol.Auth, error) {
+		data, err := protocol.Marshal(msg)
+		if err != nil {
+			return protocol.Auth{}, err
+		}
+		if err := write(data); err != nil {
+			return protocol.Auth{}, err
+		}
+
+		data, err = read()
+		if err != nil {
+			return protocol.Auth{}, fmt.Errorf("auth: %w", err)
+		}
+		return protocol.DecodeAuth(data)
+	}
+
+	challenge, err := exchange(protocol.Auth{Public: srp.Public()})
+	if err != nil {
+		return err
+	}
+
+	proof, err := srp.Proof(challenge.Salt, challenge.Public)
+	if err != nil {
+		return err
+	}
+
+	reply, err := exchange(protocol.Auth{Proof: proof})
+	if err != nil {
+		return err
+	}
+
+	if !srp.Verify(reply.Proof) {
+		return fmt.Errorf("%w: the viewer doesn't know the PIN", protocol.ErrAuthFailed)
+	}
+	return nil
+}
+
+// receive decodes messages from read into output until the connection fails
+// or the viewer says goodbye, then closes output. Heartbeats are answered here
+// and never reach output.
+func (s *sessionState) receive(read func() ([]byte, error), send func(protocol.Message) error, output chan protocol.Message) {
+	defer close(output)
+
+	for {
+		data, err := read()
+		var msg protocol.Message
+		if err == nil {
+			msg, err = protocol.Decode(data)
+		}
+
+		if err != nil {
+			var protoErr *protocol.ProtocolError
+			if errors.As(err, &protoErr) {
+				fmt.Fprintf(os.Stderr, "Closing connection: %s\n", err)
+				send(protoErr.Message())
+			}
+
+			s.link.SetState(transport.StateDisconnected, err)
+			return
+		}
+
+		if s.link.Intercept(msg, send) {
+			continue
+		}
+
+		if bye, ok := msg.(protocol.Goodbye); ok {
+			s.hangUp(bye)
+			s.link.SetState(transport.StateDisconnected, bye)
+			return
+		}
+
+		output <- msg
+	}
+}
@@ -0,0 +1,20 @@
+package client
+
+import "ghostviewer/transport"
+
+// StdioGClient speaks to the viewer over a stream such as our own stdin and
+// stdout, for when the viewer reaches us by running us over ssh. Past the
+// stream it behaves like TCPGClient.
+type StdioGClient struct {
+	TCPGClient
+	Stream *transport.Stream
+}
+
+func (h *StdioGClient) Connect() error {
+	conn, err := h.Stream.Open()
+	if err != nil {
+		return err
+	}
+
+	return h.start(conn)
+}
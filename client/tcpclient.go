@@ -1,121 +1,106 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
-	"fmt"
-	"ghostviewer/io"
+	"crypto/tls"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
 	"net"
-	"os"
+	"net/url"
 	"strconv"
 	"time"
 )
 
-const headerSize = 5
-const packetPrefix = '%'
-
-type Message struct {
-	Cmd  string
-	Data []byte
-}
-
 type TCPGClient struct {
-	Ip   string
-	Port int
-	Conn *net.TCPConn
+	sessionState
+	Ip        string
+	Port      int
+	Conn      net.Conn
+	Proxy     *url.URL // overrides HTTPS_PROXY/ALL_PROXY when set
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+	// TLS wraps the connection in TLS 1.3. The viewer's certificate is
+	// checked as HTTPSGClient checks it.
+	TLS         bool
+	TLSConfig   *tls.Config // overrides KnownHosts when set; Fingerprint is checked too
+	Fingerprint string
+	KnownHosts  *transport.KnownHosts
+	mux         *transport.Mux
 }
 
 func (h *TCPGClient) Connect() error {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", h.Ip+":"+strconv.Itoa(h.Port))
-
+	addr := net.JoinHostPort(h.Ip, strconv.Itoa(h.Port))
+	conn, err := transport.DialTCP(h.Proxy, addr)
 	if err != nil {
 		return err
 	}
 
-	for i := 0; i < 10; i++ {
-		h.Conn, err = net.DialTCP("tcp", nil, tcpAddr)
-		if err == nil {
-			break
-		}
-		fmt.Println(err)
-		fmt.Println("Connect failed, sleeping 5 seconds")
-		time.Sleep(5 * time.Second)
-	}
-
-	return nil
-}
-
-func (h *TCPGClient) ProcessRead(data *bytes.Buffer) (done bool) {
-	done = false
-
-	for {
-		if len(data.Bytes()) == 0 {
-			return
+	if h.TLS {
+		conf := transport.PinnedTLSConfig(addr, h.Fingerprint, h.KnownHosts)
+		if h.TLSConfig != nil {
+			conf = transport.PinCertificate(h.TLSConfig.Clone(), addr, h.Fingerprint)
+			if conf.ServerName == "" {
+				conf.ServerName = h.Ip
+			}
 		}
 
-		if data.Bytes()[0] != packetPrefix { // check for prefix
-			done = true
-			return
+		if conn, err = transport.TLSClient(conn, conf); err != nil {
+			return err
 		}
+	}
 
-		var dataSize int
-		if data.Len() > headerSize {
-			dataSize = int(binary.LittleEndian.Uint32(data.Bytes()[1:5])) // All UI events follow the partten Left Mouse Click -> ML:x:y;, Key A Press -> K:char:idx;
-		} else {
-			return
-		}
+	return h.start(conn)
+}
 
-		packetSize := headerSize + dataSize
-		if data.Len() < packetSize {
-			return
-		}
+// start runs the handshake over a freshly dialed conn and brings the link up.
+func (h *TCPGClient) start(conn net.Conn) error {
+	reader, writer := protocol.NewPacketReader(conn), protocol.NewPacketWriter(conn)
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	if err := h.handshake(reader, writer, h.Hello, transport.ChannelBinding(conn)); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
 
-		packet := data.Next(packetSize)[5:]
-		encodedMsgs := bytes.Split(packet, []byte{';'})
+	h.Conn, h.mux = conn, transport.NewMux(reader, writer, true)
+	h.link.SetState(transport.StateConnected, nil)
+	go h.link.RunHeartbeat(h.Heartbeat, h.SendMessage, func() { conn.Close() })
+	return nil
+}
 
-		for _, msg := range encodedMsgs {
-			if len(msg) == 0 {
-				continue
-			}
+// Receive closes the connection on return, since a protocol error leaves the
+// stream unusable.
+func (h *TCPGClient) Receive(output chan protocol.Message) {
+	defer h.Conn.Close()
+	h.receive(h.mux.Read, h.SendMessage, output)
+}
 
-			io.PassMessageToIODriver(msg)
-		}
+func (h *TCPGClient) SendMessage(msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
+	if err != nil {
+		return err
 	}
+	return h.mux.Write(data)
 }
-func (h *TCPGClient) Receive() {
-	localBuf := new(bytes.Buffer)
-	readBuf := make([]byte, 256)
 
-	for {
-		dataLen, _ := h.Conn.Read(readBuf)
-		localBuf.Write(readBuf[:dataLen])
-		h.ProcessRead(localBuf)
+func (h *TCPGClient) SendFrame(frame protocol.Frame) error {
+	if h.Conn == nil {
+		return errNotConnected
 	}
+	return h.SendMessage(frame)
 }
 
-func (h *TCPGClient) SendMessage(msg Message) error {
-	bin_buf := new(bytes.Buffer)
-	gobobj := gob.NewEncoder(bin_buf)
-	gobobj.Encode(msg)
-	databytes := bin_buf.Bytes()
-	packetPrefix := []byte{'%'}
-	packetSize := make([]byte, 4)
-	binary.LittleEndian.PutUint32(packetSize, uint32(len(databytes)))
-	packet := append(append(packetPrefix, packetSize[:]...), databytes[:]...)
-	_, err := h.Conn.Write(packet)
-	return err
+func (h *TCPGClient) sendEncodedFrame(data []byte) error {
+	return h.mux.Write(data)
 }
 
-func (h *TCPGClient) SendFrame(img []byte, width int, height int) error {
-	if h.Conn == nil {
-		fmt.Println("Invalid connection")
-		os.Exit(1)
-	}
-	msg := Message{"FRAME:" + strconv.Itoa(width) + ":" + strconv.Itoa(height), img}
-	return h.SendMessage(msg)
+// Mux returns the connection's channels, for features that open their own.
+func (h *TCPGClient) Mux() *transport.Mux {
+	return h.mux
 }
 
-func (h *TCPGClient) Disconnect(message string) {
+func (h *TCPGClient) Disconnect(bye protocol.Goodbye) {
+	h.hangUp(bye)
+	h.link.SetState(transport.StateDisconnected, nil)
+	h.SendMessage(bye)
 	h.Conn.Close()
 }
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"strconv"
+	"time"
+)
+
+type UDPGClient struct {
+	sessionState
+	Ip        string
+	Port      int
+	Conn      *transport.DatagramConn
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+}
+
+func (h *UDPGClient) Connect() error {
+	conn, err := transport.DialDatagram(h.Ip + ":" + strconv.Itoa(h.Port))
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	if err := h.handshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	h.Conn = conn
+	h.link.SetState(transport.StateConnected, nil)
+	go h.link.RunHeartbeat(h.Heartbeat, h.SendMessage, func() { conn.Close() })
+	return nil
+}
+
+func (h *UDPGClient) handshake(conn *transport.DatagramConn) error {
+	data, err := h.hello(h.Hello)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.WriteReliable(data); err != nil {
+		return err
+	}
+
+	data, err = conn.Read()
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	// datagrams aren't encrypted, so there is nothing to bind a PIN to
+	return h.accept(h.Hello, data, nil, conn.Read, conn.WriteReliable)
+}
+
+func (h *UDPGClient) Receive(output chan protocol.Message) {
+	defer h.Conn.Close()
+	h.receive(h.Conn.Read, h.SendMessage, output)
+}
+
+func (h *UDPGClient) SendMessage(msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return h.Conn.WriteReliable(data)
+}
+
+// SendFrame sends frames unreliably; the viewer asks for a refresh if the
+// latest one is lost.
+func (h *UDPGClient) SendFrame(frame protocol.Frame) error {
+	if h.Conn == nil {
+		return errNotConnected
+	}
+
+	data, err := protocol.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	return h.Conn.WriteUnreliable(data)
+}
+
+func (h *UDPGClient) sendEncodedFrame(data []byte) error {
+	return h.Conn.WriteUnreliable(data)
+}
+
+func (h *UDPGClient) Disconnect(bye protocol.Goodbye) {
+	h.hangUp(bye)
+	h.link.SetState(transport.StateDisconnected, nil)
+	h.SendMessage(bye)
+	h.Conn.Linger(time.Second)
+}
@@ -0,0 +1,19 @@
+package client
+
+import "net"
+
+// UnixGClient connects to a viewer listening on a Unix socket, such as one
+// forwarded over ssh with -R. Past the socket it behaves like TCPGClient.
+type UnixGClient struct {
+	TCPGClient
+	Path string
+}
+
+func (h *UnixGClient) Connect() error {
+	conn, err := net.Dial("unix", h.Path)
+	if err != nil {
+		return err
+	}
+
+	return h.start(conn)
+}
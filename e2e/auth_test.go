@@ -0,0 +1,118 @@
+package e2e
+
+import (
+	"errors"
+	"ghostviewer/client"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"io"
+	"testing"
+)
+
+const pin = "482913"
+
+// pinSharer returns a sharer on listener that answers the viewer's PIN
+// request with password, if it has one.
+func pinSharer(listener *transport.PipeListener, password string) *client.PipeGClient {
+	ghostclient := &client.PipeGClient{
+		TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportPipe, newCapturer())},
+		Listener:   listener,
+	}
+	if password != "" {
+		ghostclient.SetPassword(password)
+	}
+	return ghostclient
+}
+
+func TestPIN(t *testing.T) {
+	listener := transport.NewPipeListener()
+	defer listener.Close()
+
+	ghostserver := &server.PipeGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+		Listener:   listener,
+	}
+	ghostserver.SetPassword(pin)
+
+	listened := make(chan error, 1)
+	go func() { listened <- ghostserver.Listen() }()
+
+	// neither a sharer without the PIN nor a guesser holds up the one who
+	// has it
+	for _, password := range []string{"", "482914"} {
+		if err := pinSharer(listener, password).Connect(); !errors.Is(err, protocol.ErrAuthFailed) {
+			t.Fatalf("PIN %q: got %v", password, err)
+		}
+	}
+
+	capturer := newCapturer()
+	ghostclient := pinSharer(listener, pin)
+	if err := ghostclient.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+
+	checkSession(t, ghostserver, ghostclient, capturer, protocol.TransportPipe)
+}
+
+func TestPINGuesses(t *testing.T) {
+	listener := transport.NewPipeListener()
+	defer listener.Close()
+
+	hub := &server.Hub{
+		Listener: listener,
+		Hello:    protocol.NewHello(protocol.TransportPipe, 1920, 1080),
+		Password: pin,
+	}
+	go hub.Serve()
+
+	for i := 0; i < 10; i++ {
+		if err := pinSharer(listener, "000000").Connect(); !errors.Is(err, protocol.ErrAuthFailed) {
+			t.Fatalf("guess %d: got %v", i, err)
+		}
+	}
+
+	// the viewer has stopped taking guesses, even the right one
+	if err := pinSharer(listener, pin).Connect(); !errors.Is(err, protocol.ErrRefused) {
+		t.Fatalf("got %v after too many guesses", err)
+	}
+}
+
+func TestPINRelayed(t *testing.T) {
+	viewerSide, sharerSide := transport.NewPipeListener(), transport.NewPipeListener()
+	defer viewerSide.Close()
+	defer sharerSide.Close()
+
+	ghostserver := &server.PipeGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+		Listener:   viewerSide,
+	}
+	ghostserver.SetPassword(pin)
+	go ghostserver.Listen()
+
+	// someone in the middle passes everything on between a connection of
+	// their own to each side, so both run the exchange with the right PIN
+	go func() {
+		fromSharer, err := sharerSide.Accept()
+		if err != nil {
+			return
+		}
+		defer fromSharer.Close()
+
+		toViewer, err := viewerSide.Dial()
+		if err != nil {
+			return
+		}
+		defer toViewer.Close()
+
+		go io.Copy(toViewer, fromSharer)
+		io.Copy(fromSharer, toViewer)
+	}()
+
+	if err := pinSharer(sharerSide, pin).Connect(); !errors.Is(err, protocol.ErrAuthFailed) {
+		t.Fatalf("exchange relayed between two connections: got %v", err)
+	}
+}
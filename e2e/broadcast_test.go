@@ -0,0 +1,268 @@
+package e2e
+
+import (
+	"errors"
+	"ghostviewer/client"
+	"ghostviewer/fake"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"image"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stalledRenderer never finishes drawing a frame until release is closed,
+// like a viewer on a link far slower than the others.
+type stalledRenderer struct {
+	*fake.Renderer
+	release chan struct{}
+}
+
+func (r *stalledRenderer) UpdateFrame(frame *image.RGBA) {
+	<-r.release
+}
+
+// broadcast shares one fake screen with a viewer per renderer, each over its
+// own in-memory pipe.
+func broadcast(t *testing.T, renderers ...server.Renderer) (*client.Broadcast, []server.GServer, *fake.InputDriver) {
+	capturer := &fake.Capturer{Width: width, Height: height, Interval: 5 * time.Millisecond}
+	input := fake.NewInputDriver()
+	b := &client.Broadcast{}
+
+	var servers []server.GServer
+	for _, renderer := range renderers {
+		listener := transport.NewPipeListener()
+		ghostserver := &server.PipeGServer{
+			TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+			Listener:   listener,
+		}
+		b.Viewers = append(b.Viewers, &client.PipeGClient{
+			TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportPipe, capturer)},
+			Listener:   listener,
+		})
+		servers = append(servers, ghostserver)
+
+		go func(renderer server.Renderer) {
+			if err := ghostserver.Listen(); err != nil {
+				t.Error(err)
+				return
+			}
+			server.ServerViewer(ghostserver, renderer)
+		}(renderer)
+	}
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hangUp(b) })
+
+	go client.ClientCommunicate(b, capturer, input, &fake.Consent{}, fullScale)
+	return b, servers, input
+}
+
+func waitFrames(t *testing.T, renderer *fake.Renderer, count int) {
+	last := -1
+	for i := 0; i < count; i++ {
+		select {
+		case frame := <-renderer.Frames:
+			n := checkFrame(t, frame)
+			if n <= last {
+				t.Fatalf("frame %d arrived after frame %d", n, last)
+			}
+			last = n
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a frame")
+		}
+	}
+}
+
+func waitControl(t *testing.T, ghostserver server.GServer, want bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for ghostserver.HasControl() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("HasControl never became %v", want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBroadcastSlowViewer(t *testing.T) {
+	fast1, fast2 := fake.NewRenderer(), fake.NewRenderer()
+	slow := &stalledRenderer{Renderer: fake.NewRenderer(), release: make(chan struct{})}
+	defer close(slow.release)
+
+	broadcast(t, fast1, slow, fast2)
+	waitFrames(t, fast1, 20)
+	waitFrames(t, fast2, 20)
+}
+
+func TestBroadcastInputToken(t *testing.T) {
+	first, second := fake.NewRenderer(), fake.NewRenderer()
+	b, servers, input := broadcast(t, first, second)
+
+	// the first viewer to connect holds the token
+	waitFrames(t, first, 1)
+	waitFrames(t, second, 1)
+	waitControl(t, servers[1], false)
+	if c := b.Controller(); c != 0 {
+		t.Fatalf("controller is %d", c)
+	}
+
+	ignored := protocol.Key{Kind: 1, Char: 'x'}
+	replayed := protocol.Key{Kind: 1, Char: 'a'}
+	second.Events <- ignored
+	first.Events <- replayed
+	expectInput(t, input, replayed)
+	// make sure the ignored key was handled while second was view only, not
+	// after it takes control below
+	waitStatus(t, second, "View only, click or type to ask for control")
+
+	b.SetController(1)
+	waitControl(t, servers[0], false)
+	waitControl(t, servers[1], true)
+
+	replayed = protocol.Key{Kind: 1, Char: 'b'}
+	first.Events <- ignored
+	second.Events <- replayed
+	expectInput(t, input, replayed)
+
+	select {
+	case msg := <-input.Injected:
+		t.Fatalf("replayed %#v from a view only viewer", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func waitStatus(t *testing.T, renderer *fake.Renderer, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for renderer.Status() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("status is %q, want %q", renderer.Status(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func expectInput(t *testing.T, input *fake.InputDriver, want protocol.Message) {
+	select {
+	case got := <-input.Injected:
+		if got, _ = unstamp(t, got); got != want {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for input")
+	}
+}
+
+// lateViewer can't be reached until ready is closed, like a viewer started
+// after the sharer.
+type lateViewer struct {
+	*client.PipeGClient
+	ready chan struct{}
+}
+
+func (v lateViewer) Connect() error {
+	select {
+	case <-v.ready:
+		return v.PipeGClient.Connect()
+	default:
+		return errors.New("viewer not up yet")
+	}
+}
+
+// lateBroadcast shares one fake screen with a viewer per hostname, each over
+// its own in-memory pipe. Only the first is up when consent is asked; the
+// others can't be reached until ready is closed.
+func lateBroadcast(t *testing.T, consent *fake.Consent, hostnames ...string) ([]*fake.Renderer, chan struct{}) {
+	capturer := &fake.Capturer{Width: width, Height: height, Interval: 5 * time.Millisecond}
+	b := &client.Broadcast{}
+	ready := make(chan struct{})
+
+	var renderers []*fake.Renderer
+	for i, hostname := range hostnames {
+		listener := transport.NewPipeListener()
+		t.Cleanup(func() { listener.Close() })
+		hello := protocol.NewHello(protocol.TransportPipe, 1920, 1080)
+		hello.Hostname = hostname
+		ghostserver := &server.PipeGServer{TCPGServer: server.TCPGServer{Hello: hello}, Listener: listener}
+
+		var viewer client.GClient = &client.PipeGClient{
+			TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportPipe, capturer)},
+			Listener:   listener,
+		}
+		if i > 0 {
+			viewer = lateViewer{PipeGClient: viewer.(*client.PipeGClient), ready: ready}
+		}
+		b.Viewers = append(b.Viewers, viewer)
+
+		renderer := fake.NewRenderer()
+		renderers = append(renderers, renderer)
+		go func() {
+			if err := ghostserver.Listen(); err == nil {
+				server.ServerViewer(ghostserver, renderer)
+			}
+		}()
+	}
+
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hangUp(b) })
+
+	go client.ClientCommunicate(b, capturer, fake.NewInputDriver(), consent, fullScale)
+	waitFrames(t, renderers[0], 1)
+	return renderers, ready
+}
+
+func TestBroadcastLateViewer(t *testing.T) {
+	consent := &fake.Consent{Answer: func(viewer string, access string) string {
+		if strings.Contains(viewer, "late") {
+			return ""
+		}
+		return access
+	}}
+	renderers, ready := lateBroadcast(t, consent, "first", "late")
+
+	// the viewer that wasn't there when consent was given is asked about
+	// on its own, and declining it turns it away before it sees anything
+	close(ready)
+	waitStatus(t, renderers[1], "Session ended: declined by the sharer")
+	select {
+	case <-renderers[1].Frames:
+		t.Fatal("declined viewer was sent a frame")
+	default:
+	}
+
+	if asked := consent.Asked(); len(asked) != 2 || !strings.HasPrefix(asked[0], `"first"`) || !strings.HasPrefix(asked[1], `"late"`) {
+		t.Fatalf("asked %q", asked)
+	}
+	if indicated := consent.Indicated(); strings.Contains(indicated, "late") {
+		t.Fatalf("indicator shows %q", indicated)
+	}
+	waitFrames(t, renderers[0], 5)
+}
+
+func TestBroadcastLateViewersIndicated(t *testing.T) {
+	consent := &fake.Consent{Delay: 50 * time.Millisecond}
+	renderers, ready := lateBroadcast(t, consent, "first", "second", "third")
+
+	// the late viewers turn up together, but are asked about one after the
+	// other, and the indicator ends up listing everyone allowed
+	close(ready)
+	waitFrames(t, renderers[1], 1)
+	waitFrames(t, renderers[2], 1)
+
+	if consent.Overlapped() {
+		t.Fatal("asked about a viewer while another prompt was open")
+	}
+	if len(consent.Asked()) != 3 {
+		t.Fatalf("asked %q", consent.Asked())
+	}
+	for _, hostname := range []string{"first", "second", "third"} {
+		if indicated := consent.Indicated(); !strings.Contains(indicated, `"`+hostname+`"`) {
+			t.Fatalf("indicator shows %q, without %s", indicated, hostname)
+		}
+	}
+}
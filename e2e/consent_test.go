@@ -0,0 +1,180 @@
+package e2e
+
+import (
+	"errors"
+	"ghostviewer/client"
+	"ghostviewer/fake"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"os"
+	"testing"
+	"time"
+)
+
+// consentSession runs a session where the sharer's user answers with consent,
+// returning the viewer's window and a channel closed once the viewer's side
+// has ended.
+func consentSession(t *testing.T, consent *fake.Consent, capturer *fake.Capturer, input *fake.InputDriver) (*fake.Renderer, server.GServer, chan struct{}) {
+	ghostserver, ghostclient := connect(t, capturer)
+	renderer := fake.NewRenderer()
+
+	viewed := make(chan struct{})
+	go func() {
+		server.ServerViewer(ghostserver, renderer)
+		close(viewed)
+	}()
+	go client.ClientCommunicate(ghostclient, capturer, input, consent, fullScale)
+	return renderer, ghostserver, viewed
+}
+
+func waitClosed(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session never ended")
+	}
+}
+
+func TestConsentDeclined(t *testing.T) {
+	consent := &fake.Consent{Decline: true}
+	capturer := newCapturer()
+	renderer, _, viewed := consentSession(t, consent, capturer, fake.NewInputDriver())
+	waitClosed(t, viewed)
+
+	if status := renderer.Status(); status != "Session ended: declined by the sharer" {
+		t.Fatalf("viewer shows %q", status)
+	}
+	// the fake numbers its frames in the blue channel
+	if frame, _ := capturer.Capture(); frame.Pix[0] != 0 {
+		t.Fatal("captured the screen without consent")
+	}
+	if consent.Showing() {
+		t.Fatal("indicator shown for a declined session")
+	}
+
+	hostname, _ := os.Hostname()
+	if asked := consent.Asked(); len(asked) != 1 || asked[0] != "\""+hostname+"\" "+protocol.AccessControl {
+		t.Fatalf("asked %q", asked)
+	}
+}
+
+func TestConsentViewOnly(t *testing.T) {
+	input := fake.NewInputDriver()
+	renderer, ghostserver, _ := consentSession(t, &fake.Consent{ViewOnly: true}, newCapturer(), input)
+
+	waitFrames(t, renderer, 1)
+	waitControl(t, ghostserver, false)
+
+	renderer.Events <- protocol.Key{Kind: 1, Char: 'a'}
+	select {
+	case msg := <-input.Injected:
+		t.Fatalf("replayed %#v with view only consent", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConsentStop(t *testing.T) {
+	consent := &fake.Consent{}
+	renderer, _, viewed := consentSession(t, consent, newCapturer(), fake.NewInputDriver())
+
+	waitFrames(t, renderer, 1)
+	if !consent.Showing() {
+		t.Fatal("no indicator while sharing")
+	}
+
+	consent.Stop()
+	waitClosed(t, viewed)
+	if status := renderer.Status(); status != "Session ended: stopped sharing" {
+		t.Fatalf("viewer shows %q", status)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for consent.Showing() {
+		if time.Now().After(deadline) {
+			t.Fatal("indicator still up after the session ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConsentNewSession(t *testing.T) {
+	listener := transport.NewPipeListener()
+	defer listener.Close()
+
+	viewer := func() *server.PipeGServer {
+		ghostserver := &server.PipeGServer{
+			TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+			Listener:   listener,
+		}
+		go ghostserver.Listen()
+		return ghostserver
+	}
+
+	first := viewer()
+	ghostclient := pinSharer(listener, "")
+	if err := ghostclient.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+
+	// a restarted viewer, or anyone else listening there, starts a session
+	// of its own, which the sharer's user never agreed to
+	viewer()
+	if err := ghostclient.Connect(); !errors.Is(err, protocol.ErrRefused) {
+		t.Fatalf("reconnected to a new session: %v", err)
+	}
+}
+
+func TestConsentNoIndicator(t *testing.T) {
+	consent := &fake.Consent{NoIndicator: true}
+	capturer := newCapturer()
+	renderer, _, viewed := consentSession(t, consent, capturer, fake.NewInputDriver())
+	waitClosed(t, viewed)
+
+	if status := renderer.Status(); status != "Session ended: couldn't show the sharing indicator" {
+		t.Fatalf("viewer shows %q", status)
+	}
+	if frame, _ := capturer.Capture(); frame.Pix[0] != 0 {
+		t.Fatal("captured the screen without showing it is shared")
+	}
+}
+
+func TestConsentSlowAnswer(t *testing.T) {
+	heartbeat := transport.Heartbeat{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	capturer := newCapturer()
+	listener := transport.NewPipeListener()
+	defer listener.Close()
+	ghostserver := &server.PipeGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080), Heartbeat: heartbeat},
+		Listener:   listener,
+	}
+	ghostclient := &client.PipeGClient{
+		TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportPipe, capturer), Heartbeat: heartbeat},
+		Listener:   listener,
+	}
+
+	listened := make(chan error, 1)
+	go func() { listened <- ghostserver.Listen() }()
+	if err := ghostclient.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hangUp(ghostclient) })
+	events := ghostclient.Events()
+
+	// the user takes several heartbeat timeouts to answer, and the link
+	// stays up all the while
+	renderer := fake.NewRenderer()
+	go server.ServerViewer(ghostserver, renderer)
+	go client.ClientCommunicate(ghostclient, capturer, fake.NewInputDriver(), &fake.Consent{Delay: 10 * heartbeat.Timeout}, fullScale)
+	waitFrames(t, renderer, 1)
+
+	for len(events) > 0 {
+		if event := <-events; event.State != transport.StateConnected {
+			t.Fatalf("link went %v while the user was asked: %v", event.State, event.Err)
+		}
+	}
+}
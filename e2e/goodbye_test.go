@@ -0,0 +1,197 @@
+package e2e
+
+import (
+	"errors"
+	"ghostviewer/client"
+	"ghostviewer/fake"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"image"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// brokenCapturer fails every capture after the first few, like a display
+// driver that has gone away.
+type brokenCapturer struct {
+	*fake.Capturer
+	captures int32
+}
+
+func (c *brokenCapturer) Capture() (*image.RGBA, error) {
+	if atomic.AddInt32(&c.captures, 1) > 5 {
+		time.Sleep(c.Interval)
+		return nil, errors.New("access lost")
+	}
+	return c.Capturer.Capture()
+}
+
+// goodbye runs a session until it ends, returning the status the viewer is
+// left showing.
+func goodbye(t *testing.T, capturer client.Capturer, end func(client.GClient)) string {
+	ghostserver, ghostclient := connect(t, capturer)
+	renderer := fake.NewRenderer()
+
+	viewed := make(chan struct{})
+	go func() {
+		server.ServerViewer(ghostserver, renderer)
+		close(viewed)
+	}()
+	shared := make(chan struct{})
+	go func() {
+		client.ClientCommunicate(ghostclient, capturer, fake.NewInputDriver(), &fake.Consent{}, fullScale)
+		close(shared)
+	}()
+
+	waitFrames(t, renderer, 1)
+	end(ghostclient)
+
+	for _, done := range []chan struct{}{viewed, shared} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("session never ended")
+		}
+	}
+
+	return renderer.Status()
+}
+
+func TestGoodbye(t *testing.T) {
+	status := goodbye(t, newCapturer(), func(ghostclient client.GClient) {
+		ghostclient.Disconnect(protocol.Goodbye{Code: protocol.GoodbyeUserEnded})
+	})
+
+	if status != "Session ended: user ended sharing" {
+		t.Fatalf("viewer shows %q", status)
+	}
+}
+
+func TestGoodbyeCaptureLost(t *testing.T) {
+	defer func(timeout time.Duration) { client.CaptureLostTimeout = timeout }(client.CaptureLostTimeout)
+	client.CaptureLostTimeout = 100 * time.Millisecond
+
+	status := goodbye(t, &brokenCapturer{Capturer: newCapturer()}, func(client.GClient) {})
+	if status != "Session ended: access lost" {
+		t.Fatalf("viewer shows %q", status)
+	}
+}
+
+func TestGoodbyeViewerClosed(t *testing.T) {
+	consent := &fake.Consent{}
+	capturer := newCapturer()
+	ghostserver, ghostclient := connect(t, capturer)
+	renderer := fake.NewRenderer()
+	go server.ServerViewer(ghostserver, renderer)
+
+	shared := make(chan struct{})
+	go func() {
+		client.ClientCommunicate(ghostclient, capturer, fake.NewInputDriver(), consent, fullScale)
+		close(shared)
+	}()
+
+	waitFrames(t, renderer, 1)
+	ghostserver.Disconnect(protocol.Goodbye{Code: protocol.GoodbyeUserEnded, Reason: "viewer closed"})
+	waitClosed(t, shared)
+
+	if consent.Showing() {
+		t.Fatal("indicator still up after the viewer closed")
+	}
+}
+
+func TestResumeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { client.ResumeTimeout = timeout }(client.ResumeTimeout)
+	client.ResumeTimeout = 200 * time.Millisecond
+
+	consent := &fake.Consent{}
+	capturer := newCapturer()
+	listener := transport.NewPipeListener()
+	ghostserver := &server.PipeGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+		Listener:   listener,
+	}
+	ghostclient := pinSharer(listener, "")
+
+	listened := make(chan error, 1)
+	go func() { listened <- ghostserver.Listen() }()
+	if err := ghostclient.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+
+	shared := make(chan struct{})
+	go func() {
+		client.ClientCommunicate(ghostclient, capturer, fake.NewInputDriver(), consent, fullScale)
+		close(shared)
+	}()
+
+	// the viewer goes away without a word, as when it crashes
+	renderer := fake.NewRenderer()
+	go ghostserver.Receive(make(chan protocol.Frame, 100), renderer.Input())
+	time.Sleep(50 * time.Millisecond)
+	listener.Close()
+	ghostserver.Close()
+
+	waitClosed(t, shared)
+	if consent.Showing() {
+		t.Fatal("indicator still up after giving up on the viewer")
+	}
+}
+
+func TestBroadcastResumeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { client.ResumeTimeout = timeout }(client.ResumeTimeout)
+	client.ResumeTimeout = 200 * time.Millisecond
+
+	consent := &fake.Consent{}
+	capturer := newCapturer()
+	b := &client.Broadcast{}
+	var listeners []*transport.PipeListener
+	var servers []*server.PipeGServer
+	for i := 0; i < 2; i++ {
+		listener := transport.NewPipeListener()
+		listeners = append(listeners, listener)
+		servers = append(servers, &server.PipeGServer{
+			TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+			Listener:   listener,
+		})
+		b.Viewers = append(b.Viewers, pinSharer(listener, ""))
+	}
+
+	listened := make(chan error, len(servers))
+	for _, ghostserver := range servers {
+		go func(ghostserver *server.PipeGServer) { listened <- ghostserver.Listen() }(ghostserver)
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for range servers {
+		if err := <-listened; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shared := make(chan struct{})
+	go func() {
+		client.ClientCommunicate(b, capturer, fake.NewInputDriver(), consent, fullScale)
+		close(shared)
+	}()
+
+	// both viewers go away without a word, and the broadcast ends once the
+	// last of them has been given up on
+	for i, ghostserver := range servers {
+		renderer := fake.NewRenderer()
+		go ghostserver.Receive(make(chan protocol.Frame, 100), renderer.Input())
+		time.Sleep(50 * time.Millisecond)
+		listeners[i].Close()
+		ghostserver.Close()
+	}
+
+	waitClosed(t, shared)
+	if consent.Showing() {
+		t.Fatal("indicator still up after giving up on every viewer")
+	}
+}
@@ -0,0 +1,150 @@
+package e2e
+
+import (
+	"ghostviewer/client"
+	"ghostviewer/fake"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"testing"
+	"time"
+)
+
+type opened struct {
+	id       int
+	hostname string
+	renderer *fake.Renderer
+}
+
+// sharer connects a fake sharer named hostname to listener and starts its
+// main loop.
+func sharer(t *testing.T, listener *transport.PipeListener, hostname string, width int, height int) *client.PipeGClient {
+	capturer := &fake.Capturer{Width: width, Height: height, Interval: 5 * time.Millisecond}
+	hello := client.LocalHello(protocol.TransportPipe, capturer)
+	hello.Hostname = hostname
+
+	ghostclient := &client.PipeGClient{TCPGClient: client.TCPGClient{Hello: hello}, Listener: listener}
+	if err := ghostclient.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hangUp(ghostclient) })
+
+	go client.ClientCommunicate(ghostclient, capturer, fake.NewInputDriver(), &fake.Consent{}, fullScale)
+	return ghostclient
+}
+
+func nextFrameWidth(t *testing.T, renderer *fake.Renderer) int {
+	select {
+	case frame := <-renderer.Frames:
+		return frame.Bounds().Dx()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a frame")
+	}
+	return 0
+}
+
+func TestHubSessions(t *testing.T) {
+	listener := transport.NewPipeListener()
+	sessions := make(chan opened, 4)
+	hub := &server.Hub{
+		Listener: listener,
+		Hello:    protocol.NewHello(protocol.TransportPipe, 1920, 1080),
+		NewRenderer: func(id int, hostname string) server.Renderer {
+			renderer := fake.NewRenderer()
+			sessions <- opened{id, hostname, renderer}
+			return renderer
+		},
+	}
+	go hub.Serve()
+	defer listener.Close()
+
+	// tell the sharers apart by frame size
+	widths := map[string]int{"alpha": 32, "beta": 64}
+	alpha := sharer(t, listener, "alpha", widths["alpha"], 8)
+	sharer(t, listener, "beta", widths["beta"], 8)
+
+	byHost := map[string]opened{}
+	for len(byHost) < 2 {
+		select {
+		case s := <-sessions:
+			byHost[s.hostname] = s
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for sessions")
+		}
+	}
+
+	if byHost["alpha"].id == byHost["beta"].id {
+		t.Fatalf("both sharers got session %d", byHost["alpha"].id)
+	}
+
+	for host, s := range byHost {
+		if w := nextFrameWidth(t, s.renderer); w != widths[host] {
+			t.Fatalf("session %d for %s shows a %d wide frame", s.id, host, w)
+		}
+	}
+
+	if infos := hub.Sessions(); len(infos) != 2 || !infos[0].Connected || !infos[1].Connected {
+		t.Fatalf("Sessions() = %+v", infos)
+	}
+
+	// alpha drops and reconnects with its resume token, keeping its session
+	alpha.Conn.Close()
+	renderer := byHost["alpha"].renderer
+	deadline := time.After(5 * time.Second)
+	for len(renderer.Frames) > 0 {
+		<-renderer.Frames
+	}
+
+	for reconnected := false; !reconnected; {
+		select {
+		case s := <-sessions:
+			t.Fatalf("reconnect opened new session %d for %s", s.id, s.hostname)
+		case <-renderer.Frames:
+			reconnected = len(hub.Sessions()) == 2 && hub.Sessions()[0].Connected
+		case <-deadline:
+			t.Fatal("alpha did not come back")
+		}
+	}
+}
+
+func TestHubGoodbye(t *testing.T) {
+	listener := transport.NewPipeListener()
+	sessions := make(chan opened, 1)
+	closed := make(chan int, 1)
+	hub := &server.Hub{
+		Listener: listener,
+		Hello:    protocol.NewHello(protocol.TransportPipe, 1920, 1080),
+		NewRenderer: func(id int, hostname string) server.Renderer {
+			renderer := fake.NewRenderer()
+			sessions <- opened{id, hostname, renderer}
+			return renderer
+		},
+		OnClosed: func(id int) { closed <- id },
+	}
+	go hub.Serve()
+	defer listener.Close()
+
+	alpha := sharer(t, listener, "alpha", 32, 8)
+	var s opened
+	select {
+	case s = <-sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a session")
+	}
+	nextFrameWidth(t, s.renderer)
+
+	// the reason is on screen by the time the session is closed
+	bye := protocol.Goodbye{Code: protocol.GoodbyeUserEnded, Reason: "stopped sharing"}
+	alpha.Disconnect(bye)
+	select {
+	case id := <-closed:
+		if id != s.id {
+			t.Fatalf("closed session %d, want %d", id, s.id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was never closed")
+	}
+	if want := "Session ended: " + bye.Error(); s.renderer.Status() != want {
+		t.Fatalf("status is %q, want %q", s.renderer.Status(), want)
+	}
+}
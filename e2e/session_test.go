@@ -0,0 +1,262 @@
+package e2e
+
+import (
+	"errors"
+	"ghostviewer/client"
+	"ghostviewer/fake"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"image"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const width, height = 64, 48
+
+// fullScale stops the sharer scaling frames down on a busy test machine, so
+// checkFrame still recognises them.
+var fullScale = client.RateLimits{MinFPS: 1, MaxFPS: 30, MinScale: 1, MaxScale: 1, MinQuality: 20, MaxQuality: 90}
+
+// session connects a sharer and a viewer over an in-memory pipe and starts
+// both sides' main loops.
+func session(t *testing.T) (*fake.Renderer, *fake.InputDriver, server.GServer) {
+	renderer := fake.NewRenderer()
+	input := fake.NewInputDriver()
+	capturer := &fake.Capturer{Width: width, Height: height, Interval: 5 * time.Millisecond}
+	ghostserver, ghostclient := connect(t, capturer)
+
+	go server.ServerViewer(ghostserver, renderer)
+	go client.ClientCommunicate(ghostclient, capturer, input, &fake.Consent{}, fullScale)
+	return renderer, input, ghostserver
+}
+
+// connect connects a sharer of capturer's screen to a viewer over an
+// in-memory pipe.
+func connect(t *testing.T, capturer client.Capturer) (*server.PipeGServer, *client.PipeGClient) {
+	listener := transport.NewPipeListener()
+	ghostserver := &server.PipeGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+		Listener:   listener,
+	}
+	ghostclient := &client.PipeGClient{
+		TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportPipe, capturer)},
+		Listener:   listener,
+	}
+
+	listened := make(chan error, 1)
+	go func() { listened <- ghostserver.Listen() }()
+
+	if err := ghostclient.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { hangUp(ghostclient) })
+	return ghostserver, ghostclient
+}
+
+// hangUp ends a session a test has finished with, so its sharer stops
+// capturing and doesn't slow down the tests after it.
+func hangUp(ghostclient client.GClient) {
+	ghostclient.Disconnect(protocol.Goodbye{Code: protocol.GoodbyeUserEnded})
+}
+
+// checkFrame verifies frame is fake.Frame(width, height, n) for some n after
+// the viewer's BGRA to RGBA conversion, and returns n.
+func checkFrame(t *testing.T, frame *image.RGBA) int {
+	if frame.Bounds() != image.Rect(0, 0, width, height) {
+		t.Fatalf("frame is %v, want %dx%d", frame.Bounds(), width, height)
+	}
+
+	n := frame.Pix[2]
+	for i := 0; i < width*height; i++ {
+		p := frame.Pix[i*4 : i*4+4]
+		if p[0] != byte(i>>8) || p[1] != byte(i) || p[2] != n || p[3] != 255 {
+			t.Fatalf("pixel %d is %v in frame %d", i, p, n)
+		}
+	}
+
+	return int(n)
+}
+
+func TestSessionFrames(t *testing.T) {
+	renderer, _, ghostserver := session(t)
+
+	if transport := ghostserver.Session().Transport; transport != protocol.TransportPipe {
+		t.Fatalf("negotiated %q", transport)
+	}
+
+	last := -1
+	for i := 0; i < 5; i++ {
+		select {
+		case frame := <-renderer.Frames:
+			n := checkFrame(t, frame)
+			if n <= last {
+				t.Fatalf("frame %d arrived after frame %d", n, last)
+			}
+			last = n
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a frame")
+		}
+	}
+}
+
+func TestSessionInputOrder(t *testing.T) {
+	renderer, input, _ := session(t)
+
+	var sent []protocol.Message
+	for i := 0; i < 100; i++ {
+		switch i % 3 {
+		case 0:
+			sent = append(sent, protocol.Pointer{X: int32(i), Y: int32(-i), Button: protocol.ButtonLeft, Action: protocol.PointerDown})
+		case 1:
+			sent = append(sent, protocol.Key{Kind: 3, Index: uint32(i), Char: 'a' + rune(i%26), Code: uint16(i)})
+		case 2:
+			sent = append(sent, protocol.Scroll{DX: int32(i), DY: -1})
+		}
+	}
+
+	for _, msg := range sent {
+		renderer.Events <- msg
+	}
+
+	for i, want := range sent {
+		select {
+		case got := <-input.Injected:
+			got, seq := unstamp(t, got)
+			if got != want {
+				t.Fatalf("event %d: got %#v, want %#v", i, got, want)
+			}
+			if seq != uint32(i+1) {
+				t.Fatalf("event %d has seq %d", i, seq)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+}
+
+// unstamp clears the sequence number and timestamp the viewer put on an input
+// event, so it compares equal to what the UI produced, and returns the
+// sequence number.
+func unstamp(t *testing.T, msg protocol.Message) (protocol.Message, uint32) {
+	var seq uint32
+	var timestamp int64
+	switch m := msg.(type) {
+	case protocol.Pointer:
+		seq, timestamp = m.Seq, m.Timestamp
+		m.Seq, m.Timestamp = 0, 0
+		msg = m
+	case protocol.Key:
+		seq, timestamp = m.Seq, m.Timestamp
+		m.Seq, m.Timestamp = 0, 0
+		msg = m
+	case protocol.Scroll:
+		seq, timestamp = m.Seq, m.Timestamp
+		m.Seq, m.Timestamp = 0, 0
+		msg = m
+	}
+
+	if sent := time.Unix(0, timestamp); time.Since(sent) < 0 || time.Since(sent) > time.Minute {
+		t.Fatalf("%#v was sent at %s", msg, sent)
+	}
+	return msg, seq
+}
+
+func TestSessionStats(t *testing.T) {
+	renderer, _, ghostserver := session(t)
+
+	for i := 0; i < 10; i++ {
+		<-renderer.Frames
+		renderer.Events <- protocol.Scroll{DY: 1}
+	}
+
+	// the fake capturer runs on the same clock, so the offset is all error
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := ghostserver.Stats()
+		if stats.Frames >= 10 && stats.Latency > 0 && stats.InputRTT > 0 {
+			if stats.Dropped != 0 || stats.Reordered != 0 {
+				t.Fatalf("%d frames dropped and %d reordered on a pipe", stats.Dropped, stats.Reordered)
+			}
+			if offset := stats.ClockOffset; offset > stats.ClockRTT || -offset > stats.ClockRTT {
+				t.Fatalf("clock offset %s with a round trip of %s", offset, stats.ClockRTT)
+			}
+			if stats.Latency > time.Second || stats.InputRTT > time.Second {
+				t.Fatalf("latency %s, input round trip %s", stats.Latency, stats.InputRTT)
+			}
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("stats never filled in: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	listener := transport.NewPipeListener()
+	defer listener.Close()
+
+	ghostserver := &server.PipeGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportPipe, 1920, 1080)},
+		Listener:   listener,
+	}
+	go ghostserver.Listen()
+
+	// the viewer tells a sharer of another version why it won't have it,
+	// rather than just hanging up
+	for _, version := range []int{protocol.Version - 1, protocol.Version + 1} {
+		ghostclient := pinSharer(listener, "")
+		ghostclient.Hello.Version = version
+
+		err := ghostclient.Connect()
+		if !errors.Is(err, protocol.ErrRefused) || !strings.Contains(err.Error(), "protocol version") {
+			t.Fatalf("version %d: got %v", version, err)
+		}
+	}
+}
+
+func TestStalledViewer(t *testing.T) {
+	defer func(timeout time.Duration) { client.HandshakeTimeout = timeout }(client.HandshakeTimeout)
+	client.HandshakeTimeout = 100 * time.Millisecond
+
+	// a viewer that takes the connection and never answers the hello
+	listener := transport.NewPipeListener()
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	connected := make(chan error, 1)
+	go func() { connected <- pinSharer(listener, "").Connect() }()
+	select {
+	case err := <-connected:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect waited for a viewer that never answered")
+	}
+}
+
+func TestSendFrameNotConnected(t *testing.T) {
+	for _, ghostclient := range []client.GClient{&client.TCPGClient{}, &client.HTTPSGClient{}, &client.QUICGClient{}, &client.UDPGClient{}} {
+		if err := ghostclient.SendFrame(protocol.Frame{}); err == nil {
+			t.Fatalf("%T sent a frame without a connection", ghostclient)
+		}
+	}
+}
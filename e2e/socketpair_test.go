@@ -0,0 +1,36 @@
+//go:build unix
+
+package e2e
+
+import (
+	"ghostviewer/client"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// TestSocketpairSession runs a session over a socketpair, the way ssh hands
+// a ProxyCommand one socket as both its stdin and stdout.
+func TestSocketpairSession(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerEnd := os.NewFile(uintptr(fds[0]), "viewer")
+	sharerEnd := os.NewFile(uintptr(fds[1]), "sharer")
+
+	capturer := newCapturer()
+	ghostserver := &server.StdioGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportStdio, 1920, 1080)},
+		Stream:     &transport.Stream{In: viewerEnd, Out: viewerEnd},
+	}
+	ghostclient := &client.StdioGClient{
+		TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportStdio, capturer)},
+		Stream:     &transport.Stream{In: sharerEnd, Out: sharerEnd},
+	}
+
+	streamSession(t, ghostserver, ghostclient, capturer, protocol.TransportStdio)
+}
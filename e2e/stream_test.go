@@ -0,0 +1,88 @@
+package e2e
+
+import (
+	"ghostviewer/client"
+	"ghostviewer/fake"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// streamSession runs a session between ghostserver and ghostclient, which
+// must reach each other over the same stream, and checks frames get through.
+func streamSession(t *testing.T, ghostserver server.GServer, ghostclient client.GClient, capturer client.Capturer, want string) {
+	listened := make(chan error, 1)
+	go func() { listened <- ghostserver.Listen() }()
+
+	if err := client.ConnectWithRetry(ghostclient, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+
+	checkSession(t, ghostserver, ghostclient, capturer, want)
+}
+
+// checkSession checks frames get through between ghostserver and
+// ghostclient, once connected, and that they negotiated transport want.
+func checkSession(t *testing.T, ghostserver server.GServer, ghostclient client.GClient, capturer client.Capturer, want string) {
+	defer hangUp(ghostclient)
+
+	if transport := ghostserver.Session().Transport; transport != want {
+		t.Fatalf("negotiated %q", transport)
+	}
+
+	renderer := fake.NewRenderer()
+	go server.ServerViewer(ghostserver, renderer)
+	go client.ClientCommunicate(ghostclient, capturer, fake.NewInputDriver(), &fake.Consent{}, fullScale)
+	waitFrames(t, renderer, 5)
+}
+
+func newCapturer() *fake.Capturer {
+	return &fake.Capturer{Width: width, Height: height, Interval: 5 * time.Millisecond}
+}
+
+func TestStdioSession(t *testing.T) {
+	// as if the viewer ran the sharer over ssh: each one's stdout is the
+	// other's stdin
+	toViewer, fromSharer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toSharer, fromViewer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capturer := newCapturer()
+	ghostserver := &server.StdioGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportStdio, 1920, 1080)},
+		Stream:     &transport.Stream{In: toViewer, Out: fromViewer},
+	}
+	ghostclient := &client.StdioGClient{
+		TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportStdio, capturer)},
+		Stream:     &transport.Stream{In: toSharer, Out: fromSharer},
+	}
+
+	streamSession(t, ghostserver, ghostclient, capturer, protocol.TransportStdio)
+}
+
+func TestUnixSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ghostviewer.sock")
+	capturer := newCapturer()
+	ghostserver := &server.UnixGServer{
+		TCPGServer: server.TCPGServer{Hello: protocol.NewHello(protocol.TransportUnix, 1920, 1080)},
+		Path:       path,
+	}
+	ghostclient := &client.UnixGClient{
+		TCPGClient: client.TCPGClient{Hello: client.LocalHello(protocol.TransportUnix, capturer)},
+		Path:       path,
+	}
+
+	streamSession(t, ghostserver, ghostclient, capturer, protocol.TransportUnix)
+}
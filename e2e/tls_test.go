@@ -0,0 +1,141 @@
+package e2e
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"ghostviewer/client"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"ghostviewer/transport"
+	"math/big"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// selfSigned makes a certificate like the one a viewer ships with.
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTCPOverTLS(t *testing.T) {
+	cert := selfSigned(t)
+	pin, err := transport.CertificateFingerprint(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	capturer := newCapturer()
+	ghostserver := &server.TCPGServer{
+		Ip:        "127.0.0.1",
+		Port:      port,
+		Hello:     protocol.NewHello(protocol.TransportTCP, 1920, 1080),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+
+	// a plaintext sharer is turned away, and the viewer waits for the next
+	plain := &client.TCPGClient{Ip: "127.0.0.1", Port: port, Hello: client.LocalHello(protocol.TransportTCP, capturer)}
+	ghostclient := &client.TCPGClient{
+		Ip:          "127.0.0.1",
+		Port:        port,
+		Hello:       client.LocalHello(protocol.TransportTCP, capturer),
+		TLS:         true,
+		Fingerprint: pin,
+		KnownHosts:  &transport.KnownHosts{Path: filepath.Join(t.TempDir(), "known_hosts")},
+	}
+
+	listened := make(chan error, 1)
+	go func() { listened <- ghostserver.Listen() }()
+	for {
+		err := plain.Connect()
+		if err == nil {
+			t.Fatal("plaintext sharer connected")
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.ConnectWithRetry(ghostclient, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+
+	checkSession(t, ghostserver, ghostclient, capturer, protocol.TransportTCP)
+}
+
+func TestTCPClientCertificates(t *testing.T) {
+	t.Setenv("GHOSTVIEWER_CERTS", t.TempDir())
+	conf, err := server.LoadTLSConfig(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := transport.ClientTLSConfig(transport.CertDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	capturer := newCapturer()
+	ghostserver := &server.TCPGServer{
+		Ip:        "127.0.0.1",
+		Port:      port,
+		Hello:     protocol.NewHello(protocol.TransportTCP, 1920, 1080),
+		TLSConfig: conf,
+	}
+
+	// a sharer that trusts the viewer's CA but has no certificate of its own
+	// is turned away
+	anonymous := trusted.Clone()
+	anonymous.Certificates = nil
+	stranger := &client.TCPGClient{Ip: "127.0.0.1", Port: port, Hello: client.LocalHello(protocol.TransportTCP, capturer), TLS: true, TLSConfig: anonymous}
+	ghostclient := &client.TCPGClient{Ip: "127.0.0.1", Port: port, Hello: client.LocalHello(protocol.TransportTCP, capturer), TLS: true, TLSConfig: trusted}
+
+	listened := make(chan error, 1)
+	go func() { listened <- ghostserver.Listen() }()
+	for {
+		err := stranger.Connect()
+		if err == nil {
+			t.Fatal("sharer without a certificate connected")
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.ConnectWithRetry(ghostclient, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+
+	checkSession(t, ghostserver, ghostclient, capturer, protocol.TransportTCP)
+}
@@ -0,0 +1,153 @@
+package e2e
+
+import (
+	"crypto/tls"
+	"ghostviewer/client"
+	"ghostviewer/protocol"
+	"ghostviewer/server"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// behindProxy sets up a plain websocket viewer on a free port, with a reverse
+// proxy in front of it like the nginx or Caddy that would terminate TLS. The
+// viewer doesn't listen until its Listen is called.
+func behindProxy(t *testing.T, origins []string) (*server.HTTPSGServer, *httptest.Server) {
+	port := freePort(t)
+	ghostserver := &server.HTTPSGServer{
+		Ip:      "127.0.0.1",
+		Port:    port,
+		Path:    "/ghost/ws",
+		Plain:   true,
+		Origins: origins,
+		Hello:   protocol.NewHello(protocol.TransportHTTPS, 1920, 1080),
+	}
+
+	backend, err := url.Parse("http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(httputil.NewSingleHostReverseProxy(backend))
+	t.Cleanup(proxy.Close)
+	return ghostserver, proxy
+}
+
+func TestWebSocketBehindProxy(t *testing.T) {
+	ghostserver, proxy := behindProxy(t, nil)
+
+	host, port, err := net.SplitHostPort(proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	capturer := newCapturer()
+	ghostclient := &client.HTTPSGClient{
+		Ip:    host,
+		Port:  portNum,
+		Path:  "/ghost/ws",
+		Plain: true,
+		Hello: client.LocalHello(protocol.TransportHTTPS, capturer),
+	}
+
+	streamSession(t, ghostserver, ghostclient, capturer, protocol.TransportHTTPS)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	ghostserver, proxy := behindProxy(t, []string{"https://viewer.example"})
+	if err := ghostserver.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	u := "ws://" + proxy.Listener.Addr().String() + "/ghost/ws"
+
+	for _, origin := range []string{"https://evil.example", "http://" + proxy.Listener.Addr().String()} {
+		conn, resp, err := websocket.DefaultDialer.Dial(u, http.Header{"Origin": {origin}})
+		if err == nil {
+			conn.Close()
+			t.Fatalf("upgraded with origin %s", origin)
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("origin %s: %v", origin, err)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(u, http.Header{"Origin": {"https://viewer.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestWebSocketStalledAuth(t *testing.T) {
+	port := freePort(t)
+	ghostserver := &server.HTTPSGServer{
+		Ip:        "127.0.0.1",
+		Port:      port,
+		Hello:     protocol.NewHello(protocol.TransportHTTPS, 1920, 1080),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}},
+	}
+	ghostserver.SetPassword(pin)
+	if err := ghostserver.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer ghostserver.Close()
+
+	// a sharer that says hello, is asked for the PIN and then goes quiet
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	u := "wss://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/ws"
+	var conn *websocket.Conn
+	for {
+		var err error
+		if conn, _, err = dialer.Dial(u, nil); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	hello, err := protocol.Marshal(client.LocalHello(protocol.TransportHTTPS, newCapturer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, hello); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := protocol.DecodeHello(data); err != nil || reply.Auth != protocol.AuthSRP {
+		t.Fatalf("reply %+v, %v, want a PIN request", reply, err)
+	}
+
+	// the viewer can still be closed while it waits for the PIN
+	closed := make(chan struct{})
+	go func() {
+		ghostserver.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for a sharer stuck in the handshake")
+	}
+}
+
+// freePort finds a port on loopback for a server that only takes a port
+// number, which is free unless something else grabs it first.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
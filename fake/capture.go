@@ -0,0 +1,46 @@
+// Package fake provides capture, input and rendering backends that run
+// anywhere, so a whole session can be exercised without a desktop.
+package fake
+
+import (
+	"image"
+	"sync"
+	"time"
+)
+
+// Capturer produces synthetic frames. See Frame for the pattern.
+type Capturer struct {
+	Width    int
+	Height   int
+	Interval time.Duration // delay before each capture, to pace the sender
+
+	mu    sync.Mutex
+	count int
+}
+
+// Frame returns frame n as the sharer would capture it, in BGRA: blue holds
+// n and green/red hold the low and high bytes of the pixel index.
+func Frame(width int, height int, n int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = byte(n), byte(i), byte(i>>8), 255
+	}
+	return img
+}
+
+func (c *Capturer) Capture() (*image.RGBA, error) {
+	time.Sleep(c.Interval)
+
+	c.mu.Lock()
+	n := c.count
+	c.count++
+	c.mu.Unlock()
+
+	return Frame(c.Width, c.Height, n), nil
+}
+
+func (c *Capturer) Bounds() (image.Rectangle, error) {
+	return image.Rect(0, 0, c.Width, c.Height), nil
+}
+
+func (c *Capturer) Close() {}
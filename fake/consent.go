@@ -0,0 +1,114 @@
+package fake
+
+import (
+	"errors"
+	"ghostviewer/protocol"
+	"sync"
+	"time"
+)
+
+// Consent stands in for the person at the shared machine. It allows whatever
+// is asked unless told to decline or to allow viewing only, or answers with
+// Answer if set, and remembers what it was asked, whether it was asked twice
+// at once and what the indicator shows. The indicator fails to show if
+// NoIndicator is set, and Delay holds up every answer, like a user taking
+// their time.
+type Consent struct {
+	Decline     bool
+	ViewOnly    bool
+	NoIndicator bool
+	Delay       time.Duration
+	Answer      func(viewer string, access string) string
+
+	mu         sync.Mutex
+	asked      []string
+	asking     int
+	overlapped bool
+	indicators int
+	indicated  string
+	stop       func()
+}
+
+func (c *Consent) Ask(viewer string, access string) string {
+	c.mu.Lock()
+	c.asking++
+	c.overlapped = c.overlapped || c.asking > 1
+	c.mu.Unlock()
+
+	time.Sleep(c.Delay)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.asking--
+	c.asked = append(c.asked, viewer+" "+access)
+	switch {
+	case c.Answer != nil:
+		return c.Answer(viewer, access)
+	case c.Decline:
+		return ""
+	case c.ViewOnly:
+		return protocol.AccessView
+	}
+	return access
+}
+
+func (c *Consent) Indicate(viewer string, access string, stop func()) (func(), error) {
+	if c.NoIndicator {
+		return nil, errors.New("no desktop to show the indicator on")
+	}
+
+	c.mu.Lock()
+	c.indicators++
+	c.indicated, c.stop = viewer+" "+access, stop
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			c.indicators--
+			c.mu.Unlock()
+		})
+	}, nil
+}
+
+// Asked lists the requests so far, each as the viewer and the access asked.
+func (c *Consent) Asked() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.asked...)
+}
+
+// Overlapped reports whether a request was asked while another was open.
+func (c *Consent) Overlapped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.overlapped
+}
+
+// Showing reports whether an indicator is up.
+func (c *Consent) Showing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.indicators > 0
+}
+
+// Indicated is what the latest indicator shows, as the viewers and the
+// access they have.
+func (c *Consent) Indicated() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.indicated
+}
+
+// Stop clicks "stop sharing" on the indicator.
+func (c *Consent) Stop() {
+	c.mu.Lock()
+	stop := c.stop
+	c.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
@@ -0,0 +1,16 @@
+package fake
+
+import "ghostviewer/protocol"
+
+// InputDriver records the input the sharer was asked to replay.
+type InputDriver struct {
+	Injected chan protocol.Message
+}
+
+func NewInputDriver() *InputDriver {
+	return &InputDriver{Injected: make(chan protocol.Message, 1024)}
+}
+
+func (d *InputDriver) Inject(msg protocol.Message) {
+	d.Injected <- msg
+}
@@ -0,0 +1,46 @@
+package fake
+
+import (
+	"ghostviewer/protocol"
+	"image"
+	"sync"
+)
+
+// Renderer stands in for the viewer window. Frames it is given show up on
+// Frames, and anything sent on Events goes to the sharer as viewer input.
+type Renderer struct {
+	Frames chan *image.RGBA
+	Events chan protocol.Message
+
+	mu     sync.Mutex
+	status string
+}
+
+func NewRenderer() *Renderer {
+	return &Renderer{Frames: make(chan *image.RGBA, 64), Events: make(chan protocol.Message, 256)}
+}
+
+// UpdateFrame drops frames nobody is reading, as a real window would only
+// show the latest.
+func (r *Renderer) UpdateFrame(frame *image.RGBA) {
+	select {
+	case r.Frames <- frame:
+	default:
+	}
+}
+
+func (r *Renderer) SetStatus(status string) {
+	r.mu.Lock()
+	r.status = status
+	r.mu.Unlock()
+}
+
+func (r *Renderer) Status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+func (r *Renderer) Input() <-chan protocol.Message {
+	return r.Events
+}
@@ -1,105 +1,462 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"ghostviewer/client"
+	"ghostviewer/io"
+	"ghostviewer/protocol"
 	"ghostviewer/server"
+	"ghostviewer/transport"
 	"ghostviewer/ui"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 
 	"github.com/hajimehoshi/ebiten/v2"
 )
 
 func main() {
-	if len(os.Args) != 5 {
+	if len(os.Args) >= 2 && os.Args[1] == "share" {
+		os.Args[1] = "client"
+	}
+
+	if len(os.Args) >= 2 && os.Args[1] == "gencert" {
+		gencert(os.Args[2:])
+		return
+	}
+
+	// streams take a path or a command in place of an address
+	if len(os.Args) >= 3 && strings.HasPrefix(os.Args[2], "--") {
+		runStream(os.Args[1], os.Args[2], os.Args[3:])
+		return
+	}
+
+	// tcp is encrypted unless plaintext is asked for, and udp and plain
+	// websockets never are, so they have to be asked for knowingly
+	insecure := hasFlag("--insecure")
+	// the viewer only takes sharers holding a certificate from its CA
+	clientCerts := hasFlag("--client-certs")
+	// the viewer asks the sharer's user to let it watch, not control
+	access := protocol.AccessControl
+	if hasFlag("--view-only") {
+		access = protocol.AccessView
+	}
+	// the sharer pins the viewer's certificate rather than trusting it on
+	// first use
+	fingerprint, pinned := flagValue("--fingerprint")
+	if !pinned {
+		fingerprint = os.Getenv("GHOSTVIEWER_FINGERPRINT")
+	}
+
+	// a viewer makes up a PIN for the sharer to type in, or takes a password
+	// from the environment
+	password := os.Getenv("GHOSTVIEWER_PASSWORD")
+	for i, arg := range os.Args {
+		if arg != "--pin" {
+			continue
+		}
+		if os.Args[1] == "server" {
+			password = protocol.NewPIN()
+			fmt.Printf("Session PIN: %s\n", password)
+			os.Args = append(os.Args[:i:i], os.Args[i+1:]...)
+		} else if i+1 < len(os.Args) {
+			password = os.Args[i+1]
+			os.Args = append(os.Args[:i:i], os.Args[i+2:]...)
+		} else {
+			usage()
+		}
+		break
+	}
+
+	if len(os.Args) != 5 && len(os.Args) != 6 {
 		fmt.Println(os.Args)
-		fmt.Fprintf(os.Stderr, "Usage: %s <client/server> <ip> <port> <http/tcp/udp>\n", os.Args[0])
-		os.Exit(1)
+		usage()
 	}
 
 	instance := os.Args[1]
-	addr := net.ParseIP(os.Args[2])
+	// a client can broadcast to several viewers, one per address
+	var addrs []net.IP
+	for _, ip := range strings.Split(os.Args[2], ",") {
+		addrs = append(addrs, net.ParseIP(ip))
+	}
+	addr := addrs[0]
 	port, err := strconv.Atoi(os.Args[3])
 	commtype := os.Args[4]
 
+	// the last argument is the relay's invite code, or the websocket's path
+	inviteCode, path := "", ""
+	if len(os.Args) == 6 && (commtype == "https" || commtype == "ws") {
+		path = os.Args[5]
+	} else if len(os.Args) == 6 {
+		inviteCode = os.Args[5]
+	}
+
+	// plain websockets are the https transport without TLS, which a proxy in
+	// front of the viewer adds back
+	transportName := commtype
+	if commtype == "ws" {
+		transportName = protocol.TransportHTTPS
+	}
+
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid port value %s", os.Args[3])
 		os.Exit(1)
 	}
 
-	if addr == nil {
-		fmt.Fprintf(os.Stderr, "Invalid IP address\n")
+	for _, a := range addrs {
+		if a == nil {
+			fmt.Fprintf(os.Stderr, "Invalid IP address\n")
+			os.Exit(1)
+		}
+	}
+
+	if len(addrs) > 1 && (instance != "client" || commtype == "relay") {
+		fmt.Fprintf(os.Stderr, "Only a client on a direct transport can broadcast to several viewers\n")
 		os.Exit(1)
 	} else if port < 1 || port > 65535 {
 		fmt.Fprintf(os.Stderr, "Invalid port\n")
 		os.Exit(1)
 	}
 
-	ln, err := net.Listen("tcp", ":"+os.Args[3])
+	// with a relay in between, the port belongs to the relay, not to us
+	if commtype != "relay" {
+		ln, err := net.Listen("tcp", ":"+os.Args[3])
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Can't listen on port %d: %s\n", port, err)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't listen on port %d: %s\n", port, err)
+			os.Exit(1)
+		}
+
+		_ = ln.Close()
+	}
+
+	if instance == "relay" {
+		mbits, err := strconv.ParseFloat(commtype, 64)
+		if err != nil || mbits < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid bandwidth cap %s\n", commtype)
+			os.Exit(1)
+		}
+
+		relay := &transport.Relay{Addr: net.JoinHostPort(addr.String(), os.Args[3]), MaxRate: int(mbits * 1e6 / 8)}
+		fmt.Printf("Relaying on %s\n", relay.Addr)
+		if err := relay.ListenAndServe(); err != nil {
+			fmt.Fprintf(os.Stderr, "Relay error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if commtype != "https" && commtype != "ws" && commtype != "tcp" && commtype != "udp" && commtype != "quic" && commtype != "relay" {
+		fmt.Fprintf(os.Stderr, "Invalid commtype %s, choose from https, ws, tcp, udp, quic or relay\n", commtype)
 		os.Exit(1)
 	}
 
-	_ = ln.Close()
+	plaintext := commtype == "udp" || commtype == "ws"
+	if insecure && commtype != "tcp" && !plaintext {
+		fmt.Fprintf(os.Stderr, "--insecure only applies to tcp, udp and ws\n")
+		os.Exit(1)
+	} else if plaintext && !insecure {
+		fmt.Fprintf(os.Stderr, "%s is unencrypted, pass --insecure to use it anyway\n", commtype)
+		os.Exit(1)
+	} else if insecure {
+		fmt.Fprintf(os.Stderr, "WARNING: sending the screen and keystrokes unencrypted\n")
+	}
 
-	if commtype != "https" && commtype != "tcp" && commtype != "udp" {
-		fmt.Fprintf(os.Stderr, "Invalid commtype %s, choose from https, tcp or udp\n", commtype)
+	if password != "" && insecure {
+		fmt.Fprintf(os.Stderr, "A PIN or password needs an encrypted transport, not --insecure\n")
 		os.Exit(1)
 	}
 
-	if instance == "server" {
-		var ghostserver server.GServer
-		var ghostrenderer *ui.GRenderer
+	if access == protocol.AccessView && instance != "server" {
+		fmt.Fprintf(os.Stderr, "--view-only only applies to a server\n")
+		os.Exit(1)
+	}
+
+	if pinned && (instance != "client" || insecure || (commtype != "tcp" && commtype != "https" && commtype != "quic")) {
+		fmt.Fprintf(os.Stderr, "--fingerprint only applies to a client on tcp, https or quic\n")
+		os.Exit(1)
+	}
+
+	if clientCerts && (instance != "server" || insecure || (commtype != "tcp" && commtype != "https" && commtype != "quic")) {
+		fmt.Fprintf(os.Stderr, "--client-certs only applies to a server on tcp, https or quic\n")
+		os.Exit(1)
+	}
 
-		if commtype == "tcp" {
-			ghostserver = &server.TCPGServer{addr.String(), port, nil}
-		} else if commtype == "https" {
-			ghostserver = &server.HTTPSGServer{addr.String(), port, false}
+	// the viewer's certificate, for the modes that use one
+	var serverTLS *tls.Config
+	if instance == "server" && ((commtype == "tcp" && !insecure) || commtype == "https" || commtype == "quic") {
+		if serverTLS, err = server.LoadTLSConfig(clientCerts); err != nil {
+			fmt.Fprintf(os.Stderr, "Certificate error: %s\n", err)
+			os.Exit(1)
 		}
+	}
 
-		ghostrenderer = ui.NewGRenderer()
-		ghostserver.Listen()
-		go server.ServerViewer(ghostserver, ghostrenderer)
-		for !ghostserver.IsConnected() {
+	if instance == "server" && commtype == "tcp" {
+		// a TCP viewer takes any number of sharers at once
+		l, err := net.Listen("tcp", net.JoinHostPort(addr.String(), os.Args[3]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Listen error: %s\n", err)
+			os.Exit(1)
+		}
+
+		local := ui.NewGRenderer()
+		deck := ui.NewDeck()
+		hello := protocol.NewHello(commtype, local.LocalWidth, local.LocalHeight)
+		hello.Access = access
+		hub := &server.Hub{
+			Listener:  l,
+			TLSConfig: serverTLS,
+			Password:  password,
+			Hello:     hello,
+			NewRenderer: func(id int, hostname string) server.Renderer {
+				return deck.Add(id, hostname)
+			},
+			OnClosed: deck.Close,
 		}
+
 		go func() {
-			for {
-				if !ghostserver.IsConnected() {
-					fmt.Println("Client disconnected")
-					os.Exit(1)
-				}
+			if err := hub.Serve(); err != nil {
+				fmt.Fprintf(os.Stderr, "Listen error: %s\n", err)
+				os.Exit(1)
 			}
 		}()
 
-		ebiten.SetWindowTitle("Ghostviewer")
-		ebiten.SetWindowSize(1280, 720)
-		ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
-		if err := ebiten.RunGame(ghostrenderer); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to run GUI: %s\n", err)
-			os.Exit(1)
+		runWindow(deck)
+		hub.Disconnect(viewerClosed)
+	} else if instance == "server" {
+		var ghostserver server.GServer
+		var ghostrenderer *ui.GRenderer
+
+		ghostrenderer = ui.NewGRenderer()
+		hello := protocol.NewHello(transportName, ghostrenderer.LocalWidth, ghostrenderer.LocalHeight)
+		hello.Access = access
+
+		if commtype == "https" || commtype == "ws" {
+			var origins []string
+			if env := os.Getenv("GHOSTVIEWER_ORIGINS"); env != "" {
+				origins = strings.Split(env, ",")
+			}
+			ghostserver = &server.HTTPSGServer{Ip: addr.String(), Port: port, Path: path, Plain: commtype == "ws", Origins: origins, TLSConfig: serverTLS, Hello: hello}
+		} else if commtype == "udp" {
+			ghostserver = &server.UDPGServer{Ip: addr.String(), Port: port, Hello: hello}
+		} else if commtype == "quic" {
+			ghostserver = &server.QUICGServer{Ip: addr.String(), Port: port, TLSConfig: serverTLS, Hello: hello}
+		} else if commtype == "relay" {
+			if inviteCode == "" {
+				inviteCode = transport.NewInviteCode()
+			}
+			ghostserver = &server.RelayGServer{TCPGServer: server.TCPGServer{Ip: addr.String(), Port: port, Hello: hello}, InviteCode: inviteCode}
+		}
+
+		if password != "" {
+			ghostserver.(interface{ SetPassword(string) }).SetPassword(password)
 		}
+
+		view(ghostserver, ghostrenderer)
 	} else if instance == "client" {
-		var ghostclient client.GClient
-		if commtype == "tcp" {
-			ghostclient = &client.TCPGClient{addr.String(), port, nil}
-		} else if commtype == "https" {
-			ghostclient = &client.HTTPSGClient{addr.String(), port, nil}
+		capturer := &client.ScreenCapturer{}
+		hello := client.LocalHello(transportName, capturer)
+		if commtype == "relay" && inviteCode == "" {
+			fmt.Fprintf(os.Stderr, "Relay mode needs the invite code shown by the server\n")
+			os.Exit(1)
 		}
 
-		err := ghostclient.Connect()
+		// a CA from gencert replaces trust on first use
+		conf, err := transport.ClientTLSConfig(transport.CertDir())
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Connection error: %s", err)
+			fmt.Fprintf(os.Stderr, "Certificate error: %s\n", err)
 			os.Exit(1)
 		}
 
-		fmt.Println("Connect success")
-		client.ClientCommunicate(ghostclient)
+		var viewers []client.GClient
+		for _, a := range addrs {
+			viewers = append(viewers, newClient(commtype, a.String(), port, hello, inviteCode, path, insecure, fingerprint, conf))
+		}
+
+		ghostclient := viewers[0]
+		if len(viewers) > 1 {
+			ghostclient = &client.Broadcast{Viewers: viewers}
+		}
+
+		if password != "" {
+			ghostclient.(interface{ SetPassword(string) }).SetPassword(password)
+		}
+
+		share(ghostclient, capturer)
 	} else {
 		fmt.Fprintf(os.Stderr, "Invalid instance value - use server or client\n")
 		os.Exit(1)
 	}
 }
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <client/server> <ip[,ip...]> <port> <https/ws/tcp/udp/quic/relay> [invite code | websocket path] [--insecure] [--client-certs] [--view-only] [--fingerprint SHA256:... (client)] [--pin (server) | --pin <PIN> (client)]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s gencert [extra hostname or ip...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s <client/server> --stdio | --unix <path> | --command <command> [args...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s relay <ip> <port> <Mbit/s per session, 0 for no cap>\n", os.Args[0])
+	os.Exit(1)
+}
+
+// runStream shares or views over a stream instead of the network: our own
+// stdin and stdout, a command's, or a Unix socket. Together they tunnel a
+// session over ssh, e.g. "ghostviewer server --command ssh host ghostviewer
+// share --stdio".
+func runStream(instance string, mode string, args []string) {
+	if instance != "client" && instance != "server" {
+		usage()
+	}
+
+	var stream *transport.Stream
+	path := ""
+	switch {
+	case mode == "--stdio" && len(args) == 0:
+		// stdout carries the session now, so everything we print goes to
+		// stderr, which ssh passes back to the other side
+		stream = &transport.Stream{In: os.Stdin, Out: os.Stdout}
+		os.Stdout = os.Stderr
+	case mode == "--command" && len(args) > 0:
+		stream = &transport.Stream{Command: args}
+	case mode == "--unix" && len(args) == 1:
+		path = args[0]
+	default:
+		usage()
+	}
+
+	commtype := protocol.TransportStdio
+	if stream == nil {
+		commtype = protocol.TransportUnix
+	}
+
+	if instance == "client" {
+		capturer := &client.ScreenCapturer{}
+		tcp := client.TCPGClient{Hello: client.LocalHello(commtype, capturer)}
+		if stream != nil {
+			share(&client.StdioGClient{TCPGClient: tcp, Stream: stream}, capturer)
+		} else {
+			share(&client.UnixGClient{TCPGClient: tcp, Path: path}, capturer)
+		}
+		return
+	}
+
+	ghostrenderer := ui.NewGRenderer()
+	tcp := server.TCPGServer{Hello: protocol.NewHello(commtype, ghostrenderer.LocalWidth, ghostrenderer.LocalHeight)}
+	if stream != nil {
+		view(&server.StdioGServer{TCPGServer: tcp, Stream: stream}, ghostrenderer)
+	} else {
+		view(&server.UnixGServer{TCPGServer: tcp, Path: path}, ghostrenderer)
+	}
+}
+
+// share streams the screen to ghostclient until either side ends the session.
+func share(ghostclient client.GClient, capturer *client.ScreenCapturer) {
+	err := client.ConnectWithRetry(ghostclient, 10)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Connection error: %s", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Connect success")
+
+	// tell the viewer we're done rather than leave it waiting for us to
+	// reconnect
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		ghostclient.Disconnect(protocol.Goodbye{Code: protocol.GoodbyeUserEnded})
+	}()
+
+	client.ClientCommunicate(ghostclient, capturer, io.Driver{}, client.DesktopConsent{}, client.DefaultRateLimits)
+}
+
+// viewerClosed tells sharers the viewer's window was closed, so they stop
+// rather than wait for it to come back.
+var viewerClosed = protocol.Goodbye{Code: protocol.GoodbyeUserEnded, Reason: "viewer closed"}
+
+// view waits for the first sharer on ghostserver, then shows it in a window,
+// which stays open once the session ends to show why. Closing it ends the
+// session.
+func view(ghostserver server.GServer, ghostrenderer *ui.GRenderer) {
+	if err := ghostserver.Listen(); err != nil {
+		fmt.Fprintf(os.Stderr, "Listen error: %s\n", err)
+		os.Exit(1)
+	}
+	go server.ServerViewer(ghostserver, ghostrenderer)
+
+	for event := range ghostserver.Events() {
+		if event.State == transport.StateConnected {
+			break
+		}
+	}
+
+	runWindow(ghostrenderer)
+	ghostserver.Disconnect(viewerClosed)
+}
+
+// hasFlag reports whether flag was given, and removes it from os.Args.
+func hasFlag(flag string) bool {
+	for i, arg := range os.Args {
+		if arg == flag {
+			os.Args = append(os.Args[:i:i], os.Args[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// flagValue returns the value given after flag, and removes both from os.Args.
+// A flag given without a value is a usage error.
+func flagValue(flag string) (string, bool) {
+	for i, arg := range os.Args {
+		if arg != flag {
+			continue
+		}
+		if i+1 >= len(os.Args) {
+			usage()
+		}
+		value := os.Args[i+1]
+		os.Args = append(os.Args[:i:i], os.Args[i+2:]...)
+		return value, true
+	}
+	return "", false
+}
+
+// gencert creates a CA with server and client certificates signed by it, or
+// reissues them with the keys already there.
+func gencert(hosts []string) {
+	dir := transport.CertDir()
+	if err := transport.GenerateCertificates(dir, hosts); err != nil {
+		fmt.Fprintf(os.Stderr, "Certificate error: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Certificates written to %s\n", dir)
+	fmt.Printf("Copy %s, %s and %s to the sharer's certificate directory\n", transport.CAFile, transport.ClientCertFile, transport.ClientKeyFile)
+}
+
+func newClient(commtype string, ip string, port int, hello protocol.Hello, inviteCode string, path string, insecure bool, fingerprint string, conf *tls.Config) client.GClient {
+	switch commtype {
+	case "https", "ws":
+		return &client.HTTPSGClient{Ip: ip, Port: port, Path: path, Plain: commtype == "ws", TLSConfig: conf, Fingerprint: fingerprint, Hello: hello}
+	case "udp":
+		return &client.UDPGClient{Ip: ip, Port: port, Hello: hello}
+	case "quic":
+		return &client.QUICGClient{Ip: ip, Port: port, TLSConfig: conf, Fingerprint: fingerprint, Hello: hello}
+	case "relay":
+		return &client.RelayGClient{TCPGClient: client.TCPGClient{Ip: ip, Port: port, Hello: hello}, InviteCode: inviteCode}
+	}
+	return &client.TCPGClient{Ip: ip, Port: port, Hello: hello, TLS: !insecure, TLSConfig: conf, Fingerprint: fingerprint}
+}
+
+func runWindow(game ebiten.Game) {
+	ebiten.SetWindowTitle("Ghostviewer")
+	ebiten.SetWindowSize(1280, 720)
+	ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
+	if err := ebiten.RunGame(game); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run GUI: %s\n", err)
+		os.Exit(1)
+	}
+}
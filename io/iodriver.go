@@ -1,34 +1,36 @@
 package io
 
-func PassMessageToIODriver(m []byte) {
-	//msg := string(m)
-	//args := strings.Split(msg, ":")
-	/*if strings.Contains(args[0], "MOUSE") {
-		mX, _ := strconv.Atoi(args[1])
-		mY, _ := strconv.Atoi(args[2])
-		robotgo.Move(mX, mY)
+import "ghostviewer/protocol"
 
-		if args[0][0:2] == "LD" {
-			robotgo.Toggle("left", "down")
-		} else if args[0][0:2] == "RD" {
-			robotgo.Toggle("right", "down")
-		} else if args[0][0:2] == "LU" {
-			robotgo.Toggle("left", "up")
-		} else if args[0][0:2] == "RU" {
-			robotgo.Toggle("right", "up")
+func PassMessageToIODriver(msg protocol.Message) {
+	/*switch m := msg.(type) {
+	case protocol.Pointer:
+		robotgo.Move(int(m.X), int(m.Y))
+
+		button := "left"
+		if m.Button == protocol.ButtonRight {
+			button = "right"
 		}
-	} else if args[0] == "KEY" {
-		if _, err := strconv.Atoi(string(args[2])); err == nil { // checks if idx is valid, failsafe measure
-			fmt.Println(msg)
 
-			mK, _ := strconv.Atoi(string(args[1]))
-			mKind := uint8(mK)
-			kChar := string(args[3])
-			switch mKind {
-			case gohook.KeyDown:
-				robotgo.KeyDown(string(kChar))
-				robotgo.KeyUp(string(kChar))
-			} This is another test. hope it works okl. This is pushingi t I think. it's starting to get a little laggy.
+		if m.Action == protocol.PointerDown {
+			robotgo.Toggle(button, "down")
+		} else if m.Action == protocol.PointerUp {
+			robotgo.Toggle(button, "up")
+		}
+	case protocol.Scroll:
+		robotgo.Scroll(int(m.DX), int(m.DY))
+	case protocol.Key:
+		switch m.Kind {
+		case gohook.KeyDown:
+			robotgo.KeyDown(string(m.Char))
+			robotgo.KeyUp(string(m.Char))
 		}
 	}*/
 }
+
+// Driver injects viewer input into this machine's input queue.
+type Driver struct{}
+
+func (Driver) Inject(msg protocol.Message) {
+	PassMessageToIODriver(msg)
+}
@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrTruncated = errors.New("truncated message")
+
+// encoder appends big-endian fields to a byte slice.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v >> 32))
+	e.u32(uint32(v))
+}
+
+func (e *encoder) i32(v int32) {
+	e.u32(uint32(v))
+}
+
+func (e *encoder) i64(v int64) {
+	e.u64(uint64(v))
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.u32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	if len(v) > math.MaxUint16 {
+		v = v[:math.MaxUint16]
+	}
+	e.u16(uint16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) strings(v []string) {
+	e.u16(uint16(len(v)))
+	for _, s := range v {
+		e.string(s)
+	}
+}
+
+// decoder reads the fields written by encoder. The first failure is sticky so
+// callers can decode a whole struct and check err once.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.buf) < n {
+		d.err = ErrTruncated
+		d.buf = nil
+		return nil
+	}
+
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) i32() int32 {
+	return int32(d.u32())
+}
+
+func (d *decoder) i64() int64 {
+	return int64(d.u64())
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.u32()
+	if uint64(n) > uint64(len(d.buf)) {
+		d.next(len(d.buf) + 1)
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.u16())))
+}
+
+func (d *decoder) strings() []string {
+	n := int(d.u16())
+	if n > len(d.buf)/2 {
+		d.next(len(d.buf) + 1)
+		return nil
+	}
+
+	var out []string
+	for i := 0; i < n && d.err == nil; i++ {
+		out = append(out, d.string())
+	}
+	return out
+}
+
+func (d *decoder) finish(t MessageType) error {
+	if d.err != nil {
+		return fmt.Errorf("decode %s: %w", t, d.err)
+	}
+
+	if len(d.buf) != 0 {
+		return fmt.Errorf("decode %s: %d trailing bytes", t, len(d.buf))
+	}
+
+	return nil
+}
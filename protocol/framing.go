@@ -0,0 +1,219 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Stream transports frame every message as '%' followed by the little-endian
+// uint32 length of the encoded message.
+const (
+	PacketPrefix = '%'
+	HeaderSize   = 5
+)
+
+// MaxFrameSize fits an uncompressed 5K BGRA frame.
+const MaxFrameSize = 64 << 20
+
+// MaxChunkSize bounds the data in a Chunk, and so how long an urgent message
+// can wait behind a large one on a multiplexed stream.
+const MaxChunkSize = 32 << 10
+
+// maxMessageSize bounds the encoded size of each message type, so a corrupt or
+// hostile length field is rejected before anything is allocated for it.
+var maxMessageSize = map[MessageType]int{
+	TypeHello:   16 << 10,
+	TypeFrame:   MaxFrameSize,
+	TypePointer: 32,
+	TypeKey:     32,
+	TypeScroll:  32,
+	TypeControl: 16,
+	TypeError:   1 << 10,
+	TypeClock:   32,
+	TypeGoodbye: 1 << 10,
+	TypeChunk:   MaxChunkSize + 8,
+	TypeChannel: 1 << 10,
+	TypeAuth:    2 << 10,
+}
+
+// MaxPacketSize is the largest message any type allows.
+const MaxPacketSize = MaxFrameSize
+
+// ProtocolError means the peer sent something that violates the protocol.
+// The connection can't be trusted afterwards, so the receiver reports it to
+// the peer and closes.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Reason
+}
+
+// Message returns the Error message to send to the peer before closing.
+func (e *ProtocolError) Message() Error {
+	return Error{Code: ErrorProtocol, Reason: e.Reason}
+}
+
+func protocolErrorf(format string, args ...interface{}) error {
+	return &ProtocolError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// CheckSize validates the length of an encoded message whose first byte is
+// t.
+func CheckSize(t MessageType, size int) error {
+	max, ok := maxMessageSize[t]
+	if !ok {
+		return protocolErrorf("unknown message type %d", uint8(t))
+	}
+
+	if size > max {
+		return protocolErrorf("%d byte %s message exceeds %d byte limit", size, t, max)
+	}
+
+	return nil
+}
+
+// Decode checks the size limit for data's message type and unmarshals it.
+// Every failure is reported as a *ProtocolError.
+func Decode(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return nil, protocolErrorf("empty message")
+	}
+
+	if err := CheckSize(MessageType(data[0]), len(data)); err != nil {
+		return nil, err
+	}
+
+	msg, err := Unmarshal(data)
+	if err != nil {
+		return nil, &ProtocolError{Reason: err.Error()}
+	}
+
+	return msg, nil
+}
+
+// PacketReader reads framed messages from a byte stream.
+type PacketReader struct {
+	r     *bufio.Reader
+	limit int // the largest packet accepted, MaxPacketSize if 0
+}
+
+func NewPacketReader(r io.Reader) *PacketReader {
+	return &PacketReader{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// SetLimit caps the packets ReadPacket accepts at the size limit for t, so a
+// peer that hasn't been let in yet can't make it allocate more than a t
+// needs. A t of 0 lifts the cap.
+func (p *PacketReader) SetLimit(t MessageType) {
+	p.limit = maxMessageSize[t]
+}
+
+// ReadPacket returns the next encoded message. A bad prefix or a length over
+// the limit for the message's type yields a *ProtocolError; I/O failures are
+// returned as is.
+func (p *PacketReader) ReadPacket() ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return nil, err
+	}
+
+	if header[0] != PacketPrefix {
+		return nil, protocolErrorf("bad packet prefix %q", header[0])
+	}
+
+	size := binary.LittleEndian.Uint32(header[1:])
+	if size == 0 {
+		return nil, protocolErrorf("empty packet")
+	}
+
+	max := MaxPacketSize
+	if p.limit != 0 {
+		max = p.limit
+	}
+	if size > uint32(max) {
+		return nil, protocolErrorf("%d byte packet exceeds %d byte limit", size, max)
+	}
+
+	t, err := p.r.Peek(1)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if err := CheckSize(MessageType(t[0]), int(size)); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return data, nil
+}
+
+// ReadMessage reads and decodes the next message.
+func (p *PacketReader) ReadMessage() (Message, error) {
+	data, err := p.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return Decode(data)
+}
+
+// PacketWriter frames messages onto a byte stream. It is safe for concurrent
+// use.
+type PacketWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewPacketWriter(w io.Writer) *PacketWriter {
+	return &PacketWriter{w: w}
+}
+
+func (p *PacketWriter) WritePacket(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("refusing to write empty packet")
+	}
+
+	if err := CheckSize(MessageType(data[0]), len(data)); err != nil {
+		return err
+	}
+
+	header := make([]byte, HeaderSize)
+	header[0] = PacketPrefix
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(data)))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := p.w.Write(data)
+	return err
+}
+
+func (p *PacketWriter) WriteMessage(msg Message) error {
+	data, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return p.WritePacket(data)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func frame(data []byte) []byte {
+	header := make([]byte, HeaderSize)
+	header[0] = PacketPrefix
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func seedMessages(f *testing.F) {
+	msgs := []Message{
+		NewHello(TransportTCP, 1920, 1080),
+		Frame{Width: 2, Height: 1, Pix: make([]byte, 8), Seq: 3, Timestamp: 1e18},
+		Pointer{X: 10, Y: -4, Button: ButtonLeft, Action: PointerDown, Seq: 1, Timestamp: 1e18},
+		Key{Kind: 1, Index: 7, Char: 'a', Code: 65, Seq: 2, Timestamp: 1e18},
+		Scroll{DX: 0, DY: -120, Seq: 3, Timestamp: -1},
+		Control{Code: ControlPing, Value: 42},
+		Error{Code: ErrorProtocol, Reason: "bad"},
+		Goodbye{Code: GoodbyeCaptureLost, Reason: "display driver restarted"},
+		Clock{Origin: 1e18, Peer: 1e18 + 5},
+		Chunk{Channel: 3, Last: true, Data: []byte("frame")},
+		Channel{Op: ChannelOpen, Channel: 17, Value: 1, Name: "clipboard"},
+		Auth{Salt: make([]byte, 16), Public: make([]byte, 256)},
+	}
+
+	for _, msg := range msgs {
+		data, err := Marshal(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	seedMessages(f)
+	f.Add([]byte{})
+	f.Add([]byte{0xff})
+	if data, err := Marshal(Frame{Width: 1 << 31, Height: 1 << 30}); err == nil {
+		f.Add(data)
+	}
+	if data, err := Marshal(Frame{Width: 3, Height: 1, Pix: make([]byte, 8)}); err == nil {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := Decode(data)
+		if err != nil {
+			var protoErr *ProtocolError
+			if !errors.As(err, &protoErr) {
+				t.Fatalf("Decode returned non-protocol error %T: %s", err, err)
+			}
+			return
+		}
+
+		if frame, ok := msg.(Frame); ok && uint64(len(frame.Pix)) != uint64(frame.Width)*uint64(frame.Height)*4 {
+			t.Fatalf("decoded %d bytes for %dx%d frame", len(frame.Pix), frame.Width, frame.Height)
+		}
+
+		// anything that decodes must survive a round trip
+		again, err := Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal of decoded %s failed: %s", msg.Type(), err)
+		}
+
+		if _, err := Decode(again); err != nil {
+			t.Fatalf("re-decoding %s failed: %s", msg.Type(), err)
+		}
+	})
+}
+
+func FuzzReadPacket(f *testing.F) {
+	seedMessages(f)
+	f.Add(frame([]byte{byte(TypePointer)}))
+	f.Add([]byte{PacketPrefix, 0xff, 0xff, 0xff, 0xff, byte(TypeControl)})
+	f.Add([]byte{'#', 1, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		r := NewPacketReader(bytes.NewReader(stream))
+		for {
+			data, err := r.ReadPacket()
+			if err != nil {
+				var protoErr *ProtocolError
+				if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &protoErr) {
+					t.Fatalf("unexpected error %T: %s", err, err)
+				}
+				return
+			}
+
+			if len(data) == 0 || len(data) > maxMessageSize[MessageType(data[0])] {
+				t.Fatalf("ReadPacket returned %d byte packet of type %d", len(data), data[0])
+			}
+		}
+	})
+}
+
+func TestReadPacketLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"bad prefix", []byte{'#', 1, 0, 0, 0, byte(TypeControl)}},
+		{"empty", []byte{PacketPrefix, 0, 0, 0, 0}},
+		{"over max", []byte{PacketPrefix, 0xff, 0xff, 0xff, 0xff, byte(TypeFrame)}},
+		{"over type limit", frame(make([]byte, 33))},
+		{"unknown type", frame([]byte{0xee})},
+	}
+
+	tests[3].stream[HeaderSize] = byte(TypePointer)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewPacketReader(bytes.NewReader(test.stream)).ReadPacket()
+			var protoErr *ProtocolError
+			if !errors.As(err, &protoErr) {
+				t.Fatalf("got %v, want *ProtocolError", err)
+			}
+		})
+	}
+}
+
+func TestReadPacketSetLimit(t *testing.T) {
+	data := make([]byte, 20<<10)
+	data[0] = byte(TypeFrame)
+
+	// a peer only expected to say hello can't send anything bigger
+	r := NewPacketReader(bytes.NewReader(frame(data)))
+	r.SetLimit(TypeHello)
+	var protoErr *ProtocolError
+	if _, err := r.ReadPacket(); !errors.As(err, &protoErr) {
+		t.Fatalf("got %v, want *ProtocolError", err)
+	}
+
+	r = NewPacketReader(bytes.NewReader(frame(data)))
+	r.SetLimit(TypeHello)
+	r.SetLimit(0)
+	if got, err := r.ReadPacket(); err != nil || len(got) != len(data) {
+		t.Fatalf("got %d bytes, %v once the limit was lifted", len(got), err)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPacketWriter(&buf)
+	sent := []Message{
+		Pointer{X: 1, Y: 2, Button: ButtonRight, Action: PointerUp},
+		Frame{Width: 1, Height: 1, Pix: []byte{1, 2, 3, 4}},
+		Control{Code: ControlRefresh},
+	}
+
+	for _, msg := range sent {
+		if err := w.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewPacketReader(&buf)
+	for _, want := range sent {
+		got, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Type() != want.Type() {
+			t.Fatalf("got %s, want %s", got.Type(), want.Type())
+		}
+	}
+
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("got %v at end of stream, want EOF", err)
+	}
+}
+
+func TestDecodeFrameSize(t *testing.T) {
+	for _, frame := range []Frame{
+		{Width: 1 << 31, Height: 1 << 30},
+		{Width: 1 << 16, Height: 1 << 16, Pix: make([]byte, 16)},
+		{Width: 2, Height: 2, Pix: make([]byte, 12)},
+		{Width: 1, Height: 1, Pix: make([]byte, 8)},
+	} {
+		data, err := Marshal(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var protoErr *ProtocolError
+		if _, err := Decode(data); !errors.As(err, &protoErr) {
+			t.Errorf("%dx%d frame with %d bytes: got %v, want *ProtocolError", frame.Width, frame.Height, len(frame.Pix), err)
+		}
+	}
+}
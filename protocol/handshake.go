@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Version is bumped whenever the wire format changes incompatibly.
+const Version = 7
+
+const (
+	CodecRawBGRA = "raw-bgra"
+
+	TransportTCP   = "tcp"
+	TransportHTTPS = "https"
+	TransportUDP   = "udp"
+	TransportQUIC  = "quic"
+	TransportRelay = "relay"
+	TransportStdio = "stdio"
+	TransportUnix  = "unix"
+	TransportPipe  = "pipe" // in-process only, never advertised
+
+	ChannelInput     = "input"
+	ChannelClipboard = "clipboard"
+	ChannelFiles     = "files"
+
+	AccessView    = "view"
+	AccessControl = "control"
+)
+
+var SupportedCodecs = []string{CodecRawBGRA}
+var SupportedTransports = []string{TransportTCP, TransportHTTPS, TransportUDP, TransportQUIC, TransportRelay, TransportStdio, TransportUnix}
+var SupportedChannels = []string{ChannelInput}
+
+// Hello is the first packet each side sends after the transport connects. A
+// peer that refuses the session replies with Refusal set and closes. The
+// viewer hands out a ResumeToken which the sharer echoes back when it
+// reconnects to pick up the same session, and sets Auth to AuthSRP if the
+// sharer must prove it knows the viewer's PIN or password before the session
+// starts. The viewer's Access says whether it asks to view the screen or to
+// control it too, for the sharer to put to the person at its machine.
+type Hello struct {
+	Version      int
+	Hostname     string
+	ScreenWidth  int
+	ScreenHeight int
+	Codecs       []string
+	Transports   []string
+	Channels     []string
+	Refusal      string
+	ResumeToken  string
+	Auth         string
+	Access       string
+}
+
+// Session is the feature set both peers agreed on during the handshake.
+type Session struct {
+	Version   int
+	Codec     string
+	Transport string
+	Channels  []string
+	Peer      Hello
+}
+
+var ErrIncompatible = errors.New("incompatible peer")
+var ErrRefused = errors.New("session refused")
+var ErrAuthFailed = errors.New("authentication failed")
+
+// NewHello advertises everything this build supports, with the transport in
+// use listed first so negotiation settles on it.
+func NewHello(transport string, width int, height int) Hello {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return Hello{
+		Version:      Version,
+		Hostname:     hostname,
+		ScreenWidth:  width,
+		ScreenHeight: height,
+		Codecs:       SupportedCodecs,
+		Transports:   preferred(SupportedTransports, transport),
+		Channels:     SupportedChannels,
+		Access:       AccessControl,
+	}
+}
+
+func (s Session) HasChannel(channel string) bool {
+	return contains(s.Channels, channel)
+}
+
+// Negotiate picks the features shared by local and remote. Codec preference
+// follows the order of local.Codecs.
+func Negotiate(local Hello, remote Hello) (Session, error) {
+	if remote.Refusal != "" {
+		return Session{}, fmt.Errorf("%w by %s: %s", ErrRefused, remote.Hostname, remote.Refusal)
+	}
+
+	if remote.Version != local.Version {
+		return Session{}, fmt.Errorf("%w: protocol version %d, want %d", ErrIncompatible, remote.Version, local.Version)
+	}
+
+	session := Session{Version: local.Version, Peer: remote}
+
+	for _, codec := range local.Codecs {
+		if contains(remote.Codecs, codec) {
+			session.Codec = codec
+			break
+		}
+	}
+
+	if session.Codec == "" {
+		return Session{}, fmt.Errorf("%w: no common codec in %v", ErrIncompatible, remote.Codecs)
+	}
+
+	for _, transport := range local.Transports {
+		if contains(remote.Transports, transport) {
+			session.Transport = transport
+			break
+		}
+	}
+
+	if session.Transport == "" {
+		return Session{}, fmt.Errorf("%w: no common transport in %v", ErrIncompatible, remote.Transports)
+	}
+
+	for _, channel := range local.Channels {
+		if contains(remote.Channels, channel) {
+			session.Channels = append(session.Channels, channel)
+		}
+	}
+
+	return session, nil
+}
+
+// Refuse builds the reply sent to a peer that failed negotiation.
+func Refuse(local Hello, err error) Hello {
+	local.Refusal = err.Error()
+	return local
+}
+
+func NewResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// DecodeHello unmarshals data and checks that it holds a Hello. Anything
+// else, or a hello of our own version that is cut short, is a ProtocolError.
+func DecodeHello(data []byte) (Hello, error) {
+	msg, err := Unmarshal(data)
+	if err != nil {
+		return Hello{}, &ProtocolError{Reason: err.Error()}
+	}
+
+	hello, ok := msg.(Hello)
+	if !ok {
+		return Hello{}, protocolErrorf("expected hello, got %s", msg.Type())
+	}
+
+	return hello, nil
+}
+
+// DecodeAuth unmarshals data and checks that it holds an Auth. A peer that
+// rejects our proof says goodbye instead, which is returned as the error.
+func DecodeAuth(data []byte) (Auth, error) {
+	msg, err := Decode(data)
+	if err != nil {
+		return Auth{}, err
+	}
+
+	switch m := msg.(type) {
+	case Auth:
+		return m, nil
+	case Goodbye:
+		return Auth{}, fmt.Errorf("%w: %s", ErrAuthFailed, m)
+	}
+	return Auth{}, fmt.Errorf("expected auth, got %s", msg.Type())
+}
+
+func preferred(list []string, first string) []string {
+	out := []string{first}
+	for _, v := range list {
+		if v != first {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHelloOtherVersions(t *testing.T) {
+	local := NewHello(TransportTCP, 1920, 1080)
+
+	// an older peer sends fewer fields, a newer one more
+	older := &encoder{}
+	older.u8(uint8(TypeHello))
+	older.u16(Version - 1)
+	older.string("old")
+	older.u32(800)
+
+	newer, err := Marshal(Hello{Version: Version + 1, Hostname: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer = append(newer, 0, 3, 'n', 'e', 'w')
+
+	for _, test := range []struct {
+		data     []byte
+		version  int
+		hostname string
+	}{
+		{older.buf, Version - 1, "old"},
+		{newer, Version + 1, "new"},
+	} {
+		hello, err := DecodeHello(test.data)
+		if err != nil {
+			t.Fatalf("version %d: %s", test.version, err)
+		}
+
+		if hello.Version != test.version || hello.Hostname != test.hostname {
+			t.Fatalf("got version %d from %q, want %d from %q", hello.Version, hello.Hostname, test.version, test.hostname)
+		}
+
+		if _, err := Negotiate(local, hello); !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("version %d: got %v, want ErrIncompatible", test.version, err)
+		}
+	}
+}
+
+func TestDecodeHelloTruncated(t *testing.T) {
+	data, err := Marshal(NewHello(TransportTCP, 1920, 1080))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// from a peer of our own version, a field cut short or missing
+	// altogether is an error
+	short := &encoder{}
+	short.u8(uint8(TypeHello))
+	short.u16(Version)
+	short.string("short")
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"a field cut short", data[:len(data)-1]},
+		{"missing fields", short.buf},
+		{"no version", data[:2]},
+	} {
+		var protoErr *ProtocolError
+		if _, err := DecodeHello(test.data); !errors.As(err, &protoErr) || !strings.Contains(err.Error(), ErrTruncated.Error()) {
+			t.Fatalf("%s: got %v, want a ProtocolError for a truncated message", test.name, err)
+		}
+	}
+}
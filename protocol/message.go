@@ -0,0 +1,451 @@
+package protocol
+
+import "fmt"
+
+type MessageType uint8
+
+const (
+	TypeHello MessageType = iota + 1
+	TypeFrame
+	TypePointer
+	TypeKey
+	TypeScroll
+	TypeControl
+	TypeError
+	TypeClock
+	TypeGoodbye
+	TypeChunk
+	TypeChannel
+	TypeAuth
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case TypeHello:
+		return "hello"
+	case TypeFrame:
+		return "frame"
+	case TypePointer:
+		return "pointer"
+	case TypeKey:
+		return "key"
+	case TypeScroll:
+		return "scroll"
+	case TypeControl:
+		return "control"
+	case TypeError:
+		return "error"
+	case TypeClock:
+		return "clock"
+	case TypeGoodbye:
+		return "goodbye"
+	case TypeChunk:
+		return "chunk"
+	case TypeChannel:
+		return "channel"
+	case TypeAuth:
+		return "auth"
+	}
+	return fmt.Sprintf("type(%d)", uint8(t))
+}
+
+// Message is implemented by every struct that can be sent on the wire.
+type Message interface {
+	Type() MessageType
+}
+
+// Frame is one captured screen in the session codec. For raw-bgra Pix holds
+// Width*Height*4 bytes in BGRA order. Seq counts frames from one sharer and
+// Timestamp is the capture time in Unix nanoseconds on the sharer's clock.
+type Frame struct {
+	Width     uint32
+	Height    uint32
+	Pix       []byte
+	Seq       uint32
+	Timestamp int64
+}
+
+// Check reports whether Pix holds exactly Width*Height*4 bytes, and whether
+// that is within MaxFrameSize. The sizes are multiplied in 64 bits, so
+// dimensions from a hostile peer can't overflow into a small allocation or a
+// panic.
+func (f Frame) Check() error {
+	pixels := uint64(f.Width) * uint64(f.Height)
+	if pixels > MaxFrameSize/4 {
+		return fmt.Errorf("%dx%d frame exceeds %d byte limit", f.Width, f.Height, MaxFrameSize)
+	}
+
+	if uint64(len(f.Pix)) != pixels*4 {
+		return fmt.Errorf("%d bytes for %dx%d frame", len(f.Pix), f.Width, f.Height)
+	}
+
+	return nil
+}
+
+type Button uint8
+
+const (
+	ButtonNone Button = iota
+	ButtonLeft
+	ButtonRight
+	ButtonMiddle
+)
+
+type PointerAction uint8
+
+const (
+	PointerMove PointerAction = iota
+	PointerDown
+	PointerUp
+)
+
+// Input events carry a Seq counting all input from one viewer and a
+// Timestamp in Unix nanoseconds on the viewer's clock, both set as the event
+// is sent.
+
+// Pointer positions are in the sharer's screen coordinates.
+type Pointer struct {
+	X         int32
+	Y         int32
+	Button    Button
+	Action    PointerAction
+	Seq       uint32
+	Timestamp int64
+}
+
+// Key carries a gohook keyboard event. Index increases by one per key event so
+// the sharer can detect gaps.
+type Key struct {
+	Kind      uint8
+	Index     uint32
+	Char      rune
+	Code      uint16
+	Seq       uint32
+	Timestamp int64
+}
+
+type Scroll struct {
+	DX        int32
+	DY        int32
+	Seq       uint32
+	Timestamp int64
+}
+
+type ControlCode uint8
+
+const (
+	// ControlRefresh asks the sharer to send a full frame.
+	ControlRefresh ControlCode = iota + 1
+	// ControlPing is answered with a ControlPong carrying the same Value.
+	ControlPing
+	ControlPong
+	// When a sharer broadcasts to several viewers only one of them, the
+	// holder of the input token, has its input replayed. Viewers ask for the
+	// token with ControlInputRequest and hand it back with
+	// ControlInputRelease; the sharer answers with ControlInputGranted or
+	// ControlInputRevoked.
+	ControlInputRequest
+	ControlInputRelease
+	ControlInputGranted
+	ControlInputRevoked
+	// ControlFrameAck is sent by the viewer for every frame it receives, with
+	// the frame's Seq as Value, so the sharer can measure the round trip and
+	// the bandwidth.
+	ControlFrameAck
+	// ControlInputAck is sent by the sharer once it has replayed an input
+	// event, with the event's Seq as Value.
+	ControlInputAck
+)
+
+type Control struct {
+	Code  ControlCode
+	Value uint64
+}
+
+type ErrorCode uint16
+
+const (
+	ErrorProtocol ErrorCode = iota + 1
+	ErrorUnsupported
+)
+
+// Clock asks the peer for the time on its clock, so timestamps from it can be
+// read against ours. The request carries Origin, our clock when sending, and
+// the reply echoes it along with Peer, the peer's clock when answering. Both
+// are Unix nanoseconds.
+type Clock struct {
+	Origin int64
+	Peer   int64
+}
+
+type GoodbyeCode uint16
+
+const (
+	GoodbyeUserEnded GoodbyeCode = iota + 1
+	GoodbyeAuthFailed
+	GoodbyeCaptureLost
+	GoodbyeIdleTimeout
+	GoodbyeDeclined
+)
+
+func (c GoodbyeCode) String() string {
+	switch c {
+	case GoodbyeUserEnded:
+		return "user ended sharing"
+	case GoodbyeAuthFailed:
+		return "auth failed"
+	case GoodbyeCaptureLost:
+		return "capture device lost"
+	case GoodbyeIdleTimeout:
+		return "idle timeout"
+	case GoodbyeDeclined:
+		return "declined by the sharer"
+	}
+	return fmt.Sprintf("goodbye(%d)", uint16(c))
+}
+
+// Goodbye is the last message a peer sends before hanging up on purpose, so
+// the other side knows not to wait for it to come back. Code is for programs
+// and Reason, which may be empty, for people.
+type Goodbye struct {
+	Code   GoodbyeCode
+	Reason string
+}
+
+// Chunk carries part of a message on a multiplexed channel. Last marks the
+// chunk that completes it.
+type Chunk struct {
+	Channel uint16
+	Last    bool
+	Data    []byte
+}
+
+type ChannelOp uint8
+
+const (
+	// ChannelOpen announces a new channel by Name, with its Priority as
+	// Value.
+	ChannelOpen ChannelOp = iota + 1
+	// ChannelClose says no more messages will be sent on the channel.
+	ChannelClose
+	// ChannelWindow lets the peer send Value more messages on the channel.
+	ChannelWindow
+)
+
+// Channel manages a multiplexed channel.
+type Channel struct {
+	Op      ChannelOp
+	Channel uint16
+	Value   uint32
+	Name    string
+}
+
+// Auth carries one step of the password exchange that follows the hello when
+// the viewer asks for one: the sharer's Public key, then the viewer's Salt
+// and Public key, then each side's Proof, sharer first.
+type Auth struct {
+	Salt   []byte
+	Public []byte
+	Proof  []byte
+}
+
+// Error tells the peer why its last message could not be handled.
+type Error struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (Hello) Type() MessageType   { return TypeHello }
+func (Frame) Type() MessageType   { return TypeFrame }
+func (Pointer) Type() MessageType { return TypePointer }
+func (Key) Type() MessageType     { return TypeKey }
+func (Scroll) Type() MessageType  { return TypeScroll }
+func (Control) Type() MessageType { return TypeControl }
+func (Error) Type() MessageType   { return TypeError }
+func (Clock) Type() MessageType   { return TypeClock }
+func (Goodbye) Type() MessageType { return TypeGoodbye }
+func (Chunk) Type() MessageType   { return TypeChunk }
+func (Channel) Type() MessageType { return TypeChannel }
+func (Auth) Type() MessageType    { return TypeAuth }
+
+func (e Error) Error() string {
+	return fmt.Sprintf("peer error %d: %s", e.Code, e.Reason)
+}
+
+func (g Goodbye) Error() string {
+	if g.Reason == "" {
+		return g.Code.String()
+	}
+	return g.Reason
+}
+
+// Marshal encodes msg as a type byte followed by its fields in big-endian
+// order.
+func Marshal(msg Message) ([]byte, error) {
+	e := &encoder{}
+	e.u8(uint8(msg.Type()))
+
+	switch m := msg.(type) {
+	case Hello:
+		e.u16(uint16(m.Version))
+		e.string(m.Hostname)
+		e.u32(uint32(m.ScreenWidth))
+		e.u32(uint32(m.ScreenHeight))
+		e.strings(m.Codecs)
+		e.strings(m.Transports)
+		e.strings(m.Channels)
+		e.string(m.Refusal)
+		e.string(m.ResumeToken)
+		e.string(m.Auth)
+		e.string(m.Access)
+	case Frame:
+		e.u32(m.Width)
+		e.u32(m.Height)
+		e.bytes(m.Pix)
+		e.u32(m.Seq)
+		e.i64(m.Timestamp)
+	case Pointer:
+		e.i32(m.X)
+		e.i32(m.Y)
+		e.u8(uint8(m.Button))
+		e.u8(uint8(m.Action))
+		e.u32(m.Seq)
+		e.i64(m.Timestamp)
+	case Key:
+		e.u8(m.Kind)
+		e.u32(m.Index)
+		e.i32(m.Char)
+		e.u16(m.Code)
+		e.u32(m.Seq)
+		e.i64(m.Timestamp)
+	case Scroll:
+		e.i32(m.DX)
+		e.i32(m.DY)
+		e.u32(m.Seq)
+		e.i64(m.Timestamp)
+	case Control:
+		e.u8(uint8(m.Code))
+		e.u64(m.Value)
+	case Error:
+		e.u16(uint16(m.Code))
+		e.string(m.Reason)
+	case Clock:
+		e.i64(m.Origin)
+		e.i64(m.Peer)
+	case Goodbye:
+		e.u16(uint16(m.Code))
+		e.string(m.Reason)
+	case Chunk:
+		e.u16(m.Channel)
+		if m.Last {
+			e.u8(1)
+		} else {
+			e.u8(0)
+		}
+		e.bytes(m.Data)
+	case Channel:
+		e.u8(uint8(m.Op))
+		e.u16(m.Channel)
+		e.u32(m.Value)
+		e.string(m.Name)
+	case Auth:
+		e.bytes(m.Salt)
+		e.bytes(m.Public)
+		e.bytes(m.Proof)
+	default:
+		return nil, fmt.Errorf("marshal: unknown message %T", msg)
+	}
+
+	return e.buf, nil
+}
+
+// unmarshalHello decodes a hello from a peer of any version, so one that
+// doesn't match ours can still be refused with a reason. Version comes first
+// and is all a hello needs; fields an older peer doesn't send are left empty,
+// and ones a newer peer appends are skipped. A field cut short is only an
+// error in a hello of our own version.
+func unmarshalHello(d *decoder) Hello {
+	h := Hello{Version: int(d.u16())}
+	if d.err != nil {
+		return h
+	}
+
+	fields := []func(){
+		func() { h.Hostname = d.string() },
+		func() { h.ScreenWidth = int(d.u32()) },
+		func() { h.ScreenHeight = int(d.u32()) },
+		func() { h.Codecs = d.strings() },
+		func() { h.Transports = d.strings() },
+		func() { h.Channels = d.strings() },
+		func() { h.Refusal = d.string() },
+		func() { h.ResumeToken = d.string() },
+		func() { h.Auth = d.string() },
+		func() { h.Access = d.string() },
+	}
+	// a peer of another version may send fewer fields, for Negotiate to
+	// refuse; one of ours has no excuse
+	same := h.Version == Version
+	for _, field := range fields {
+		if d.err != nil || (!same && len(d.buf) == 0) {
+			break
+		}
+		field()
+	}
+
+	if !same {
+		d.err = nil
+	}
+	d.buf = nil
+	return h
+}
+
+// Unmarshal decodes one message produced by Marshal. Byte slices in the
+// result alias data.
+func Unmarshal(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return nil, ErrTruncated
+	}
+
+	t := MessageType(data[0])
+	d := &decoder{buf: data[1:]}
+	var msg Message
+
+	switch t {
+	case TypeHello:
+		msg = unmarshalHello(d)
+	case TypeFrame:
+		frame := Frame{Width: d.u32(), Height: d.u32(), Pix: d.bytes(), Seq: d.u32(), Timestamp: d.i64()}
+		if d.err == nil {
+			d.err = frame.Check()
+		}
+		msg = frame
+	case TypePointer:
+		msg = Pointer{X: d.i32(), Y: d.i32(), Button: Button(d.u8()), Action: PointerAction(d.u8()), Seq: d.u32(), Timestamp: d.i64()}
+	case TypeKey:
+		msg = Key{Kind: d.u8(), Index: d.u32(), Char: d.i32(), Code: d.u16(), Seq: d.u32(), Timestamp: d.i64()}
+	case TypeScroll:
+		msg = Scroll{DX: d.i32(), DY: d.i32(), Seq: d.u32(), Timestamp: d.i64()}
+	case TypeControl:
+		msg = Control{Code: ControlCode(d.u8()), Value: d.u64()}
+	case TypeError:
+		msg = Error{Code: ErrorCode(d.u16()), Reason: d.string()}
+	case TypeClock:
+		msg = Clock{Origin: d.i64(), Peer: d.i64()}
+	case TypeGoodbye:
+		msg = Goodbye{Code: GoodbyeCode(d.u16()), Reason: d.string()}
+	case TypeChunk:
+		msg = Chunk{Channel: d.u16(), Last: d.u8() != 0, Data: d.bytes()}
+	case TypeChannel:
+		msg = Channel{Op: ChannelOp(d.u8()), Channel: d.u16(), Value: d.u32(), Name: d.string()}
+	case TypeAuth:
+		msg = Auth{Salt: d.bytes(), Public: d.bytes(), Proof: d.bytes()}
+	default:
+		return nil, fmt.Errorf("unmarshal: unknown message type %d", uint8(t))
+	}
+
+	if err := d.finish(t); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// AuthSRP is SRP-6a (RFC 5054) in its 2048-bit group with SHA-256. Both sides
+// prove they know the PIN without revealing it: someone listening in learns
+// nothing to test guesses against offline, and someone pretending to be
+// either side gets one guess per connection. The proofs also cover the
+// connection's channel binding, so someone relaying the exchange between two
+// connections of their own can't pass it on.
+const AuthSRP = "srp6a-2048-sha256"
+
+// NewPIN returns a random six digit PIN for the viewer to read out.
+func NewPIN() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1e6))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%06d", n)
+}
+
+// srpIdentity stands in for the user name, as the PIN is all there is.
+const srpIdentity = "ghostviewer"
+
+var (
+	srpN, _ = new(big.Int).SetString(strings.Join(strings.Fields(`
+		AC6BDB41 324A9A9B F166DE5E 1389582F AF72B665 1987EE07 FC319294 3DB56050
+		A37329CB B4A099ED 8193E075 7767A13D D52312AB 4B03310D CD7F48A9 DA04FD50
+		E8083969 EDB767B0 CF609517 9A163AB3 661A05FB D5FAAAE8 2918A996 2F0B93B8
+		55F97993 EC975EEA A80D740A DBF4FF74 7359D041 D5C33EA7 1D281E44 6B14773B
+		CA97B43A 23FB8016 76BD207A 436C6481 F1D2B907 8717461A 5B9D32E6 88F87748
+		544523B5 24B0D57D 5EA77A27 75D2ECFA 032CFBDB F52FB378 61602790 04E57AE6
+		AF874E73 03CE5329 9CCC041C 7BC308D8 2A5698F3 A8D0C382 71AE35F8 E9DBFBB6
+		94B5C803 D89F7AE4 35DE236D 525F5475 9B65E372 FCD68EF2 0FA7111F 9E4AFF73`), ""), 16)
+	srpG   = big.NewInt(2)
+	srpLen = (srpN.BitLen() + 7) / 8
+	srpK   = new(big.Int).SetBytes(srpHash(srpPad(srpN), srpPad(srpG)))
+)
+
+func srpHash(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func srpPad(x *big.Int) []byte {
+	return x.FillBytes(make([]byte, srpLen))
+}
+
+func srpX(salt []byte, password string) *big.Int {
+	return new(big.Int).SetBytes(srpHash(salt, srpHash([]byte(srpIdentity+":"+password))))
+}
+
+// srpPublic checks a public key from the peer, which mustn't be 0 mod N or
+// the shared secret would be known to anyone.
+func srpPublic(data []byte) (*big.Int, error) {
+	v := new(big.Int).SetBytes(data)
+	if len(data) > srpLen || v.Sign() == 0 || new(big.Int).Mod(v, srpN).Sign() == 0 {
+		return nil, fmt.Errorf("%w: bad public key", ErrAuthFailed)
+	}
+	return v, nil
+}
+
+// srpSecret returns a random exponent.
+func srpSecret() (*big.Int, error) {
+	x, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 256))
+	if err != nil {
+		return nil, err
+	}
+	return x.Add(x, big.NewInt(1)), nil
+}
+
+// srpProofs derives the proofs each side sends from the shared secret and the
+// connection's binding.
+func srpProofs(a []byte, b []byte, secret *big.Int, binding []byte) ([]byte, []byte) {
+	key := srpHash(srpPad(secret), srpHash(binding))
+	m1 := srpHash(a, b, key)
+	return m1, srpHash(a, m1, key)
+}
+
+// SRPClient is the sharer's side of the exchange.
+type SRPClient struct {
+	password string
+	binding  []byte
+	a        *big.Int
+	public   []byte
+	m2       []byte
+}
+
+// NewSRPClient starts the exchange on a connection whose channel binding is
+// binding.
+func NewSRPClient(password string, binding []byte) (*SRPClient, error) {
+	a, err := srpSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SRPClient{password: password, binding: binding, a: a, public: srpPad(new(big.Int).Exp(srpG, a, srpN))}, nil
+}
+
+// Public is the key sent to the viewer first.
+func (c *SRPClient) Public() []byte {
+	return c.public
+}
+
+// Proof answers the viewer's salt and public key with our proof of the PIN.
+func (c *SRPClient) Proof(salt []byte, public []byte) ([]byte, error) {
+	b, err := srpPublic(public)
+	if err != nil {
+		return nil, err
+	}
+
+	u := new(big.Int).SetBytes(srpHash(c.public, srpPad(b)))
+	if u.Sign() == 0 {
+		return nil, fmt.Errorf("%w: bad public key", ErrAuthFailed)
+	}
+
+	// S = (B - k * g^x) ^ (a + u * x) mod N
+	x := srpX(salt, c.password)
+	base := new(big.Int).Exp(srpG, x, srpN)
+	base.Mul(base, srpK)
+	base.Sub(b, base)
+	base.Mod(base, srpN)
+	exp := new(big.Int).Mul(u, x)
+	exp.Add(exp, c.a)
+
+	m1, m2 := srpProofs(c.public, srpPad(b), new(big.Int).Exp(base, exp, srpN), c.binding)
+	c.m2 = m2
+	return m1, nil
+}
+
+// Verify checks the viewer's proof that it knows the PIN too.
+func (c *SRPClient) Verify(proof []byte) bool {
+	return c.m2 != nil && subtle.ConstantTimeCompare(proof, c.m2) == 1
+}
+
+// SRPServer is the viewer's side of the exchange, started once the sharer's
+// public key arrives.
+type SRPServer struct {
+	salt   []byte
+	public []byte
+	m1     []byte
+	m2     []byte
+}
+
+// NewSRPServer answers clientPublic on a connection whose channel binding is
+// binding.
+func NewSRPServer(password string, binding []byte, clientPublic []byte) (*SRPServer, error) {
+	a, err := srpPublic(clientPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	b, err := srpSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	// B = k * v + g^b mod N
+	v := new(big.Int).Exp(srpG, srpX(salt, password), srpN)
+	public := new(big.Int).Mul(srpK, v)
+	public.Add(public, new(big.Int).Exp(srpG, b, srpN))
+	public.Mod(public, srpN)
+
+	u := new(big.Int).SetBytes(srpHash(srpPad(a), srpPad(public)))
+	if u.Sign() == 0 {
+		return nil, fmt.Errorf("%w: bad public key", ErrAuthFailed)
+	}
+
+	// S = (A * v^u) ^ b mod N
+	secret := new(big.Int).Exp(v, u, srpN)
+	secret.Mul(secret, a)
+	secret.Exp(secret, b, srpN)
+
+	s := &SRPServer{salt: salt, public: srpPad(public)}
+	s.m1, s.m2 = srpProofs(srpPad(a), s.public, secret, binding)
+	return s, nil
+}
+
+// Salt and Public are sent back to the sharer.
+func (s *SRPServer) Salt() []byte   { return s.salt }
+func (s *SRPServer) Public() []byte { return s.public }
+
+// Verify checks the sharer's proof, and returns ours if it is right.
+func (s *SRPServer) Verify(proof []byte) ([]byte, bool) {
+	if subtle.ConstantTimeCompare(proof, s.m1) != 1 {
+		return nil, false
+	}
+	return s.m2, true
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestSRPGroup(t *testing.T) {
+	q := new(big.Int).Rsh(srpN, 1)
+	if srpN.BitLen() != 2048 || !srpN.ProbablyPrime(20) || !q.ProbablyPrime(20) {
+		t.Fatal("N is not a 2048-bit safe prime")
+	}
+}
+
+var binding = []byte("connection")
+
+// exchange runs the sharer's side with sharerPIN against the viewer's with
+// viewerPIN, each on a connection with the binding given, returning whether
+// each side accepted the other.
+func exchange(t *testing.T, sharerPIN string, sharerBinding []byte, viewerPIN string, viewerBinding []byte) (bool, bool) {
+	client, err := NewSRPClient(sharerPIN, sharerBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewSRPServer(viewerPIN, viewerBinding, client.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := client.Proof(server.Salt(), server.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverProof, ok := server.Verify(proof)
+	if !ok {
+		// a viewer that rejects the PIN says so with a goodbye, not a
+		// proof
+		return false, false
+	}
+	return true, client.Verify(serverProof)
+}
+
+func TestSRP(t *testing.T) {
+	if viewer, sharer := exchange(t, "482913", binding, "482913", binding); !viewer || !sharer {
+		t.Fatalf("right PIN: viewer accepted %v, sharer accepted %v", viewer, sharer)
+	}
+	if viewer, _ := exchange(t, "482914", binding, "482913", binding); viewer {
+		t.Fatal("viewer accepted the wrong PIN")
+	}
+
+	// a viewer that doesn't know the PIN can't fake its proof either
+	client, err := NewSRPClient("482913", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewSRPServer("000000", binding, client.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Proof(server.Salt(), server.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if client.Verify(server.m2) || client.Verify(nil) {
+		t.Fatal("sharer accepted a viewer with the wrong PIN")
+	}
+}
+
+func TestSRPBinding(t *testing.T) {
+	// someone relaying between two connections of their own gets a proof
+	// made for the wrong one, even with the right PIN on both sides
+	if viewer, _ := exchange(t, "482913", []byte("sharer's connection"), "482913", []byte("viewer's connection")); viewer {
+		t.Fatal("viewer accepted a proof made on another connection")
+	}
+}
+
+func TestSRPZeroKey(t *testing.T) {
+	// a public key of 0 mod N makes the shared secret 0 whatever the PIN
+	for _, public := range [][]byte{{0}, srpPad(srpN)} {
+		if _, err := NewSRPServer("482913", binding, public); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("accepted a %d byte public key that is 0 mod N", len(public))
+		}
+	}
+
+	client, err := NewSRPClient("482913", binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Proof(make([]byte, 16), bytes.Repeat([]byte{0}, srpLen)); !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("sharer accepted a zero public key")
+	}
+}
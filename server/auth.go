@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"ghostviewer/protocol"
+	"sync"
+)
+
+// maxAuthFailures is how many wrong PINs a viewer takes before it stops
+// asking. A six digit PIN then gives a guesser one chance in a hundred
+// thousand.
+const maxAuthFailures = 10
+
+// authGuard holds the password sharers must prove they know, and counts the
+// wrong guesses across every session that shares it.
+type authGuard struct {
+	password string
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (g *authGuard) exhausted() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.failures >= maxAuthFailures
+}
+
+func (g *authGuard) failed() {
+	g.mu.Lock()
+	g.failures++
+	g.mu.Unlock()
+}
+
+// verify runs the viewer's side of the SRP exchange over read and write, on a
+// connection with the given channel binding. A sharer with the wrong PIN is
+// told so with a goodbye, as is one on a link without a binding, where the PIN
+// would prove nothing.
+func (g *authGuard) verify(binding []byte, read func() ([]byte, error), write func([]byte) error) error {
+	send := func(msg protocol.Message) error {
+		data, err := protocol.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return write(data)
+	}
+	receive := func() (protocol.Auth, error) {
+		data, err := read()
+		if err != nil {
+			return protocol.Auth{}, fmt.Errorf("auth: %w", err)
+		}
+		return protocol.DecodeAuth(data)
+	}
+
+	if binding == nil {
+		send(protocol.Goodbye{Code: protocol.GoodbyeAuthFailed, Reason: "the viewer only takes a PIN over an encrypted link"})
+		return fmt.Errorf("%w: PIN asked for over an unencrypted link", protocol.ErrAuthFailed)
+	}
+
+	hello, err := receive()
+	if err != nil {
+		return err
+	}
+
+	srp, err := protocol.NewSRPServer(g.password, binding, hello.Public)
+	if err != nil {
+		g.failed()
+		return err
+	}
+
+	if err := send(protocol.Auth{Salt: srp.Salt(), Public: srp.Public()}); err != nil {
+		return err
+	}
+
+	answer, err := receive()
+	if err != nil {
+		return err
+	}
+
+	proof, ok := srp.Verify(answer.Proof)
+	if !ok {
+		g.failed()
+		send(protocol.Goodbye{Code: protocol.GoodbyeAuthFailed, Reason: "wrong PIN"})
+		return fmt.Errorf("%w: wrong PIN", protocol.ErrAuthFailed)
+	}
+
+	return send(protocol.Auth{Proof: proof})
+}
+
+// pendingSession is a session negotiated with a sharer that hasn't proved it
+// knows the password yet.
+type pendingSession struct {
+	session protocol.Session
+	token   string
+}
+
+// authenticate checks the password of the sharer answerHello just accepted,
+// if there is one, and only then makes its session the current one. Until it
+// does, the sharer holds nothing a rightful one would be refused for. binding
+// is the connection's, from transport.ChannelBinding.
+func (s *sessionState) authenticate(binding []byte, read func() ([]byte, error), write func([]byte) error) error {
+	s.mu.Lock()
+	auth, pending := s.auth, s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if pending == nil {
+		return nil
+	}
+
+	if err := auth.verify(binding, read, write); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.token = pending.token
+	s.session = pending.session
+	s.viewOnly = false
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"ghostviewer/transport"
+	"os"
+	"path/filepath"
+)
+
+// LoadTLSConfig serves the server certificate in transport.CertDir, creating one on
+// first use, and picks up a renewed one without a restart. With verifyClients
+// sharers must present a certificate from the same CA.
+func LoadTLSConfig(verifyClients bool) (*tls.Config, error) {
+	dir := transport.CertDir()
+	certFile, keyFile := filepath.Join(dir, transport.ServerCertFile), filepath.Join(dir, transport.ServerKeyFile)
+
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Creating certificates in %s\n", dir)
+		if err := transport.GenerateCertificates(dir, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	reloader, err := transport.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert, err := reloader.Certificate(); err == nil {
+		printFingerprint(*cert)
+	}
+
+	conf := &tls.Config{GetCertificate: reloader.GetCertificate}
+	if verifyClients {
+		data, err := os.ReadFile(filepath.Join(dir, transport.CAFile))
+		if err != nil {
+			return nil, err
+		}
+
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates", filepath.Join(dir, transport.CAFile))
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// printFingerprint shows the fingerprint sharers are told to trust on first
+// connect, so it can be checked against theirs.
+func printFingerprint(cert tls.Certificate) {
+	if fingerprint, err := transport.CertificateFingerprint(cert); err == nil {
+		fmt.Printf("Certificate fingerprint: %s\n", fingerprint)
+	}
+}
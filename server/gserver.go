@@ -1,52 +1,207 @@
 package server
 
 import (
-	"ghostviewer/ui"
+	"errors"
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
 	"image"
-	"strconv"
-	"strings"
+	"os"
+	"time"
 )
 
 type GServer interface {
-	Receive(chan ui.Message)
+	Receive(frames chan<- protocol.Frame, input <-chan protocol.Message)
 	Listen() error
 	Close()
+	Disconnect(protocol.Goodbye)
 	IsConnected() bool
+	HasControl() bool
+	Session() protocol.Session
+	Stats() Stats
+	Events() <-chan transport.StateEvent
 }
 
-func ServerViewer(ghostserver GServer, grenderer *ui.GRenderer) {
-	var uiMsgStack []ui.Message
-	messages := make(chan ui.Message)
-	go ghostserver.Receive(messages)
+// Renderer shows the sharer's screen and produces the viewer's input.
+type Renderer interface {
+	UpdateFrame(frame *image.RGBA)
+	SetStatus(status string)
+	Input() <-chan protocol.Message
+}
+
+// requestInterval limits how often a view only viewer asks for the input
+// token while the user keeps clicking or typing.
+const requestInterval = time.Second
+
+// ResumeTimeout is how long the viewer keeps a dropped session open for the
+// sharer to reconnect before giving up.
+var ResumeTimeout = 2 * time.Minute
+
+var errNoReconnect = errors.New("client did not reconnect")
+
+// ServerViewer shows ghostserver's sharer on grenderer until it is gone for
+// good, then leaves the reason on screen.
+func ServerViewer(ghostserver GServer, grenderer Renderer) {
+	var bye protocol.Goodbye
+	err := watch(ghostserver, grenderer)
+	if errors.As(err, &bye) {
+		fmt.Printf("Client ended the session: %s\n", bye)
+	} else if err == errNoReconnect {
+		fmt.Println("Client did not reconnect")
+	} else {
+		fmt.Fprintf(os.Stderr, "Listen error: %s\n", err)
+	}
+	grenderer.SetStatus(endStatus(err))
+}
+
+// endStatus is what's left on screen once watch returns err.
+func endStatus(err error) string {
+	var bye protocol.Goodbye
+	if errors.As(err, &bye) {
+		return "Session ended: " + bye.Error()
+	} else if err == errNoReconnect {
+		return "Client did not reconnect"
+	}
+	return "Listen error: " + err.Error()
+}
+
+// goodbyeReceiver is implemented by the GServers in this package to tell a
+// session the client ended from one that dropped.
+type goodbyeReceiver interface {
+	goodbye() (protocol.Goodbye, bool)
+}
+
+// watch shows ghostserver's sharer on grenderer across reconnects. It returns
+// the client's goodbye if it ends the session, errNoReconnect once it has
+// been gone for ResumeTimeout, or the error from Listen.
+func watch(ghostserver GServer, grenderer Renderer) error {
+	events := ghostserver.Events()
+	done := make(chan struct{})
+	defer close(done)
+
+	// UI events are dropped while no sharer is connected rather than being
+	// replayed into the next session
+	input := make(chan protocol.Message, 256)
 	go func() {
+		var lastRequest time.Time
+		viewOnly := false
 		for {
-			uiMsgStack = append(uiMsgStack, <-grenderer.Messages)
+			var msg protocol.Message
+			select {
+			case <-done:
+				return
+			case msg = <-grenderer.Input():
+			}
+
+			if !ghostserver.IsConnected() {
+				continue
+			}
+
+			// another viewer of a broadcast has control, so a click or key
+			// press asks for it instead of being sent
+			if !ghostserver.HasControl() {
+				if !viewOnly {
+					viewOnly = true
+					grenderer.SetStatus("View only, click or type to ask for control")
+				}
+				if !wantsControl(msg) || time.Since(lastRequest) < requestInterval {
+					continue
+				}
+				lastRequest = time.Now()
+				msg = protocol.Control{Code: protocol.ControlInputRequest}
+			} else if viewOnly {
+				viewOnly = false
+				grenderer.SetStatus("")
+			}
+
+			select {
+			case input <- msg:
+			default:
+				fmt.Fprintln(os.Stderr, "Input queue full, dropping UI event")
+			}
 		}
 	}()
 
 	for {
-		msg := <-messages
-		messages <- ui.Message{"UI:" + strconv.Itoa(len(uiMsgStack)), nil}
-		for _, uiMsg := range uiMsgStack {
-			messages <- uiMsg
+		frames := make(chan protocol.Frame, 1)
+		go ghostserver.Receive(frames, input)
+		viewSession(grenderer, frames, func(frame protocol.Frame) {
+			if d, ok := ghostserver.(frameDisplayer); ok {
+				d.frameDisplayed(frame)
+			}
+		})
+
+		if g, ok := ghostserver.(goodbyeReceiver); ok {
+			if bye, ok := g.goodbye(); ok {
+				return bye
+			}
 		}
-		uiMsgStack = []ui.Message{}
 
-		cmdlist := strings.Split(msg.Cmd, ":")
-		cmd := cmdlist[0]
-		args := cmdlist[1:]
+		// forget the events and input from the session that just ended
+		for len(events) > 0 {
+			<-events
+		}
+		for len(input) > 0 {
+			<-input
+		}
 
-		if cmd == "FRAME" {
-			w, _ := strconv.Atoi(args[0])
-			h, _ := strconv.Atoi(args[1])
-			imageBytes := make([]byte, len(msg.Data))
+		fmt.Printf("Client disconnected, waiting %s for it to reconnect\n", ResumeTimeout)
+		grenderer.SetStatus("Connection lost, reconnecting...")
+		listenErr := make(chan error, 1)
+		go func() {
+			if err := ghostserver.Listen(); err != nil {
+				listenErr <- err
+			}
+		}()
 
-			for i := 0; i < len(imageBytes); i += 4 {
-				imageBytes[i], imageBytes[i+2], imageBytes[i+1], imageBytes[i+3] = msg.Data[i+2], msg.Data[i], msg.Data[i+1], msg.Data[i+3]
+		timeout := time.After(ResumeTimeout)
+		for reconnected := false; !reconnected; {
+			select {
+			case event := <-events:
+				reconnected = event.State == transport.StateConnected
+			case err := <-listenErr:
+				return err
+			case <-timeout:
+				return errNoReconnect
 			}
+		}
+		grenderer.SetStatus("")
+	}
+}
+
+func wantsControl(msg protocol.Message) bool {
+	switch m := msg.(type) {
+	case protocol.Pointer:
+		return m.Action == protocol.PointerDown
+	case protocol.Key:
+		return true
+	}
+	return false
+}
+
+// frameDisplayer is implemented by the GServers in this package to time
+// frames from capture to screen.
+type frameDisplayer interface {
+	frameDisplayed(frame protocol.Frame)
+}
+
+// viewSession shows frames from one connection until the transport closes
+// frames, calling displayed after each one is handed to grenderer.
+func viewSession(grenderer Renderer, frames <-chan protocol.Frame, displayed func(protocol.Frame)) {
+	for m := range frames {
+		if err := m.Check(); err != nil {
+			fmt.Fprintf(os.Stderr, "Bad frame: %s\n", err)
+			continue
+		}
+
+		w, h := int(m.Width), int(m.Height)
 
-			grenderer.UpdateFrame(&image.RGBA{Pix: imageBytes, Stride: w * 4, Rect: image.Rect(0, 0, w, h)})
+		imageBytes := make([]byte, w*h*4)
+		for i := 0; i < len(imageBytes); i += 4 {
+			imageBytes[i], imageBytes[i+2], imageBytes[i+1], imageBytes[i+3] = m.Pix[i+2], m.Pix[i], m.Pix[i+1], m.Pix[i+3]
 		}
 
+		grenderer.UpdateFrame(&image.RGBA{Pix: imageBytes, Stride: w * 4, Rect: image.Rect(0, 0, w, h)})
+		displayed(m)
 	}
 }
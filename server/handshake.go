@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"ghostviewer/protocol"
+)
+
+// answerHello negotiates against the client's hello and returns the reply to
+// send back, which carries a refusal if the hello can't be read, the two sides
+// are incompatible or the client is not the one that owns the current session.
+// If a password is set, the session only starts once authenticate has checked
+// it.
+func (s *sessionState) answerHello(local protocol.Hello, data []byte) (protocol.Session, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var session protocol.Session
+	remote, err := protocol.DecodeHello(data)
+	if err != nil {
+		err = fmt.Errorf("handshake: %w", err)
+	} else {
+		session, err = protocol.Negotiate(local, remote)
+	}
+	if err == nil && s.token != "" && remote.ResumeToken != s.token {
+		err = fmt.Errorf("%w: a session with %s is already active", protocol.ErrRefused, s.session.Peer.Hostname)
+	}
+	if err == nil && s.auth != nil && s.auth.exhausted() {
+		err = fmt.Errorf("%w: too many wrong PINs, restart the viewer for a new one", protocol.ErrRefused)
+	}
+
+	reply := local
+	if err != nil {
+		reply = protocol.Refuse(local, err)
+	} else {
+		token := s.token
+		if token == "" {
+			token = protocol.NewResumeToken()
+		}
+		reply.ResumeToken = token
+
+		if s.auth != nil {
+			reply.Auth = protocol.AuthSRP
+			s.pending = &pendingSession{session: session, token: token}
+		} else {
+			s.token = token
+			s.session = session
+			s.viewOnly = false
+		}
+	}
+
+	replyData, encErr := protocol.Marshal(reply)
+	if encErr != nil {
+		return protocol.Session{}, nil, encErr
+	}
+
+	return session, replyData, err
+}
+
+// handshake reads the client's hello from r, answers it on w and checks the
+// client's password if one is set, bound to the connection by binding.
+func (s *sessionState) handshake(r *protocol.PacketReader, w *protocol.PacketWriter, local protocol.Hello, binding []byte) (protocol.Session, error) {
+	data, err := r.ReadPacket()
+	if err != nil {
+		return protocol.Session{}, fmt.Errorf("handshake: %w", err)
+	}
+
+	session, reply, err := s.answerHello(local, data)
+	if reply != nil {
+		if writeErr := w.WritePacket(reply); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	if err == nil {
+		err = s.authenticate(binding, r.ReadPacket, w.WritePacket)
+	}
+
+	return session, err
+}
@@ -3,20 +3,46 @@ package server
 import (
 	"crypto/tls"
 	"fmt"
-	"ghostviewer/ui"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
-	"golang.org/x/crypto/acme/autocert"
 )
 
 type HTTPSGServer struct {
+	sessionState
 	Ip        string
 	Port      int
-	Connected bool
+	Path      string // where the websocket is served, /ws if empty
+	Conn      *websocket.Conn
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+	// Plain serves ws:// instead of wss://, for running behind a reverse
+	// proxy that terminates TLS. The proxy's X-Forwarded-For then gives the
+	// client's address in the logs.
+	Plain bool
+	// Origins lists the Origin headers allowed to open the websocket, or "*"
+	// for any. Otherwise only clients sending no Origin, like our own, or one
+	// matching the Host header are allowed.
+	Origins   []string
+	TLSConfig *tls.Config // defaults to LoadTLSConfig, unused if Plain
+
+	server     *http.Server
+	accepted   chan struct{}
+	connMutex  sync.Mutex
+	writeMutex sync.Mutex // websocket.Conn allows only one concurrent writer
+	// handshakeMutex lets one client at a time through answerHello and
+	// authenticate, which keep the session they negotiate until it is
+	// authenticated. Each holds it for at most helloTimeout.
+	handshakeMutex sync.Mutex
 }
 
 var upgrader = websocket.Upgrader{
@@ -24,87 +50,222 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 8192,
 }
 
-func (h *HTTPSGServer) IsConnected() bool {
-	return h.Connected
-}
-
-func ProcessInput(conn *websocket.Conn) {
-	for {
-		messageType, p, err := conn.ReadMessage()
+func (h *HTTPSGServer) Endpoint(w http.ResponseWriter, r *http.Request) {
+	addr := h.remoteAddr(r)
+	upgrader := upgrader
+	upgrader.CheckOrigin = h.checkOrigin
+	ws, err := upgrader.Upgrade(w, r, nil)
 
-		if err != nil {
-			fmt.Fprintf(os.Stdout, "Websocket read error: %s", err)
-			return
-		}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to upgrade client %s to websocket: %s\n", addr, err)
+		return
+	}
 
-		fmt.Println("Got message!")
+	// a client that never finishes the handshake is dropped, rather than
+	// holding up the next one for good
+	ws.SetReadLimit(protocol.MaxPacketSize)
+	ws.SetReadDeadline(time.Now().Add(helloTimeout))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Handshake read error: %s\n", err)
+		ws.Close()
+		return
+	}
 
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			fmt.Fprintf(os.Stdout, "Websocket write error: %s", err)
-			return
-		}
+	h.handshakeMutex.Lock()
+	defer h.handshakeMutex.Unlock()
 
+	if h.connected() {
+		fmt.Fprintf(os.Stderr, "Refused client %s: a session is already active\n", addr)
+		ws.Close()
+		return
 	}
-}
 
-func (h *HTTPSGServer) Endpoint(w http.ResponseWriter, r *http.Request) {
-	h.Connected = true
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true } // remove CORS error
-	ws, err := upgrader.Upgrade(w, r, nil)
+	session, reply, err := h.answerHello(h.Hello, data)
+	if reply != nil {
+		ws.WriteMessage(websocket.BinaryMessage, reply)
+	}
+	if err == nil {
+		err = h.authenticate(transport.ChannelBinding(ws), func() ([]byte, error) {
+			_, data, err := ws.ReadMessage()
+			return data, err
+		}, func(data []byte) error {
+			return ws.WriteMessage(websocket.BinaryMessage, data)
+		})
+	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "Failed to upgrade client to websocket: %s", err)
+		fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", addr, err)
+		ws.Close()
+		return
 	}
+	ws.SetReadDeadline(time.Time{})
 
-	fmt.Println("Client connected")
+	fmt.Printf("Websocket client %s accepted\n", addr)
+	logConnected(session, h.resumed())
+	h.connMutex.Lock()
+	h.Conn = ws
+	accepted := h.accepted
+	h.connMutex.Unlock()
+	h.linkUp(h.Heartbeat, h.sender(ws), h.Close)
+	close(accepted)
+}
 
-	ProcessInput(ws)
+// connected reports whether Endpoint has accepted a client since Listen was
+// last called.
+func (h *HTTPSGServer) connected() bool {
+	h.connMutex.Lock()
+	defer h.connMutex.Unlock()
+	return h.Conn != nil
 }
 
+// Listen starts the server on the first call. Later calls, made after the
+// client dropped, just re-arm Endpoint to accept the client again.
 func (h *HTTPSGServer) Listen() error {
-	fmt.Println("Waiting for HTTPS client to connect...")
+	if h.Plain {
+		fmt.Println("Waiting for websocket client to connect...")
+	} else {
+		fmt.Println("Waiting for HTTPS client to connect...")
+	}
+	h.connMutex.Lock()
+	h.accepted = make(chan struct{})
+	h.Conn = nil
+	h.connMutex.Unlock()
+
+	if h.server != nil {
+		return nil
+	}
+
+	path := h.Path
+	if path == "" {
+		path = "/ws"
+	}
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 		h.Endpoint(w, r)
 	})
 
-	certManager := autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		Cache:  autocert.DirCache("certs"),
+	l, err := net.Listen("tcp", net.JoinHostPort(h.Ip, strconv.Itoa(h.Port)))
+	if err != nil {
+		return err
 	}
 
-	certManager.TLSConfig().ServerName = "ghostclient"
+	if h.Plain {
+		h.server = &http.Server{Handler: mux}
+		go func() {
+			if err := h.server.Serve(l); err != http.ErrServerClosed {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}()
+		return nil
+	}
 
-	server := &http.Server{
-		Addr:    h.Ip + ":" + strconv.Itoa(h.Port),
-		Handler: mux,
-		TLSConfig: &tls.Config{
-			GetCertificate: certManager.GetCertificate,
-		},
+	conf := h.TLSConfig
+	if conf == nil {
+		if conf, err = LoadTLSConfig(false); err != nil {
+			l.Close()
+			fmt.Fprintf(os.Stderr, "Certificate error: %s\n", err)
+			return err
+		}
 	}
 
-	go func() {
-		if ex, err := os.Executable(); err == nil {
-			exPath := filepath.Dir(ex)
+	h.server = &http.Server{Handler: mux, TLSConfig: conf}
 
-			if err := server.ListenAndServeTLS(exPath+"/certs/localhost.crt", exPath+"/certs/localhost.key"); err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		} else {
+	go func() {
+		if err := h.server.ServeTLS(l, "", ""); err != http.ErrServerClosed {
 			fmt.Println(err)
+			os.Exit(1)
 		}
 	}()
 
 	return nil
 }
 
+// remoteAddr is the client's address for the logs. Behind a proxy that is the
+// last address in X-Forwarded-For, the one the proxy added itself, as the
+// client can send any earlier ones it likes.
+func (h *HTTPSGServer) remoteAddr(r *http.Request) string {
+	if !h.Plain {
+		return r.RemoteAddr
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		return r.RemoteAddr
+	}
+
+	hops := strings.Split(forwarded[len(forwarded)-1], ",")
+	if addr := strings.TrimSpace(hops[len(hops)-1]); addr != "" {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+func (h *HTTPSGServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(h.Origins) == 0 {
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+	}
+
+	for _, allowed := range h.Origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Refused client %s: origin %s not allowed\n", h.remoteAddr(r), origin)
+	return false
+}
+
 func (h *HTTPSGServer) Close() {
-	h.Connected = false
+	h.link.SetState(transport.StateDisconnected, nil)
+
+	h.connMutex.Lock()
+	defer h.connMutex.Unlock()
+
+	if h.Conn != nil {
+		h.Conn.Close()
+	}
 }
 
-func (h *HTTPSGServer) Receive(output chan ui.Message) {
+// sender writes to conn, one session's websocket, so nothing meant for it
+// goes to a client accepted after it.
+func (h *HTTPSGServer) sender(conn *websocket.Conn) func(protocol.Message) error {
+	return func(msg protocol.Message) error {
+		data, err := protocol.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		h.writeMutex.Lock()
+		defer h.writeMutex.Unlock()
+		return conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+}
+
+// Receive waits for the websocket client accepted by Endpoint, then serves it
+// until it disconnects.
+func (h *HTTPSGServer) Receive(frames chan<- protocol.Frame, input <-chan protocol.Message) {
+	h.connMutex.Lock()
+	accepted := h.accepted
+	h.connMutex.Unlock()
+
+	<-accepted
+	h.connMutex.Lock()
+	conn := h.Conn
+	h.connMutex.Unlock()
 
+	h.serve(func() ([]byte, error) {
+		_, data, err := conn.ReadMessage()
+		return data, err
+	}, h.sender(conn), conn.Close, frames, input)
 }
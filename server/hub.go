@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	helloTimeout   = 10 * time.Second
+	handoffTimeout = 10 * time.Second
+)
+
+// Hub accepts any number of sharers on one listener and gives each its own
+// session, so one long-running viewer can serve a whole helpdesk. A sharer
+// that drops and comes back with its resume token within ResumeTimeout gets
+// its old session back.
+type Hub struct {
+	Listener  net.Listener
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+	TLSConfig *tls.Config // wraps each connection in TLS 1.3 when set
+	Password  string      // every sharer must prove it knows this when set
+
+	// NewRenderer is called for every new sharer, and OnClosed once its
+	// session has ended for good and the reason is on its renderer.
+	NewRenderer func(id int, hostname string) Renderer
+	OnClosed    func(id int)
+
+	mu       sync.Mutex
+	nextID   int
+	sessions map[int]*hubSession
+	tokens   map[string]*hubSession
+	auth     *authGuard
+}
+
+// SessionInfo describes one sharer known to a Hub.
+type SessionInfo struct {
+	ID        int
+	Hostname  string
+	Connected bool
+	Stats     Stats
+}
+
+type hubSession struct {
+	id       int
+	hostname string
+	server   *hubGServer
+}
+
+// hubGServer is the GServer behind one hub session. It doesn't listen itself
+// but takes the connections the hub routes to it.
+type hubGServer struct {
+	TCPGServer
+	conns chan hubConn
+	done  chan struct{}
+}
+
+// hubConn is a connection whose hello the hub has already read.
+type hubConn struct {
+	conn   net.Conn
+	reader *protocol.PacketReader
+	writer *protocol.PacketWriter
+	hello  []byte
+	result chan error
+}
+
+func (h *hubGServer) Listen() error {
+	for {
+		select {
+		case c := <-h.conns:
+			session, reply, err := h.answerHello(h.Hello, c.hello)
+			if reply != nil {
+				if writeErr := c.writer.WritePacket(reply); writeErr != nil && err == nil {
+					err = writeErr
+				}
+			}
+			if err == nil {
+				c.conn.SetReadDeadline(time.Now().Add(helloTimeout))
+				err = h.authenticate(transport.ChannelBinding(c.conn), c.reader.ReadPacket, c.writer.WritePacket)
+				c.conn.SetReadDeadline(time.Time{})
+			}
+
+			if err == nil {
+				c.reader.SetLimit(0)
+				h.attach(c.conn, c.reader, c.writer, session)
+			}
+
+			c.result <- err
+			if err == nil {
+				return nil
+			}
+		case <-h.done:
+			return net.ErrClosed
+		}
+	}
+}
+
+// Serve accepts sharers until the listener fails.
+func (h *Hub) Serve() error {
+	h.mu.Lock()
+	if h.sessions == nil {
+		h.sessions = make(map[int]*hubSession)
+		h.tokens = make(map[string]*hubSession)
+	}
+	if h.Password != "" && h.auth == nil {
+		h.auth = &authGuard{password: h.Password}
+	}
+	h.mu.Unlock()
+
+	fmt.Printf("Waiting for clients on %s...\n", h.Listener.Addr())
+	for {
+		conn, err := h.Listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go h.admit(conn)
+	}
+}
+
+// Sessions lists the current sessions by ID.
+func (h *Hub) Sessions() []SessionInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []SessionInfo
+	for _, s := range h.sessions {
+		out = append(out, SessionInfo{ID: s.id, Hostname: s.hostname, Connected: s.server.IsConnected(), Stats: s.server.Stats()})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Disconnect says bye to every connected sharer, for when the viewer closes.
+func (h *Hub) Disconnect(bye protocol.Goodbye) {
+	h.mu.Lock()
+	var servers []*hubGServer
+	for _, s := range h.sessions {
+		servers = append(servers, s.server)
+	}
+	h.mu.Unlock()
+
+	for _, server := range servers {
+		server.Disconnect(bye)
+	}
+}
+
+// admit reads a sharer's hello and hands the connection to the session its
+// resume token names, or to a new one.
+func (h *Hub) admit(conn net.Conn) {
+	if h.TLSConfig != nil {
+		addr := conn.RemoteAddr()
+		var err error
+		if conn, err = transport.TLSServer(conn, h.TLSConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", addr, err)
+			return
+		}
+	}
+
+	// nothing bigger than a hello is read until the sharer is let in
+	reader, writer := protocol.NewPacketReader(conn), protocol.NewPacketWriter(conn)
+	reader.SetLimit(protocol.TypeHello)
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	data, err := reader.ReadPacket()
+	conn.SetReadDeadline(time.Time{})
+
+	var remote protocol.Hello
+	if err == nil {
+		remote, err = protocol.DecodeHello(data)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Refused client %s: handshake: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	h.mu.Lock()
+	s := h.tokens[remote.ResumeToken]
+	h.mu.Unlock()
+
+	isNew := s == nil
+	if isNew {
+		s = &hubSession{hostname: remote.Hostname, server: &hubGServer{
+			TCPGServer: TCPGServer{Hello: h.Hello, Heartbeat: h.Heartbeat},
+			conns:      make(chan hubConn),
+			done:       make(chan struct{}),
+		}}
+		h.mu.Lock()
+		s.server.auth = h.auth
+		h.mu.Unlock()
+		go s.server.Listen()
+	} else if s.server.IsConnected() {
+		// the token's owner is back before we noticed it had gone
+		s.server.Close()
+	}
+
+	result := make(chan error, 1)
+	select {
+	case s.server.conns <- hubConn{conn: conn, reader: reader, writer: writer, hello: data, result: result}:
+		err = <-result
+	case <-s.server.done:
+		err = errors.New("session has ended")
+	case <-time.After(handoffTimeout):
+		err = errors.New("session is busy")
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		if isNew {
+			close(s.server.done)
+		}
+		return
+	}
+
+	if !isNew {
+		return
+	}
+
+	h.mu.Lock()
+	h.nextID++
+	s.id = h.nextID
+	h.sessions[s.id] = s
+	h.tokens[s.server.resumeToken()] = s
+	h.mu.Unlock()
+
+	fmt.Printf("Session %d: %s\n", s.id, s.hostname)
+	go h.run(s, h.NewRenderer(s.id, s.hostname))
+}
+
+// run shows one session until its sharer is gone for good, then leaves the
+// reason on screen and forgets it.
+func (h *Hub) run(s *hubSession, renderer Renderer) {
+	var bye protocol.Goodbye
+	err := watch(s.server, renderer)
+	if errors.As(err, &bye) {
+		fmt.Printf("Session %d: %s ended the session: %s\n", s.id, s.hostname, bye)
+	} else if err == errNoReconnect {
+		fmt.Printf("Session %d: %s did not reconnect\n", s.id, s.hostname)
+	}
+	renderer.SetStatus(endStatus(err))
+
+	h.mu.Lock()
+	delete(h.sessions, s.id)
+	delete(h.tokens, s.server.resumeToken())
+	h.mu.Unlock()
+
+	close(s.server.done)
+	if h.OnClosed != nil {
+		h.OnClosed(s.id)
+	}
+}
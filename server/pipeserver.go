@@ -0,0 +1,31 @@
+package server
+
+import (
+	"fmt"
+	"ghostviewer/transport"
+	"os"
+)
+
+// PipeGServer accepts sharers from an in-memory listener, for running a whole
+// session inside one process. Past the listener it behaves like TCPGServer.
+type PipeGServer struct {
+	TCPGServer
+	Listener *transport.PipeListener
+}
+
+func (h *PipeGServer) Listen() error {
+	for {
+		conn, err := h.Listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		if err := h.start(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		return nil
+	}
+}
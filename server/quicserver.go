@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"os"
+	"strconv"
+	"time"
+)
+
+type QUICGServer struct {
+	sessionState
+	Ip        string
+	Port      int
+	Conn      *transport.QUICConn
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+	TLSConfig *tls.Config // defaults to LoadTLSConfig
+	listener  *transport.QUICListener
+}
+
+// Listen opens the QUIC listener on the first call and keeps it open across
+// sessions, so a sharer that reconnects from a new address is still accepted.
+func (h *QUICGServer) Listen() error {
+	fmt.Println("Waiting for QUIC client to connect...")
+
+	if h.listener == nil {
+		conf := h.TLSConfig
+		if conf == nil {
+			var err error
+			if conf, err = LoadTLSConfig(false); err != nil {
+				fmt.Fprintf(os.Stderr, "Certificate error: %s\n", err)
+				return err
+			}
+		}
+
+		listener, err := transport.ListenQUIC(h.Ip+":"+strconv.Itoa(h.Port), conf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Listen error: %s\n", err)
+			return err
+		}
+		h.listener = listener
+	}
+
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(helloTimeout))
+		data, err := conn.Read()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client %s: handshake: %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		session, reply, err := h.answerHello(h.Hello, data)
+		if reply != nil {
+			conn.Write(reply)
+		}
+		if err == nil {
+			err = h.authenticate(conn.ChannelBinding(), conn.Read, conn.Write)
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", conn.RemoteAddr(), err)
+			conn.Linger(2 * time.Second)
+			continue
+		}
+
+		logConnected(session, h.resumed())
+		h.Conn = conn
+		h.linkUp(h.Heartbeat, h.send, h.Close)
+		return nil
+	}
+}
+
+func (h *QUICGServer) Close() {
+	h.link.SetState(transport.StateDisconnected, nil)
+	h.Conn.Close()
+}
+
+func (h *QUICGServer) send(msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return h.Conn.Write(data)
+}
+
+func (h *QUICGServer) Receive(frames chan<- protocol.Frame, input <-chan protocol.Message) {
+	h.serve(h.Conn.Read, h.send, h.Conn.Close, frames, input)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"ghostviewer/transport"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RelayGServer waits for the sharer on a relay instead of a listening port.
+// Past the relay it behaves like TCPGServer over an end to end encrypted
+// stream.
+type RelayGServer struct {
+	TCPGServer
+	InviteCode string
+	Proxy      *url.URL // overrides HTTPS_PROXY/ALL_PROXY when set
+}
+
+func (h *RelayGServer) Listen() error {
+	addr := net.JoinHostPort(h.Ip, strconv.Itoa(h.Port))
+	fmt.Printf("Waiting for client on relay %s, invite code %s\n", addr, h.InviteCode)
+
+	backoff := transport.DefaultBackoff
+	for {
+		conn, err := transport.DialRelay(h.Proxy, addr, transport.RelayViewer, h.InviteCode)
+		if errors.Is(err, transport.ErrInviteCode) || errors.Is(err, transport.ErrRelayRefused) {
+			return err
+		}
+
+		if err != nil {
+			// the relay may just be restarting, keep trying
+			delay := backoff.Next()
+			fmt.Fprintf(os.Stderr, "Relay error: %s, retrying in %s\n", err, delay.Round(time.Millisecond))
+			time.Sleep(delay)
+			continue
+		}
+
+		backoff.Reset()
+
+		if err := h.start(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client via relay: %s\n", err)
+			conn.Close()
+			continue
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"os"
+	"sync"
+	"time"
+)
+
+// sessionState is embedded by every GServer. It holds the negotiated session,
+// the token a dropped client presents to resume it, and the link state.
+type sessionState struct {
+	mu       sync.Mutex
+	session  protocol.Session
+	token    string
+	viewOnly bool // a broadcasting client gave the input token to another viewer
+	bye      *protocol.Goodbye
+	link     transport.Link
+	stats    sessionStats
+	auth     *authGuard      // set when sharers must prove they know a password
+	pending  *pendingSession // negotiated, waiting for the sharer's proof
+	// connSend and connClose reach the current connection, for Disconnect
+	connSend  func(protocol.Message) error
+	connClose func()
+}
+
+// SetPassword makes sharers prove they know password, typically a one-time
+// PIN read out over the phone, before their session starts.
+func (s *sessionState) SetPassword(password string) {
+	s.mu.Lock()
+	s.auth = &authGuard{password: password}
+	s.mu.Unlock()
+}
+
+func (s *sessionState) Session() protocol.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session
+}
+
+func (s *sessionState) resumeToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// HasControl reports whether the client will replay our input. Only a client
+// broadcasting to several viewers ever says otherwise.
+func (s *sessionState) HasControl() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.viewOnly
+}
+
+func (s *sessionState) setViewOnly(viewOnly bool) {
+	s.mu.Lock()
+	s.viewOnly = viewOnly
+	s.mu.Unlock()
+}
+
+// Stats reports how the session has been performing.
+func (s *sessionState) Stats() Stats {
+	return s.stats.Stats()
+}
+
+func (s *sessionState) frameDisplayed(frame protocol.Frame) {
+	s.stats.frameDisplayed(frame)
+}
+
+// goodbye reports why the client ended the session on purpose, if it did.
+func (s *sessionState) goodbye() (protocol.Goodbye, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bye == nil {
+		return protocol.Goodbye{}, false
+	}
+	return *s.bye, true
+}
+
+func (s *sessionState) IsConnected() bool {
+	return s.link.Connected()
+}
+
+// linkUp brings the link up once the handshake has succeeded, keeping it
+// alive with heartbeat. send and closeConn reach the new connection.
+func (s *sessionState) linkUp(heartbeat transport.Heartbeat, send func(protocol.Message) error, closeConn func()) {
+	s.mu.Lock()
+	s.connSend, s.connClose = send, closeConn
+	s.mu.Unlock()
+
+	s.link.SetState(transport.StateConnected, nil)
+	go s.link.RunHeartbeat(heartbeat, send, closeConn)
+}
+
+// Disconnect tells the client the viewer is going away, so it stops trying to
+// reconnect, and closes the connection. It does nothing if no client is
+// connected.
+func (s *sessionState) Disconnect(bye protocol.Goodbye) {
+	if !s.IsConnected() {
+		return
+	}
+
+	s.mu.Lock()
+	send, closeConn := s.connSend, s.connClose
+	s.mu.Unlock()
+
+	send(bye)
+	closeConn()
+}
+
+func (s *sessionState) Events() <-chan transport.StateEvent {
+	return s.link.Events()
+}
+
+// resumed reports whether the client that just connected picked up an
+// existing session rather than starting a new one.
+func (s *sessionState) resumed() bool {
+	return s.link.State() == transport.StateDisconnected
+}
+
+func logConnected(session protocol.Session, resumed bool) {
+	verb := "connected"
+	if resumed {
+		verb = "resumed session"
+	}
+
+	fmt.Printf("Client %s %s (codec %s, channels %v)\n", session.Peer.Hostname, verb, session.Codec, session.Channels)
+}
+
+// serve runs one connection as two independent goroutines: the reader pushes
+// frames to frames as they arrive, and the writer sends UI events from input
+// as soon as they are queued. It returns once either side fails or the client
+// says goodbye, calling closeConn and then closing frames so the viewer knows
+// the connection is gone. closeConn must close this connection, not whichever
+// is current: the viewer may accept the next one as soon as frames is closed.
+func (s *sessionState) serve(read func() ([]byte, error), send func(protocol.Message) error, closeConn func() error, frames chan<- protocol.Frame, input <-chan protocol.Message) {
+	defer close(frames)
+	defer closeConn()
+	defer s.link.SetState(transport.StateDisconnected, nil)
+	done := make(chan struct{})
+	defer close(done)
+
+	s.stats.connected()
+	s.mu.Lock()
+	s.bye = nil
+	s.mu.Unlock()
+
+	go func() {
+		var seq uint32
+		clock := time.NewTicker(clockInterval)
+		defer clock.Stop()
+
+		// sample the sharer's clock straight away, so frame latency can be
+		// worked out from the start
+		if err := send(protocol.Clock{Origin: time.Now().UnixNano()}); err != nil {
+			s.link.SetState(transport.StateDisconnected, err)
+			return
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-clock.C:
+				if err := send(protocol.Clock{Origin: time.Now().UnixNano()}); err != nil {
+					s.link.SetState(transport.StateDisconnected, err)
+					return
+				}
+			case msg := <-input:
+				if !s.Session().HasChannel(protocol.ChannelInput) {
+					continue
+				}
+
+				now := time.Now()
+				if stamped, ok := stamp(msg, seq+1, now); ok {
+					seq++
+					msg = stamped
+					s.stats.inputSentAt(seq, now)
+				}
+
+				if err := send(msg); err != nil {
+					fmt.Fprintf(os.Stderr, "Couldn't send UI event: %s\n", err)
+					s.link.SetState(transport.StateDisconnected, err)
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		data, err := read()
+		var msg protocol.Message
+		if err == nil {
+			msg, err = protocol.Decode(data)
+		}
+
+		if err != nil {
+			var protoErr *protocol.ProtocolError
+			if errors.As(err, &protoErr) {
+				fmt.Fprintf(os.Stderr, "Closing connection: %s\n", err)
+				send(protoErr.Message())
+			}
+
+			s.link.SetState(transport.StateDisconnected, err)
+			return
+		}
+
+		if s.link.Intercept(msg, send) {
+			continue
+		}
+
+		switch m := msg.(type) {
+		case protocol.Frame:
+			s.stats.frameReceived(m)
+			frames <- m
+			// acked once the viewer has taken it, so a viewer that can't
+			// keep up slows the sharer down too
+			if err := send(protocol.Control{Code: protocol.ControlFrameAck, Value: uint64(m.Seq)}); err != nil {
+				s.link.SetState(transport.StateDisconnected, err)
+				return
+			}
+		case protocol.Control:
+			switch m.Code {
+			case protocol.ControlInputGranted:
+				s.setViewOnly(false)
+			case protocol.ControlInputRevoked:
+				s.setViewOnly(true)
+			case protocol.ControlInputAck:
+				s.stats.inputAcked(uint32(m.Value))
+			}
+		case protocol.Clock:
+			s.stats.clockReply(m)
+		case protocol.Goodbye:
+			s.mu.Lock()
+			s.bye = &m
+			s.mu.Unlock()
+			s.link.SetState(transport.StateDisconnected, m)
+			return
+		case protocol.Error:
+			fmt.Fprintf(os.Stderr, "Client error: %s\n", m.Reason)
+		}
+	}
+}
+
+// stamp sets the sequence number and send time on an input event, reporting
+// false for anything else the UI queues.
+func stamp(msg protocol.Message, seq uint32, at time.Time) (protocol.Message, bool) {
+	switch m := msg.(type) {
+	case protocol.Pointer:
+		m.Seq, m.Timestamp = seq, at.UnixNano()
+		return m, true
+	case protocol.Key:
+		m.Seq, m.Timestamp = seq, at.UnixNano()
+		return m, true
+	case protocol.Scroll:
+		m.Seq, m.Timestamp = seq, at.UnixNano()
+		return m, true
+	}
+	return msg, false
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"ghostviewer/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	// clockInterval is how often the sharer's clock is sampled, and
+	// clockWindow how long the best sample stands before a worse one may
+	// replace it, in case either clock drifts
+	clockInterval = 5 * time.Second
+	clockWindow   = time.Minute
+
+	maxPendingInput = 1024
+)
+
+// Stats describes how a session is performing, for when a user says it feels
+// laggy. Latencies are smoothed over the last several samples and are zero
+// until there is one.
+type Stats struct {
+	Frames    uint64 // frames received
+	Dropped   uint64 // frames the sharer sent that never arrived
+	Reordered uint64 // frames that arrived after a later one
+
+	// Latency is from the sharer capturing a frame to it being on screen,
+	// which depends on ClockOffset being right.
+	Latency time.Duration
+	// InputRTT is from an input event being sent to the sharer confirming
+	// it has replayed it.
+	InputRTT time.Duration
+	// ClockOffset is the sharer's clock minus ours, measured to within
+	// half of ClockRTT.
+	ClockOffset time.Duration
+	ClockRTT    time.Duration
+}
+
+// sessionStats gathers Stats for a session across reconnects.
+type sessionStats struct {
+	mu        sync.Mutex
+	stats     Stats
+	haveClock bool
+	clockAt   time.Time
+	lastSeq   uint32
+	haveSeq   bool
+	inputSent map[uint32]time.Time
+}
+
+func (s *sessionStats) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// connected starts counting sequence numbers afresh, as a sharer that has
+// restarted counts from zero again.
+func (s *sessionStats) connected() {
+	s.mu.Lock()
+	s.haveSeq = false
+	s.inputSent = nil
+	s.mu.Unlock()
+}
+
+func (s *sessionStats) frameReceived(frame protocol.Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Frames++
+	if !s.haveSeq {
+		s.haveSeq = true
+		s.lastSeq = frame.Seq
+		return
+	}
+
+	gap := int32(frame.Seq - s.lastSeq)
+	switch {
+	case gap > 0:
+		s.stats.Dropped += uint64(gap - 1)
+		s.lastSeq = frame.Seq
+	case gap < 0:
+		// counted as dropped when the later frame overtook it
+		s.stats.Reordered++
+		if s.stats.Dropped > 0 {
+			s.stats.Dropped--
+		}
+	}
+}
+
+func (s *sessionStats) frameDisplayed(frame protocol.Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.haveClock {
+		return
+	}
+
+	captured := time.Unix(0, frame.Timestamp).Add(-s.stats.ClockOffset)
+	s.stats.Latency = smooth(s.stats.Latency, time.Since(captured))
+}
+
+// clockReply takes a sample from the sharer's answer to a clock request,
+// keeping the one with the quickest round trip as the most accurate.
+func (s *sessionStats) clockReply(clock protocol.Clock) {
+	now := time.Now()
+	sent := time.Unix(0, clock.Origin)
+	rtt := now.Sub(sent)
+	if rtt < 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.haveClock && rtt > s.stats.ClockRTT && now.Sub(s.clockAt) < clockWindow {
+		return
+	}
+
+	s.haveClock = true
+	s.clockAt = now
+	s.stats.ClockRTT = rtt
+	s.stats.ClockOffset = time.Duration(clock.Peer - sent.Add(rtt/2).UnixNano())
+}
+
+func (s *sessionStats) inputSentAt(seq uint32, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a sharer that never acks, or has input turned off, mustn't grow this
+	// without bound
+	if s.inputSent == nil || len(s.inputSent) >= maxPendingInput {
+		s.inputSent = make(map[uint32]time.Time)
+	}
+	s.inputSent[seq] = at
+}
+
+func (s *sessionStats) inputAcked(seq uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent, ok := s.inputSent[seq]
+	if !ok {
+		return
+	}
+
+	delete(s.inputSent, seq)
+	s.stats.InputRTT = smooth(s.stats.InputRTT, time.Since(sent))
+}
+
+func smooth(avg time.Duration, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return (7*avg + sample) / 8
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// StdioGServer views a sharer over a stream, typically by running it over ssh
+// with Stream.Command set to something like
+// "ssh host ghostviewer share --stdio". Past the stream it behaves like
+// TCPGServer.
+type StdioGServer struct {
+	TCPGServer
+	Stream *transport.Stream
+}
+
+func (h *StdioGServer) Listen() error {
+	if len(h.Stream.Command) == 0 {
+		conn, err := h.Stream.Open()
+		if err != nil {
+			return err
+		}
+
+		if err := h.start(conn); err != nil {
+			conn.Close()
+			return err
+		}
+		return nil
+	}
+
+	fmt.Printf("Running %s\n", strings.Join(h.Stream.Command, " "))
+
+	backoff := transport.DefaultBackoff
+	for {
+		conn, err := h.Stream.Open()
+		if errors.Is(err, exec.ErrNotFound) {
+			return err
+		}
+
+		if err == nil {
+			if err = h.start(conn); err == nil {
+				return nil
+			}
+			conn.Close()
+			if errors.Is(err, protocol.ErrIncompatible) {
+				return err
+			}
+		}
+
+		// ssh may fail on a flaky network, keep trying
+		delay := backoff.Next()
+		fmt.Fprintf(os.Stderr, "Tunnel error: %s, retrying in %s\n", err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
@@ -1,29 +1,25 @@
 package server
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"crypto/tls"
 	"fmt"
-	"ghostviewer/ui"
-	"io"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
 	"net"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 )
 
-const headerSize = 5
-const packetPrefix = '%'
-
 type TCPGServer struct {
-	Ip   string
-	Port int
-	Conn net.Conn
-}
-
-func (h *TCPGServer) IsConnected() bool {
-	return h.Conn != nil && h.Conn.RemoteAddr() != nil
+	sessionState
+	Ip        string
+	Port      int
+	Conn      net.Conn
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+	TLSConfig *tls.Config // wraps the connections Listen accepts in TLS 1.3 when set
+	mux       *transport.Mux
 }
 
 func (h *TCPGServer) Listen() error {
@@ -34,87 +30,73 @@ func (h *TCPGServer) Listen() error {
 		return err
 	}
 
-	h.Conn, err = l.Accept()
-	l.Close()
-	return err
-}
-
-func (h *TCPGServer) Close() {
-	h.Conn.Close()
-	h.Conn = nil
-}
-
-func (h *TCPGServer) ProcessInput(output chan ui.Message, data *bytes.Buffer) (disconnect bool) {
-	disconnect = false
+	defer l.Close()
 
 	for {
-		if len(data.Bytes()) == 0 {
-			return
+		conn, err := l.Accept()
+		if err != nil {
+			return err
 		}
 
-		if data.Bytes()[0] != packetPrefix { // check for prefix
-			disconnect = true
-			return
+		if h.TLSConfig != nil {
+			addr := conn.RemoteAddr()
+			if conn, err = transport.TLSServer(conn, h.TLSConfig); err != nil {
+				fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", addr, err)
+				continue
+			}
 		}
 
-		var dataSize int
-		if data.Len() > headerSize {
-			dataSize = int(binary.LittleEndian.Uint32(data.Bytes()[1:5]))
-		} else {
-			return
+		if err := h.start(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
 		}
 
-		packetSize := headerSize + dataSize
-		if data.Len() < packetSize {
-			return
-		}
+		return nil
+	}
+}
 
-		packet := data.Next(packetSize)[5:]
-		//fmt.Println(len(packet))
-		tmpbuff := bytes.NewBuffer(packet)
-		msg := new(ui.Message)
-		gobobjdec := gob.NewDecoder(tmpbuff)
-		err := gobobjdec.Decode(msg)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Couldn't decode packet: %s", err)
-		}
+// start runs the handshake over a newly accepted conn and brings the link up.
+// A client that doesn't finish it within helloTimeout is dropped, so it can't
+// keep the next one from being accepted.
+func (h *TCPGServer) start(conn net.Conn) error {
+	reader, writer := protocol.NewPacketReader(conn), protocol.NewPacketWriter(conn)
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	session, err := h.handshake(reader, writer, h.Hello, transport.ChannelBinding(conn))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
 
-		output <- *msg
+	h.attach(conn, reader, writer, session)
+	return nil
+}
 
-		// send UI events back
+// attach brings the link up on conn once the handshake has succeeded.
+func (h *TCPGServer) attach(conn net.Conn, reader *protocol.PacketReader, writer *protocol.PacketWriter, session protocol.Session) {
+	logConnected(session, h.resumed())
+	h.Conn, h.mux = conn, transport.NewMux(reader, writer, false)
+	h.linkUp(h.Heartbeat, h.send, h.Close)
+}
 
-		uiMsgHeader := <-output
-		numUIEvents, _ := strconv.Atoi(strings.Split(uiMsgHeader.Cmd, ":")[1])
-		if numUIEvents != 0 {
-			packetPrefix := []byte{'%'}
-			encodedEvents := []byte{}
-			uiPacketSize := make([]byte, 4)
-			for i := 0; i < numUIEvents; i++ {
-				encodedEvents = append(encodedEvents, ui.EncodeEvent(<-output)[:]...)
-			}
-			binary.LittleEndian.PutUint32(uiPacketSize, uint32(len(encodedEvents)))
-			packet = append(append(packetPrefix, uiPacketSize[:]...), encodedEvents[:]...)
-			h.Conn.Write(packet)
-		}
-	}
+func (h *TCPGServer) Close() {
+	h.link.SetState(transport.StateDisconnected, nil)
+	h.Conn.Close()
 }
 
-func (h *TCPGServer) Receive(output chan ui.Message) {
-	localBuf := new(bytes.Buffer)
-	readBuf := make([]byte, 4096)
-	defer h.Close()
+func (h *TCPGServer) send(msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return h.mux.Write(data)
+}
 
-	for {
-		dataLen, err := h.Conn.Read(readBuf)
-		if err != nil {
-			if err == io.EOF {
-				h.Close()
-			}
-		}
+// Mux returns the connection's channels, for features that open their own.
+func (h *TCPGServer) Mux() *transport.Mux {
+	return h.mux
+}
 
-		localBuf.Write(readBuf[:dataLen])
-		if h.ProcessInput(output, localBuf) {
-			break
-		}
-	}
+func (h *TCPGServer) Receive(frames chan<- protocol.Frame, input <-chan protocol.Message) {
+	h.serve(h.mux.Read, h.send, h.Conn.Close, frames, input)
 }
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"ghostviewer/protocol"
+	"ghostviewer/transport"
+	"os"
+	"strconv"
+	"time"
+)
+
+type UDPGServer struct {
+	sessionState
+	Ip        string
+	Port      int
+	Conn      *transport.DatagramConn
+	Hello     protocol.Hello
+	Heartbeat transport.Heartbeat
+}
+
+func (h *UDPGServer) Listen() error {
+	fmt.Println("Waiting for UDP client to connect...")
+
+	for {
+		conn, err := transport.AcceptDatagram(h.Ip + ":" + strconv.Itoa(h.Port))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Listen error: %s\n", err)
+			return err
+		}
+
+		// whoever sent the first datagram must say hello in time, or we go
+		// back to waiting for someone else
+		conn.SetReadDeadline(time.Now().Add(helloTimeout))
+		data, err := conn.Read()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client %s: handshake: %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		session, reply, err := h.answerHello(h.Hello, data)
+		if reply != nil {
+			conn.WriteReliable(reply)
+		}
+		if err == nil {
+			// datagrams aren't encrypted, so there is nothing to bind a PIN to
+			err = h.authenticate(nil, conn.Read, conn.WriteReliable)
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client %s: %s\n", conn.RemoteAddr(), err)
+			conn.Flush(2 * time.Second)
+			conn.Close()
+			continue
+		}
+
+		conn.OnFrameLost = func() {
+			if data, err := protocol.Marshal(protocol.Control{Code: protocol.ControlRefresh}); err == nil {
+				conn.WriteReliable(data)
+			}
+		}
+
+		logConnected(session, h.resumed())
+		h.Conn = conn
+		h.linkUp(h.Heartbeat, h.send, h.Close)
+		return nil
+	}
+}
+
+func (h *UDPGServer) Close() {
+	h.link.SetState(transport.StateDisconnected, nil)
+	h.Conn.Close()
+}
+
+func (h *UDPGServer) send(msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return h.Conn.WriteReliable(data)
+}
+
+func (h *UDPGServer) Receive(frames chan<- protocol.Frame, input <-chan protocol.Message) {
+	h.serve(h.Conn.Read, h.send, h.Conn.Close, frames, input)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"ghostviewer/transport"
+	"os"
+)
+
+// UnixGServer waits for a sharer on a Unix socket, which ssh can forward from
+// another host. Past the socket it behaves like TCPGServer.
+type UnixGServer struct {
+	TCPGServer
+	Path string
+}
+
+func (h *UnixGServer) Listen() error {
+	fmt.Printf("Waiting for client on %s...\n", h.Path)
+	l, err := transport.ListenUnix(h.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Listen error: %s\n", err)
+		return err
+	}
+
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		if err := h.start(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Refused client on %s: %s\n", h.Path, err)
+			conn.Close()
+			continue
+		}
+
+		return nil
+	}
+}
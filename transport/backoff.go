@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff produces exponentially growing, jittered delays between reconnect
+// attempts.
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+var DefaultBackoff = Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+
+func (b *Backoff) Next() time.Duration {
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = DefaultBackoff.Min
+	}
+	if max <= 0 {
+		max = DefaultBackoff.Max
+	}
+
+	delay := max
+	if b.attempt < 30 && min<<b.attempt < max {
+		delay = min << b.attempt
+	}
+	b.attempt++
+
+	// up to 25% jitter so many sharers don't reconnect in lockstep
+	return delay - time.Duration(rand.Int63n(int64(delay)/4+1))
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"crypto/tls"
+
+	"github.com/gorilla/websocket"
+)
+
+// bindingLabel is the TLS exporter label for the PIN exchange's binding.
+const bindingLabel = "EXPORTER-ghostviewer-auth"
+
+// bindingSize is how many bytes of binding the exporters give.
+const bindingSize = 32
+
+// binder is a connection that derives its own channel binding.
+type binder interface {
+	ChannelBinding() []byte
+}
+
+// ChannelBinding returns a value both ends of conn agree on, and that someone
+// relaying between two separate connections can't make them agree on: TLS's
+// exporter, or a key derived alongside the relay's. The PIN exchange mixes it
+// into its proofs, so a proof only counts on the connection it was made on.
+// It returns nil if the link isn't encrypted, where nothing stops someone in
+// the middle taking over once the PIN has been checked.
+func ChannelBinding(conn any) []byte {
+	if ws, ok := conn.(*websocket.Conn); ok {
+		conn = ws.UnderlyingConn()
+	}
+
+	switch c := conn.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		return exportBinding(&state)
+	case binder:
+		return c.ChannelBinding()
+	}
+	return nil
+}
+
+func exportBinding(state *tls.ConnectionState) []byte {
+	binding, err := state.ExportKeyingMaterial(bindingLabel, nil, bindingSize)
+	if err != nil {
+		return nil
+	}
+	return binding
+}
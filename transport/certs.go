@@ -0,0 +1,309 @@
+package transport
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The files GenerateCertificates writes to a certificate directory. The
+// viewer serves server.crt; a sharer given ca.crt checks the viewer against it
+// and presents client.crt if it's there.
+const (
+	CAFile         = "ca.crt"
+	CAKeyFile      = "ca.key"
+	ServerCertFile = "server.crt"
+	ServerKeyFile  = "server.key"
+	ClientCertFile = "client.crt"
+	ClientKeyFile  = "client.key"
+)
+
+const (
+	caLifetime   = 10 * 365 * 24 * time.Hour
+	leafLifetime = 2 * 365 * 24 * time.Hour
+)
+
+// CertDir is where certificates are kept: GHOSTVIEWER_CERTS, or the certs
+// directory in our config directory.
+func CertDir() string {
+	if dir := os.Getenv("GHOSTVIEWER_CERTS"); dir != "" {
+		return dir
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "ghostviewer", "certs")
+}
+
+// GenerateCertificates creates a CA in dir, unless one is already there, and
+// issues a server certificate valid for hosts, this machine's names and
+// addresses, and a client certificate. Keys already in dir are kept, so
+// reissued certificates keep the fingerprints sharers have pinned.
+func GenerateCertificates(dir string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	caKey, err := loadOrCreateKey(filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return err
+	}
+
+	ca, err := loadCertificateFile(filepath.Join(dir, CAFile))
+	if errors.Is(err, os.ErrNotExist) {
+		template := &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "ghostviewer CA"},
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		if ca, err = issue(filepath.Join(dir, CAFile), template, caLifetime, caKey, nil, caKey); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if !caKey.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(ca.PublicKey) {
+		return fmt.Errorf("%s doesn't match %s", CAKeyFile, CAFile)
+	}
+
+	hostname, _ := os.Hostname()
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hostname},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range append(localNames(hostname), hosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else if host != "" {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+
+	client := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ghostviewer sharer"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, leaf := range []struct {
+		template  *x509.Certificate
+		cert, key string
+	}{{server, ServerCertFile, ServerKeyFile}, {client, ClientCertFile, ClientKeyFile}} {
+		key, err := loadOrCreateKey(filepath.Join(dir, leaf.key))
+		if err != nil {
+			return err
+		}
+		if _, err := issue(filepath.Join(dir, leaf.cert), leaf.template, leafLifetime, key, ca, caKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// localNames lists the names and addresses sharers may use to reach us.
+func localNames(hostname string) []string {
+	names := []string{"localhost", hostname}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			names = append(names, ipnet.IP.String())
+		}
+	}
+	return names
+}
+
+// issue signs template for key with parent's key, or self-signs it if parent
+// is nil, and writes the certificate to path.
+func issue(path string, template *x509.Certificate, lifetime time.Duration, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(lifetime)
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type", path)
+	}
+	return signer, nil
+}
+
+func loadCertificateFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// writeAtomic replaces path in one step, so a viewer reloading its
+// certificate never reads half of one.
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ClientTLSConfig checks the viewer against the CA in dir and presents the
+// client certificate there, if any. It returns nil if dir holds no CA, in
+// which case the viewer is pinned as PinnedTLSConfig does.
+func ClientTLSConfig(dir string) (*tls.Config, error) {
+	data, err := os.ReadFile(filepath.Join(dir, CAFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates", filepath.Join(dir, CAFile))
+	}
+	conf := &tls.Config{RootCAs: roots}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, ClientCertFile), filepath.Join(dir, ClientKeyFile))
+	if err == nil {
+		conf.Certificates = []tls.Certificate{cert}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// CertReloader serves a certificate and key pair from disk, reloading them
+// whenever either file changes, so a renewed certificate is picked up by the
+// next handshake while sessions already running carry on.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the pair once up front, so a missing or broken
+// certificate is reported at startup rather than on the first handshake.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if _, err := r.Certificate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Certificate returns the pair, reloaded if it changed on disk. If reloading
+// fails, e.g. because only one file has been replaced yet, the previous pair
+// is kept.
+func (r *CertReloader) Certificate() (*tls.Certificate, error) {
+	modTime, err := r.latestModTime()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err == nil && r.cert != nil && modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, loadErr := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if loadErr != nil {
+		if r.cert != nil {
+			fmt.Fprintf(os.Stderr, "Keeping the current certificate, reloading %s failed: %s\n", r.CertFile, loadErr)
+			return r.cert, nil
+		}
+		return nil, loadErr
+	}
+
+	if r.cert != nil {
+		fmt.Printf("Reloaded certificate %s\n", r.CertFile)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return r.cert, nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate is for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate()
+}
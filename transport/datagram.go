@@ -0,0 +1,528 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Datagrams carry either a fragment of an unreliable payload (video frames),
+// a reliable payload (input, control, handshake) or an ack for one. Every
+// datagram starts with the same header:
+//
+//	magic u8 | kind u8 | seq u32 | index u16 | count u16
+const (
+	datagramMagic      = 'G'
+	datagramHeaderSize = 10
+
+	// MaxDatagramSize keeps datagrams under the common 1280 byte IPv6 MTU.
+	MaxDatagramSize    = 1200
+	MaxDatagramPayload = MaxDatagramSize - datagramHeaderSize
+
+	maxFragments = 1 << 16
+
+	// socketBuffer leaves room for a full burst of frame fragments so the
+	// kernel doesn't drop them before readLoop catches up.
+	socketBuffer = 8 << 20
+
+	// maxPartialFrames and maxReorderWindow bound the memory a peer can make
+	// us hold for incomplete or out-of-order data.
+	maxPartialFrames = 3
+	maxReorderWindow = 1024
+)
+
+const (
+	kindFragment uint8 = iota + 1
+	kindReliable
+	kindAck
+)
+
+var (
+	ErrDatagramClosed = errors.New("datagram connection closed")
+	ErrPeerTimeout    = errors.New("peer stopped acknowledging reliable messages")
+	ErrTooLarge       = errors.New("payload too large")
+)
+
+var (
+	// RetransmitInterval is how long a reliable message waits for an ack
+	// before it is sent again.
+	RetransmitInterval = 200 * time.Millisecond
+	// MaxRetransmits bounds how often a reliable message is resent before the
+	// peer is considered gone.
+	MaxRetransmits = 25
+	// FrameTimeout is how long an incomplete frame is kept waiting for its
+	// missing fragments before it is discarded as lost.
+	FrameTimeout = 250 * time.Millisecond
+)
+
+type pending struct {
+	data     []byte
+	sentAt   time.Time
+	attempts int
+}
+
+type partialFrame struct {
+	fragments [][]byte
+	received  int
+	started   time.Time
+}
+
+// DatagramConn runs ordered reliable delivery and best-effort fragmented
+// delivery over a single UDP socket talking to one peer.
+type DatagramConn struct {
+	conn *net.UDPConn
+	peer *net.UDPAddr
+
+	// OnFrameLost is called when an incomplete frame is given up on, so the
+	// receiver can ask the sender for a refresh.
+	OnFrameLost func()
+
+	incoming chan []byte
+	done     chan struct{}
+	closeErr error
+	once     sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	sendSeq      uint32
+	unacked      map[uint32]*pending
+	recvSeq      uint32
+	outOfOrder   map[uint32][]byte
+	frameSeq     uint32
+	lastFrame    uint32
+	partials     map[uint32]*partialFrame
+}
+
+func newDatagramConn(conn *net.UDPConn, peer *net.UDPAddr) *DatagramConn {
+	conn.SetReadBuffer(socketBuffer)
+	conn.SetWriteBuffer(socketBuffer)
+
+	return &DatagramConn{
+		conn:       conn,
+		peer:       peer,
+		incoming:   make(chan []byte, 64),
+		done:       make(chan struct{}),
+		unacked:    make(map[uint32]*pending),
+		outOfOrder: make(map[uint32][]byte),
+		partials:   make(map[uint32]*partialFrame),
+	}
+}
+
+// DialDatagram opens a local UDP socket that talks to addr.
+func DialDatagram(addr string) (*DatagramConn, error) {
+	peer, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newDatagramConn(conn, peer)
+	c.start()
+	return c, nil
+}
+
+// AcceptDatagram listens on addr and binds to whichever peer sends the first
+// valid datagram. Datagrams from anyone else are ignored afterwards.
+func AcceptDatagram(addr string) (*DatagramConn, error) {
+	local, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, peer, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if n < datagramHeaderSize || buf[0] != datagramMagic {
+			continue
+		}
+
+		c := newDatagramConn(conn, peer)
+		c.handle(buf[:n])
+		c.start()
+		return c, nil
+	}
+}
+
+func (c *DatagramConn) start() {
+	go c.readLoop()
+	go c.retransmitLoop()
+}
+
+func (c *DatagramConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// Read returns the next reliable message or reassembled frame.
+func (c *DatagramConn) Read() ([]byte, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case data := <-c.incoming:
+		return data, nil
+	case <-c.done:
+		return nil, c.closeErr
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// SetReadDeadline makes Read calls started after it fail with
+// os.ErrDeadlineExceeded once t has passed. A zero t means no deadline.
+func (c *DatagramConn) SetReadDeadline(t time.Time) {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+}
+
+// WriteReliable sends data so that it arrives exactly once and in order with
+// respect to other reliable messages. It must fit in one datagram.
+func (c *DatagramConn) WriteReliable(data []byte) error {
+	if len(data) > MaxDatagramPayload {
+		return fmt.Errorf("%w: %d byte reliable message", ErrTooLarge, len(data))
+	}
+
+	c.mu.Lock()
+	c.sendSeq++
+	seq := c.sendSeq
+	c.unacked[seq] = &pending{data: data, sentAt: time.Now(), attempts: 1}
+	c.mu.Unlock()
+
+	return c.send(kindReliable, seq, 0, 0, data)
+}
+
+// WriteUnreliable splits data into fragments and sends them once. The peer
+// drops the whole payload if any fragment goes missing.
+func (c *DatagramConn) WriteUnreliable(data []byte) error {
+	count := (len(data) + MaxDatagramPayload - 1) / MaxDatagramPayload
+	if count == 0 {
+		count = 1
+	}
+
+	if count >= maxFragments {
+		return fmt.Errorf("%w: %d byte frame", ErrTooLarge, len(data))
+	}
+
+	c.mu.Lock()
+	c.frameSeq++
+	seq := c.frameSeq
+	c.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * MaxDatagramPayload
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := c.send(kindFragment, seq, uint16(i), uint16(count), data[i*MaxDatagramPayload:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush waits until every reliable message has been acknowledged or the
+// timeout expires.
+func (c *DatagramConn) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		empty := len(c.unacked) == 0
+		c.mu.Unlock()
+
+		if empty {
+			return true
+		}
+
+		select {
+		case <-c.done:
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	return false
+}
+
+func (c *DatagramConn) Close() error {
+	c.closeWith(ErrDatagramClosed)
+	return nil
+}
+
+// Linger waits up to timeout for the peer to ack every reliable message, then
+// closes, so a last message written just before hanging up isn't lost.
+func (c *DatagramConn) Linger(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		acked := len(c.unacked) == 0
+		c.mu.Unlock()
+
+		if acked {
+			break
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	c.Close()
+}
+
+func (c *DatagramConn) closeWith(err error) {
+	c.once.Do(func() {
+		c.closeErr = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *DatagramConn) send(kind uint8, seq uint32, index uint16, count uint16, payload []byte) error {
+	packet := make([]byte, datagramHeaderSize+len(payload))
+	packet[0] = datagramMagic
+	packet[1] = kind
+	binary.BigEndian.PutUint32(packet[2:], seq)
+	binary.BigEndian.PutUint16(packet[6:], index)
+	binary.BigEndian.PutUint16(packet[8:], count)
+	copy(packet[datagramHeaderSize:], payload)
+
+	_, err := c.conn.WriteToUDP(packet, c.peer)
+	return err
+}
+
+func (c *DatagramConn) readLoop() {
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			c.closeWith(err)
+			return
+		}
+
+		if !from.IP.Equal(c.peer.IP) || from.Port != c.peer.Port {
+			continue
+		}
+
+		c.handle(buf[:n])
+	}
+}
+
+func (c *DatagramConn) handle(packet []byte) {
+	if len(packet) < datagramHeaderSize || packet[0] != datagramMagic {
+		return
+	}
+
+	kind := packet[1]
+	seq := binary.BigEndian.Uint32(packet[2:])
+	index := binary.BigEndian.Uint16(packet[6:])
+	count := binary.BigEndian.Uint16(packet[8:])
+	payload := append([]byte(nil), packet[datagramHeaderSize:]...)
+
+	switch kind {
+	case kindAck:
+		c.mu.Lock()
+		delete(c.unacked, seq)
+		c.mu.Unlock()
+	case kindReliable:
+		c.send(kindAck, seq, 0, 0, nil)
+		c.receiveReliable(seq, payload)
+	case kindFragment:
+		c.receiveFragment(seq, index, count, payload)
+	}
+}
+
+func (c *DatagramConn) receiveReliable(seq uint32, payload []byte) {
+	c.mu.Lock()
+	if seq <= c.recvSeq || seq > c.recvSeq+maxReorderWindow {
+		c.mu.Unlock()
+		return
+	}
+
+	c.outOfOrder[seq] = payload
+	var ready [][]byte
+	for {
+		next, ok := c.outOfOrder[c.recvSeq+1]
+		if !ok {
+			break
+		}
+		delete(c.outOfOrder, c.recvSeq+1)
+		c.recvSeq++
+		ready = append(ready, next)
+	}
+	c.mu.Unlock()
+
+	for _, data := range ready {
+		c.deliver(data)
+	}
+}
+
+func (c *DatagramConn) receiveFragment(seq uint32, index uint16, count uint16, payload []byte) {
+	if count == 0 || index >= count {
+		return
+	}
+
+	c.mu.Lock()
+	if seq <= c.lastFrame {
+		c.mu.Unlock()
+		return
+	}
+
+	frame, ok := c.partials[seq]
+	if !ok {
+		if len(c.partials) >= maxPartialFrames {
+			c.dropOldestPartial()
+		}
+		frame = &partialFrame{fragments: make([][]byte, count), started: time.Now()}
+		c.partials[seq] = frame
+	}
+
+	if int(count) != len(frame.fragments) || frame.fragments[index] != nil {
+		c.mu.Unlock()
+		return
+	}
+
+	frame.fragments[index] = payload
+	frame.received++
+	if frame.received < len(frame.fragments) {
+		c.mu.Unlock()
+		return
+	}
+
+	// A complete frame supersedes every older partial one.
+	for s := range c.partials {
+		if s <= seq {
+			delete(c.partials, s)
+		}
+	}
+	c.lastFrame = seq
+	c.mu.Unlock()
+
+	size := 0
+	for _, f := range frame.fragments {
+		size += len(f)
+	}
+
+	data := make([]byte, 0, size)
+	for _, f := range frame.fragments {
+		data = append(data, f...)
+	}
+
+	c.deliver(data)
+}
+
+// dropOldestPartial must be called with c.mu held.
+func (c *DatagramConn) dropOldestPartial() {
+	oldest := uint32(0)
+	for seq := range c.partials {
+		if oldest == 0 || seq < oldest {
+			oldest = seq
+		}
+	}
+	delete(c.partials, oldest)
+}
+
+func (c *DatagramConn) deliver(data []byte) {
+	select {
+	case c.incoming <- data:
+	case <-c.done:
+	}
+}
+
+func (c *DatagramConn) retransmitLoop() {
+	ticker := time.NewTicker(RetransmitInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if c.retransmit(now) {
+				c.closeWith(ErrPeerTimeout)
+				return
+			}
+			c.expireFrames(now)
+		}
+	}
+}
+
+// retransmit resends overdue reliable messages and reports whether any of
+// them ran out of attempts.
+func (c *DatagramConn) retransmit(now time.Time) (gaveUp bool) {
+	c.mu.Lock()
+	var resend map[uint32][]byte
+	for seq, p := range c.unacked {
+		if now.Sub(p.sentAt) < RetransmitInterval {
+			continue
+		}
+
+		if p.attempts >= MaxRetransmits {
+			gaveUp = true
+			break
+		}
+
+		p.attempts++
+		p.sentAt = now
+		if resend == nil {
+			resend = make(map[uint32][]byte)
+		}
+		resend[seq] = p.data
+	}
+	c.mu.Unlock()
+
+	for seq, data := range resend {
+		c.send(kindReliable, seq, 0, 0, data)
+	}
+
+	return gaveUp
+}
+
+func (c *DatagramConn) expireFrames(now time.Time) {
+	lost := false
+
+	c.mu.Lock()
+	for seq, frame := range c.partials {
+		if now.Sub(frame.started) >= FrameTimeout {
+			delete(c.partials, seq)
+			if seq > c.lastFrame {
+				c.lastFrame = seq
+			}
+			lost = true
+		}
+	}
+	c.mu.Unlock()
+
+	if lost && c.OnFrameLost != nil {
+		c.OnFrameLost()
+	}
+}
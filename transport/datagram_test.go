@@ -0,0 +1,288 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyLink forwards datagrams between a DialDatagram client and an
+// AcceptDatagram server, dropping those drop picks out.
+type lossyLink struct {
+	conn   *net.UDPConn
+	server *net.UDPAddr
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	drop   func(toServer bool, kind uint8, seq uint32, index uint16) bool
+	sizes  []int
+}
+
+// datagramPair connects a client and a server through a lossyLink.
+func datagramPair(t *testing.T) (*DatagramConn, *DatagramConn, *lossyLink) {
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &lossyLink{conn: conn, server: serverAddr}
+	go link.run()
+	t.Cleanup(func() { conn.Close() })
+
+	accepted := make(chan *DatagramConn, 1)
+	failed := make(chan error, 1)
+	go func() {
+		server, err := AcceptDatagram(serverAddr.String())
+		if err != nil {
+			failed <- err
+			return
+		}
+		accepted <- server
+	}()
+
+	client, err := DialDatagram(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	// the server binds to whoever speaks first, so keep saying hello until
+	// it is listening
+	var server *DatagramConn
+	for server == nil {
+		if err := client.WriteUnreliable([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case server = <-accepted:
+		case err := <-failed:
+			t.Fatal(err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Cleanup(func() { server.Close() })
+
+	// skip the hellos that made it through
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	for {
+		if _, err := server.Read(); err != nil {
+			break
+		}
+	}
+	server.SetReadDeadline(time.Time{})
+
+	return client, server, link
+}
+
+func (l *lossyLink) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		packet := buf[:n]
+		toServer := !(from.IP.Equal(l.server.IP) && from.Port == l.server.Port)
+
+		l.mu.Lock()
+		if toServer {
+			l.client = from
+		}
+		to := l.client
+		if toServer {
+			to = l.server
+		}
+		l.sizes = append(l.sizes, n)
+		drop := l.drop != nil && n >= datagramHeaderSize &&
+			l.drop(toServer, packet[1], binary.BigEndian.Uint32(packet[2:]), binary.BigEndian.Uint16(packet[6:]))
+		l.mu.Unlock()
+
+		if !drop && to != nil {
+			l.conn.WriteToUDP(packet, to)
+		}
+	}
+}
+
+func (l *lossyLink) setDrop(drop func(toServer bool, kind uint8, seq uint32, index uint16) bool) {
+	l.mu.Lock()
+	l.drop = drop
+	l.mu.Unlock()
+}
+
+func (l *lossyLink) largest() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	largest := 0
+	for _, n := range l.sizes {
+		if n > largest {
+			largest = n
+		}
+	}
+	return largest
+}
+
+func readWithin(t *testing.T, c *DatagramConn, timeout time.Duration) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	data, err := c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func payload(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = seed + byte(i*7)
+	}
+	return data
+}
+
+func TestDatagramFragments(t *testing.T) {
+	client, server, link := datagramPair(t)
+
+	for _, size := range []int{0, 1, MaxDatagramPayload, MaxDatagramPayload + 1, 40*MaxDatagramPayload + 17} {
+		sent := payload(size, byte(size))
+		if err := client.WriteUnreliable(sent); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readWithin(t, server, 2*time.Second); !bytes.Equal(got, sent) {
+			t.Fatalf("%d byte frame came back as %d bytes", size, len(got))
+		}
+	}
+
+	if largest := link.largest(); largest > MaxDatagramSize {
+		t.Fatalf("sent a %d byte datagram, limit is %d", largest, MaxDatagramSize)
+	}
+
+	if err := client.WriteUnreliable(make([]byte, maxFragments*MaxDatagramPayload)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversized frame: got %v", err)
+	}
+}
+
+func TestDatagramFrameLoss(t *testing.T) {
+	client, server, link := datagramPair(t)
+
+	// the hellos were frames too, so the ones below come after them
+	client.mu.Lock()
+	first := client.frameSeq + 1
+	client.mu.Unlock()
+
+	link.setDrop(func(toServer bool, kind uint8, seq uint32, index uint16) bool {
+		return toServer && kind == kindFragment && seq == first && index == 2
+	})
+
+	lost := make(chan struct{}, 1)
+	server.mu.Lock()
+	server.OnFrameLost = func() {
+		select {
+		case lost <- struct{}{}:
+		default:
+		}
+	}
+	server.mu.Unlock()
+
+	if err := client.WriteUnreliable(payload(5*MaxDatagramPayload, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the frame missing a fragment is never delivered, and the one after it
+	// is, whole
+	next := payload(3*MaxDatagramPayload, 2)
+	if err := client.WriteUnreliable(next); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWithin(t, server, 2*time.Second); !bytes.Equal(got, next) {
+		t.Fatalf("got %d bytes, want the %d byte frame after the lost one", len(got), len(next))
+	}
+
+	// a frame left incomplete is given up on after FrameTimeout
+	link.setDrop(func(toServer bool, kind uint8, seq uint32, index uint16) bool {
+		return toServer && kind == kindFragment && index == 2
+	})
+	if err := client.WriteUnreliable(payload(5*MaxDatagramPayload, 3)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lost:
+	case <-time.After(10 * FrameTimeout):
+		t.Fatal("OnFrameLost wasn't called for an incomplete frame")
+	}
+}
+
+func TestDatagramRetransmit(t *testing.T) {
+	client, server, link := datagramPair(t)
+
+	// lose the first two tries of the first message and the first ack of
+	// the second, so one is resent until it gets through and the other
+	// arrives twice
+	client.mu.Lock()
+	first := client.sendSeq + 1
+	client.mu.Unlock()
+
+	tries := map[uint32]int{}
+	link.setDrop(func(toServer bool, kind uint8, seq uint32, index uint16) bool {
+		switch {
+		case toServer && kind == kindReliable && seq == first:
+			tries[seq]++
+			return tries[seq] <= 2
+		case !toServer && kind == kindAck && seq == first+1:
+			tries[seq]++
+			return tries[seq] == 1
+		}
+		return false
+	})
+
+	sent := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	for _, data := range sent {
+		if err := client.WriteReliable(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range sent {
+		if got := readWithin(t, server, 20*RetransmitInterval); !bytes.Equal(got, want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	if !client.Flush(20 * RetransmitInterval) {
+		t.Fatal("reliable messages still unacknowledged")
+	}
+
+	server.SetReadDeadline(time.Now().Add(2 * RetransmitInterval))
+	if data, err := server.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %q, %v after the last message, want nothing", data, err)
+	}
+
+	if err := client.WriteReliable(make([]byte, MaxDatagramPayload+1)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversized reliable message: got %v", err)
+	}
+}
+
+func TestDatagramReadDeadline(t *testing.T) {
+	_, server, _ := datagramPair(t)
+
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := server.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: %v", err)
+	}
+}
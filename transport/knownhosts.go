@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Fingerprint identifies a certificate by its public key, in the same form as
+// ssh's, so a certificate renewed with the same key keeps its fingerprint.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// CertificateFingerprint is Fingerprint for a certificate about to be served.
+func CertificateFingerprint(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("empty certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(leaf), nil
+}
+
+// HostKeyError means a viewer presented a different certificate from the one
+// we trusted, or were told to trust, before.
+type HostKeyError struct {
+	Host string
+	Want string
+	Got  string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("WARNING: the certificate of %s has changed, someone may be impersonating it! "+
+		"Expected %s but got %s. If the viewer's certificate really changed, remove %s from the known hosts file",
+		e.Host, e.Want, e.Got, e.Host)
+}
+
+// KnownHosts remembers the certificate fingerprint of each viewer connected
+// to, like ssh's known_hosts. Each line of the file is a host and a
+// fingerprint; blank lines and lines starting with # are ignored.
+type KnownHosts struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// DefaultKnownHosts is the known_hosts file in our config directory.
+func DefaultKnownHosts() *KnownHosts {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return &KnownHosts{Path: filepath.Join(dir, "ghostviewer", "known_hosts")}
+}
+
+// Lookup returns the fingerprint trusted for host, if there is one.
+func (k *KnownHosts) Lookup(host string) (string, bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	f, err := os.Open(k.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == host {
+			return fields[1], true, nil
+		}
+	}
+
+	return "", false, scanner.Err()
+}
+
+// Add trusts fingerprint for host from now on.
+func (k *KnownHosts) Add(host string, fingerprint string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(k.Path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(k.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s %s\n", host, fingerprint)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// PinnedTLSConfig accepts the viewer's self-signed certificate only if its
+// fingerprint is pin or, without a pin, the one known for host. A host seen
+// for the first time is trusted and remembered, and its fingerprint printed
+// so it can be checked against the one the viewer shows. known may be nil to
+// use DefaultKnownHosts.
+func PinnedTLSConfig(host string, pin string, known *KnownHosts) *tls.Config {
+	if known == nil {
+		known = DefaultKnownHosts()
+	}
+
+	return &tls.Config{
+		// the chain can't be verified, as the certificate is self-signed;
+		// the fingerprint check below stands in for it
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			got, err := leafFingerprint(rawCerts)
+			if err != nil {
+				return err
+			}
+
+			if pin != "" {
+				if got != pin {
+					return &HostKeyError{Host: host, Want: pin, Got: got}
+				}
+				return nil
+			}
+
+			want, ok, err := known.Lookup(host)
+			if err != nil {
+				return fmt.Errorf("reading known hosts: %w", err)
+			}
+
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Trusting %s on first use, certificate fingerprint %s\n", host, got)
+				if err := known.Add(host, got); err != nil {
+					fmt.Fprintf(os.Stderr, "Could not save %s to %s: %s\n", host, known.Path, err)
+				}
+				return nil
+			}
+
+			if got != want {
+				return &HostKeyError{Host: host, Want: want, Got: got}
+			}
+			return nil
+		},
+	}
+}
+
+// PinCertificate returns a copy of conf that, on top of its own checks, only
+// accepts a viewer whose certificate's fingerprint is pin, so a pin still
+// counts when the viewer's certificate is also checked against a CA. conf is
+// returned as it is if it is nil or pin is empty.
+func PinCertificate(conf *tls.Config, host string, pin string) *tls.Config {
+	if conf == nil || pin == "" {
+		return conf
+	}
+
+	conf = conf.Clone()
+	verify := conf.VerifyPeerCertificate
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+
+		got, err := leafFingerprint(rawCerts)
+		if err != nil {
+			return err
+		}
+		if got != pin {
+			return &HostKeyError{Host: host, Want: pin, Got: got}
+		}
+		return nil
+	}
+	return conf
+}
+
+func leafFingerprint(rawCerts [][]byte) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("viewer sent no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(cert), nil
+}
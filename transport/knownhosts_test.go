@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// dialTLS runs a TLS handshake with a server using serverConf over loopback.
+// A pipe won't do, as a client that rejects the certificate blocks sending
+// its alert while the server blocks sending the rest of its handshake.
+func dialTLS(serverConf *tls.Config, clientConf *tls.Config) error {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConf)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	known := &KnownHosts{Path: filepath.Join(t.TempDir(), "known_hosts")}
+	viewer := selfSignedConfig(t)
+
+	for i := 0; i < 2; i++ {
+		if err := dialTLS(viewer, PinnedTLSConfig("viewer:443", "", known)); err != nil {
+			t.Fatalf("connect %d: %v", i+1, err)
+		}
+	}
+
+	want, _ := CertificateFingerprint(viewer.Certificates[0])
+	if got, ok, err := known.Lookup("viewer:443"); err != nil || !ok || got != want {
+		t.Fatalf("known as %q, %v, %v, want %q", got, ok, err, want)
+	}
+
+	// someone else answering at the same address
+	var keyErr *HostKeyError
+	err := dialTLS(selfSignedConfig(t), PinnedTLSConfig("viewer:443", "", known))
+	if !errors.As(err, &keyErr) || keyErr.Want != want {
+		t.Fatalf("impostor: %v", err)
+	}
+
+	// a different host is trusted on its own first use
+	if err := dialTLS(selfSignedConfig(t), PinnedTLSConfig("other:443", "", known)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinnedFingerprint(t *testing.T) {
+	known := &KnownHosts{Path: filepath.Join(t.TempDir(), "known_hosts")}
+	viewer := selfSignedConfig(t)
+	pin, err := CertificateFingerprint(viewer.Certificates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialTLS(viewer, PinnedTLSConfig("viewer:443", pin, known)); err != nil {
+		t.Fatal(err)
+	}
+
+	var keyErr *HostKeyError
+	if err := dialTLS(selfSignedConfig(t), PinnedTLSConfig("viewer:443", pin, known)); !errors.As(err, &keyErr) {
+		t.Fatalf("wrong certificate: %v", err)
+	}
+
+	// a pin is checked, not remembered
+	if _, ok, _ := known.Lookup("viewer:443"); ok {
+		t.Fatal("pinned host added to known hosts")
+	}
+
+	l, err := ListenQUIC("127.0.0.1:0", selfSignedConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+
+	if _, err := DialQUIC(l.Addr().String(), PinnedTLSConfig(l.Addr().String(), pin, known)); !errors.As(err, &keyErr) {
+		t.Fatalf("wrong certificate over QUIC: %v", err)
+	}
+}
+
+func TestPinCertificate(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenerateCertificates(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ClientTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.ServerName = "localhost"
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, ServerCertFile), filepath.Join(dir, ServerKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := &tls.Config{Certificates: []tls.Certificate{cert}}
+	pin, err := CertificateFingerprint(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialTLS(viewer, PinCertificate(ca, "viewer:443", pin)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the CA vouches for the certificate, but it isn't the one pinned
+	other, err := CertificateFingerprint(selfSignedConfig(t).Certificates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyErr *HostKeyError
+	if err := dialTLS(viewer, PinCertificate(ca, "viewer:443", other)); !errors.As(err, &keyErr) {
+		t.Fatalf("wrong pin: %v", err)
+	}
+	if ca.VerifyPeerCertificate != nil {
+		t.Fatal("PinCertificate changed the config it was given")
+	}
+}
@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"errors"
+	"ghostviewer/protocol"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateDisconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// StateEvent is delivered to Events subscribers whenever a link changes
+// state. Err explains why a link went down.
+type StateEvent struct {
+	State State
+	Err   error
+}
+
+// Heartbeat configures how often pings are sent and how long a peer may stay
+// silent before it is considered dead.
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+var DefaultHeartbeat = Heartbeat{Interval: 2 * time.Second, Timeout: 10 * time.Second}
+
+var ErrHeartbeatTimeout = errors.New("peer stopped responding to heartbeats")
+
+// Link tracks the state of one transport connection and runs its heartbeat.
+// The zero value is ready to use and starts out connecting.
+type Link struct {
+	mu       sync.Mutex
+	state    State
+	err      error
+	lastSeen time.Time
+	watchers []chan StateEvent
+	stop     chan struct{}
+}
+
+// Events returns a channel that receives the current state immediately and
+// every change after that.
+func (l *Link) Events() <-chan StateEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ch := make(chan StateEvent, 16)
+	ch <- StateEvent{State: l.state, Err: l.err}
+	l.watchers = append(l.watchers, ch)
+	return ch
+}
+
+func (l *Link) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+func (l *Link) Connected() bool {
+	return l.State() == StateConnected
+}
+
+func (l *Link) SetState(state State, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.state == state {
+		return
+	}
+
+	l.state = state
+	l.err = err
+	if state == StateConnected {
+		l.lastSeen = time.Now()
+		l.stop = make(chan struct{})
+	} else if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+
+	event := StateEvent{State: state, Err: err}
+	for _, w := range l.watchers {
+		select {
+		case w <- event:
+		default: // slow watcher, it will still see the latest State()
+		}
+	}
+}
+
+// Touch records that something arrived from the peer.
+func (l *Link) Touch() {
+	l.mu.Lock()
+	l.lastSeen = time.Now()
+	l.mu.Unlock()
+}
+
+// Intercept handles heartbeat control messages and answers clock requests so
+// they never reach the session. It reports whether msg was consumed.
+func (l *Link) Intercept(msg protocol.Message, send func(protocol.Message) error) bool {
+	l.Touch()
+
+	if clock, ok := msg.(protocol.Clock); ok && clock.Peer == 0 {
+		send(protocol.Clock{Origin: clock.Origin, Peer: time.Now().UnixNano()})
+		return true
+	}
+
+	control, ok := msg.(protocol.Control)
+	if !ok {
+		return false
+	}
+
+	switch control.Code {
+	case protocol.ControlPing:
+		send(protocol.Control{Code: protocol.ControlPong, Value: control.Value})
+		return true
+	case protocol.ControlPong:
+		return true
+	}
+
+	return false
+}
+
+// RunHeartbeat pings the peer every cfg.Interval until the link goes down.
+// If nothing arrives for cfg.Timeout, or a ping can't be sent, the link is
+// marked disconnected and onDead is called to tear down the connection.
+func (l *Link) RunHeartbeat(cfg Heartbeat, send func(protocol.Message) error, onDead func()) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultHeartbeat.Interval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHeartbeat.Timeout
+	}
+
+	l.mu.Lock()
+	stop := l.stop
+	l.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			silent := now.Sub(l.lastSeen)
+			l.mu.Unlock()
+
+			err := ErrHeartbeatTimeout
+			if silent < cfg.Timeout {
+				err = send(protocol.Control{Code: protocol.ControlPing, Value: uint64(now.UnixNano())})
+			}
+
+			if err != nil {
+				l.SetState(StateDisconnected, err)
+				onDead()
+				return
+			}
+		}
+	}
+}
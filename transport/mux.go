@@ -0,0 +1,544 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"ghostviewer/protocol"
+	"io"
+	"sync"
+)
+
+// A Mux splits one framed stream into channels, so a multi-megabyte frame no
+// longer holds up a keystroke queued behind it. Messages go out in chunks of
+// at most protocol.MaxChunkSize: urgent channels always go first, and bulk
+// channels take turns a chunk at a time. Each channel has a window of
+// messages the peer has yet to read, so a reader that falls behind on one
+// channel only stalls that channel.
+//
+// The control, input and video channels exist on both sides from the start.
+// Any others are opened by name with Open and picked up with Accept.
+const (
+	MuxControl uint16 = iota + 1
+	MuxInput
+	MuxVideo
+)
+
+// the dialer numbers the channels it opens with odd IDs from here and the
+// other side with even ones, so the two never pick the same one
+const firstOpenedChannel = 16
+
+// Opened channels are bounded so a peer can't make us hold more than
+// protocol.MaxPacketSize for all of them together: there may be at most
+// maxOpenedChannels open at once, by both sides, each holding at most
+// MaxChannelBuffer unread, and at most maxAcceptBacklog waiting for Accept.
+const (
+	maxOpenedChannels = 16
+	maxAcceptBacklog  = 4
+	MaxChannelBuffer  = protocol.MaxPacketSize / maxOpenedChannels
+)
+
+type Priority uint8
+
+const (
+	PriorityUrgent Priority = iota + 1
+	PriorityBulk
+)
+
+// window is how many messages may be sent on a channel before the peer has
+// read them. A bulk message may be a whole frame, so few of those are let
+// through at once.
+func window(priority Priority) int {
+	if priority == PriorityUrgent {
+		return 256
+	}
+	return 4
+}
+
+// maxMessage is the largest message an opened channel takes, such that a full
+// window of them fits in MaxChannelBuffer. The built-in channels carry
+// protocol messages, which have limits of their own.
+func maxMessage(priority Priority) int {
+	return MaxChannelBuffer / window(priority)
+}
+
+var (
+	ErrMuxClosed     = errors.New("mux closed")
+	ErrChannelClosed = errors.New("channel closed")
+)
+
+type Mux struct {
+	writer *protocol.PacketWriter
+
+	mu        sync.Mutex
+	cond      *sync.Cond // broadcast whenever anything below changes
+	channels  map[uint16]*MuxChannel
+	opened    int  // channels in channels that aren't built in
+	accepting bool // Accept has been called, so opens from the peer are wanted
+	accepted  []*MuxChannel
+	nextID    uint16
+	busy      bool       // a packet is being written
+	turns     []*muxTurn // writers waiting for the stream
+	ticket    uint64
+	readErr   error
+	writeErr  error
+}
+
+// muxTurn is a writer waiting to send one packet. Urgent writers go first,
+// and otherwise whoever has waited longest.
+type muxTurn struct {
+	ticket uint64
+	urgent bool
+}
+
+// MuxChannel carries whole messages in order. Reads and writes may happen at
+// the same time, but only one goroutine should read.
+type MuxChannel struct {
+	mux      *Mux
+	id       uint16
+	name     string
+	priority Priority
+	writeMu  sync.Mutex // keeps one message's chunks from mixing with another's
+
+	// guarded by mux.mu
+	sendWindow   int
+	queue        [][]byte // messages received but not read
+	partial      []byte
+	receiving    bool // some chunks of a message have arrived
+	unread       int  // messages the peer has started sending that we haven't credited back
+	consumed     int  // messages read but not yet credited back
+	closed       bool
+	remoteClosed bool
+}
+
+// NewMux multiplexes the stream behind reader and writer, once the handshake
+// is done with them. dialer must be true on exactly one side.
+func NewMux(reader *protocol.PacketReader, writer *protocol.PacketWriter, dialer bool) *Mux {
+	m := &Mux{writer: writer, channels: make(map[uint16]*MuxChannel), nextID: firstOpenedChannel}
+	if dialer {
+		m.nextID++
+	}
+	m.cond = sync.NewCond(&m.mu)
+
+	m.newChannel(MuxControl, "control", PriorityUrgent)
+	m.newChannel(MuxInput, "input", PriorityUrgent)
+	m.newChannel(MuxVideo, "video", PriorityBulk)
+
+	go m.readLoop(reader)
+	return m
+}
+
+// newChannel must be called with m.mu held.
+func (m *Mux) newChannel(id uint16, name string, priority Priority) *MuxChannel {
+	c := &MuxChannel{mux: m, id: id, name: name, priority: priority, sendWindow: window(priority)}
+	m.channels[id] = c
+	if id >= firstOpenedChannel {
+		m.opened++
+	}
+	return c
+}
+
+// Channel returns one of the channels that exist from the start.
+func (m *Mux) Channel(id uint16) *MuxChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channels[id]
+}
+
+// Open starts a new channel, which the peer picks up with Accept. If the peer
+// isn't accepting channels it closes the new one straight away, so writes to
+// it fail with ErrChannelClosed and reads return io.EOF.
+func (m *Mux) Open(name string, priority Priority) (*MuxChannel, error) {
+	m.mu.Lock()
+	if m.nextID < firstOpenedChannel {
+		m.mu.Unlock()
+		return nil, errors.New("out of channel IDs")
+	}
+	if m.opened >= maxOpenedChannels {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("more than %d channels open", maxOpenedChannels)
+	}
+	c := m.newChannel(m.nextID, name, priority)
+	m.nextID += 2
+	m.mu.Unlock()
+
+	if err := m.send(true, protocol.Channel{Op: protocol.ChannelOpen, Channel: c.id, Value: uint32(priority), Name: name}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept returns the next channel the peer opens. Until it is first called,
+// or while maxAcceptBacklog channels are waiting for it, the peer's opens are
+// refused.
+func (m *Mux) Accept() (*MuxChannel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.accepting = true
+
+	for len(m.accepted) == 0 && m.readErr == nil {
+		m.cond.Wait()
+	}
+	if len(m.accepted) == 0 {
+		return nil, m.readErr
+	}
+
+	c := m.accepted[0]
+	m.accepted = m.accepted[1:]
+	return c, nil
+}
+
+// Read returns the next message on the control, input or video channel, in
+// that order of preference.
+func (m *Mux) Read() ([]byte, error) {
+	m.mu.Lock()
+	for {
+		for _, id := range []uint16{MuxControl, MuxInput, MuxVideo} {
+			c := m.channels[id]
+			if len(c.queue) > 0 {
+				return c.take()
+			}
+		}
+
+		if m.readErr != nil {
+			m.mu.Unlock()
+			return nil, m.readErr
+		}
+		m.cond.Wait()
+	}
+}
+
+// Write sends an encoded message on the channel for its type, as
+// QUICConn.Write picks a stream.
+func (m *Mux) Write(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("refusing to write empty packet")
+	}
+
+	id := MuxControl
+	switch protocol.MessageType(data[0]) {
+	case protocol.TypeFrame:
+		id = MuxVideo
+	case protocol.TypePointer, protocol.TypeKey, protocol.TypeScroll:
+		id = MuxInput
+	}
+
+	return m.Channel(id).Write(data)
+}
+
+// Close fails every read and write in progress. It leaves the stream itself
+// to its owner, whose closing it also stops the mux.
+func (m *Mux) Close() {
+	m.fail(ErrMuxClosed, ErrMuxClosed)
+}
+
+func (m *Mux) fail(readErr error, writeErr error) {
+	m.mu.Lock()
+	if m.readErr == nil {
+		m.readErr = readErr
+	}
+	if m.writeErr == nil {
+		m.writeErr = writeErr
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+}
+
+// send writes one packet when its turn comes.
+func (m *Mux) send(urgent bool, msg protocol.Message) error {
+	data, err := protocol.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.ticket++
+	turn := &muxTurn{ticket: m.ticket, urgent: urgent}
+	m.turns = append(m.turns, turn)
+	for m.writeErr == nil && (m.busy || m.next() != turn) {
+		m.cond.Wait()
+	}
+
+	for i, t := range m.turns {
+		if t == turn {
+			m.turns = append(m.turns[:i], m.turns[i+1:]...)
+			break
+		}
+	}
+	if m.writeErr != nil {
+		err := m.writeErr
+		m.cond.Broadcast()
+		m.mu.Unlock()
+		return err
+	}
+	m.busy = true
+	m.mu.Unlock()
+
+	err = m.writer.WritePacket(data)
+
+	m.mu.Lock()
+	m.busy = false
+	if err != nil && m.writeErr == nil {
+		m.writeErr = err
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	return err
+}
+
+// next picks the waiting writer to go next. m.mu must be held.
+func (m *Mux) next() *muxTurn {
+	var best *muxTurn
+	for _, t := range m.turns {
+		if best == nil || (t.urgent && !best.urgent) || (t.urgent == best.urgent && t.ticket < best.ticket) {
+			best = t
+		}
+	}
+	return best
+}
+
+func (m *Mux) readLoop(reader *protocol.PacketReader) {
+	for {
+		data, err := reader.ReadPacket()
+		var msg protocol.Message
+		if err == nil {
+			msg, err = protocol.Decode(data)
+		}
+		if err == nil {
+			err = m.handle(msg)
+		}
+
+		if err != nil {
+			// writes still work, so the error can be reported to the peer
+			m.fail(err, nil)
+			return
+		}
+	}
+}
+
+func (m *Mux) handle(msg protocol.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.cond.Broadcast()
+
+	switch msg := msg.(type) {
+	case protocol.Chunk:
+		c := m.channels[msg.Channel]
+		if c == nil || c.remoteClosed {
+			return muxErrorf("chunk on unknown channel %d", msg.Channel)
+		}
+		if c.closed {
+			// sent before the peer heard we closed it, and read by nobody
+			return nil
+		}
+
+		if !c.receiving {
+			c.receiving = true
+			c.unread++
+			if c.unread > window(c.priority) {
+				return muxErrorf("more than %d unread messages on channel %d", window(c.priority), c.id)
+			}
+		}
+
+		// the built-in channels carry protocol messages, whose limits apply
+		// as they arrive rather than once they are all buffered. Other
+		// channels carry whatever their feature likes.
+		size := len(c.partial) + len(msg.Data)
+		first := c.partial
+		if len(first) == 0 {
+			first = msg.Data
+		}
+		if c.id < firstOpenedChannel && len(first) > 0 {
+			if err := protocol.CheckSize(protocol.MessageType(first[0]), size); err != nil {
+				return err
+			}
+		} else if size > maxMessage(c.priority) {
+			return muxErrorf("message on channel %d exceeds %d bytes", c.id, maxMessage(c.priority))
+		}
+
+		if msg.Last {
+			data := msg.Data
+			if len(c.partial) > 0 {
+				data = append(c.partial, msg.Data...)
+			}
+			if len(data) == 0 {
+				return muxErrorf("empty message on channel %d", c.id)
+			}
+			c.queue = append(c.queue, data)
+			c.partial, c.receiving = nil, false
+		} else {
+			c.partial = append(c.partial, msg.Data...)
+		}
+	case protocol.Channel:
+		c := m.channels[msg.Channel]
+		switch msg.Op {
+		case protocol.ChannelOpen:
+			priority := Priority(msg.Value)
+			if c != nil || msg.Channel < firstOpenedChannel || msg.Channel%2 == m.nextID%2 {
+				return muxErrorf("peer opened channel %d, which isn't its to open", msg.Channel)
+			}
+			if priority != PriorityUrgent && priority != PriorityBulk {
+				return muxErrorf("channel %d has unknown priority %d", msg.Channel, priority)
+			}
+			if m.opened >= maxOpenedChannels {
+				return muxErrorf("more than %d channels open", maxOpenedChannels)
+			}
+
+			c := m.newChannel(msg.Channel, msg.Name, priority)
+			if !m.accepting || len(m.accepted) >= maxAcceptBacklog {
+				// the channel is kept until the peer closes its side too, so
+				// refused channels count against maxOpenedChannels as well
+				c.closed = true
+				go m.send(true, protocol.Channel{Op: protocol.ChannelClose, Channel: c.id})
+				return nil
+			}
+			m.accepted = append(m.accepted, c)
+		case protocol.ChannelClose:
+			if c == nil {
+				return muxErrorf("close of unknown channel %d", msg.Channel)
+			}
+			c.remoteClosed = true
+			c.forget()
+		case protocol.ChannelWindow:
+			if c == nil {
+				// we may have closed it since
+				return nil
+			}
+			c.sendWindow += int(msg.Value)
+		default:
+			return muxErrorf("unknown channel op %d", msg.Op)
+		}
+	default:
+		return muxErrorf("%s message outside a channel", msg.Type())
+	}
+
+	return nil
+}
+
+func muxErrorf(format string, args ...interface{}) error {
+	return &protocol.ProtocolError{Reason: fmt.Sprintf(format, args...)}
+}
+
+func (c *MuxChannel) ID() uint16   { return c.id }
+func (c *MuxChannel) Name() string { return c.name }
+
+// Read returns the next message, or io.EOF once the peer has closed the
+// channel and everything it sent has been read.
+func (c *MuxChannel) Read() ([]byte, error) {
+	m := c.mux
+	m.mu.Lock()
+	for len(c.queue) == 0 && !c.remoteClosed && !c.closed && m.readErr == nil {
+		m.cond.Wait()
+	}
+
+	switch {
+	case len(c.queue) > 0:
+		return c.take()
+	case c.closed:
+		m.mu.Unlock()
+		return nil, ErrChannelClosed
+	case c.remoteClosed:
+		m.mu.Unlock()
+		return nil, io.EOF
+	}
+
+	err := m.readErr
+	m.mu.Unlock()
+	return nil, err
+}
+
+// take pops the next message, crediting the peer's window back in batches
+// rather than once a message. It is called with mux.mu held and releases it.
+func (c *MuxChannel) take() ([]byte, error) {
+	m := c.mux
+	data := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+
+	credit := 0
+	c.consumed++
+	if c.consumed >= (window(c.priority)+1)/2 {
+		credit, c.consumed = c.consumed, 0
+		c.unread -= credit
+	}
+	m.mu.Unlock()
+
+	if credit > 0 {
+		// a failed write shows up on the next read or write anyway
+		m.send(true, protocol.Channel{Op: protocol.ChannelWindow, Channel: c.id, Value: uint32(credit)})
+	}
+	return data, nil
+}
+
+// Write sends one message, waiting while the peer has too many unread on this
+// channel. Messages on opened channels may be at most MaxChannelBuffer divided
+// by the channel's window.
+func (c *MuxChannel) Write(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("refusing to write empty message")
+	}
+	if c.id >= firstOpenedChannel && len(data) > maxMessage(c.priority) {
+		return fmt.Errorf("%w: %d byte message on channel %d", ErrTooLarge, len(data), c.id)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	m := c.mux
+	m.mu.Lock()
+	for c.sendWindow == 0 && !c.closed && !c.remoteClosed && m.writeErr == nil {
+		m.cond.Wait()
+	}
+	err := m.writeErr
+	if c.closed || c.remoteClosed {
+		err = ErrChannelClosed
+	}
+	if err == nil {
+		c.sendWindow--
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	urgent := c.priority == PriorityUrgent
+	for len(data) > 0 {
+		n := len(data)
+		if n > protocol.MaxChunkSize {
+			n = protocol.MaxChunkSize
+		}
+
+		if err := m.send(urgent, protocol.Chunk{Channel: c.id, Last: n == len(data), Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// Close tells the peer nothing more will be sent and drops anything unread.
+func (c *MuxChannel) Close() error {
+	m := c.mux
+	m.mu.Lock()
+	if c.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.queue, c.partial = nil, nil
+	c.forget()
+	m.cond.Broadcast()
+	m.mu.Unlock()
+
+	return m.send(true, protocol.Channel{Op: protocol.ChannelClose, Channel: c.id})
+}
+
+// forget frees the channel's ID once both sides have closed it. mux.mu must
+// be held.
+func (c *MuxChannel) forget() {
+	if c.closed && c.remoteClosed && c.id >= firstOpenedChannel {
+		delete(c.mux.channels, c.id)
+		c.mux.opened--
+	}
+}
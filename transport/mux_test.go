@@ -0,0 +1,271 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"ghostviewer/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowReader makes a big message take a while to arrive, so there is time
+// for something else to overtake it.
+type slowReader struct {
+	net.Conn
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return r.Conn.Read(p)
+}
+
+func muxPair(t *testing.T) (*Mux, *Mux) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	dialer := NewMux(protocol.NewPacketReader(a), protocol.NewPacketWriter(a), true)
+	acceptor := NewMux(protocol.NewPacketReader(slowReader{b}), protocol.NewPacketWriter(b), false)
+	return dialer, acceptor
+}
+
+// acceptNext picks up the next channel the peer opens on m, returning once m
+// is accepting so the open isn't refused.
+func acceptNext(t *testing.T, m *Mux) <-chan *MuxChannel {
+	accepted := make(chan *MuxChannel, 1)
+	go func() {
+		c, err := m.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+
+	for {
+		m.mu.Lock()
+		accepting := m.accepting
+		m.mu.Unlock()
+		if accepting {
+			return accepted
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMuxInputOvertakesFrame(t *testing.T) {
+	dialer, acceptor := muxPair(t)
+
+	frame, err := protocol.Marshal(protocol.Frame{Width: 2048, Height: 2048, Pix: make([]byte, 2048*2048*4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := protocol.Marshal(protocol.Key{Kind: 1, Char: 'a'})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go dialer.Write(frame)
+	// let the frame start before the key is queued behind it
+	time.Sleep(10 * time.Millisecond)
+	go dialer.Write(key)
+
+	data, err := acceptor.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, key) {
+		t.Fatalf("read a %d byte message before the key", len(data))
+	}
+
+	data, err = acceptor.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, frame) {
+		t.Fatal("frame reassembled wrongly")
+	}
+}
+
+func TestMuxWindow(t *testing.T) {
+	dialer, acceptor := muxPair(t)
+	next := acceptNext(t, acceptor)
+
+	c, err := dialer.Open("bulk", PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < window(PriorityBulk); i++ {
+		if err := c.Write([]byte{byte(protocol.TypeControl), byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	written := make(chan error, 1)
+	go func() { written <- c.Write([]byte{byte(protocol.TypeControl), 0xff}) }()
+	select {
+	case err := <-written:
+		t.Fatalf("wrote past the window: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	accepted := <-next
+	if accepted.Name() != "bulk" || accepted.ID() != c.ID() {
+		t.Fatalf("accepted %q %d, opened %q %d", accepted.Name(), accepted.ID(), c.Name(), c.ID())
+	}
+
+	for i := 0; i <= window(PriorityBulk); i++ {
+		data, err := accepted.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := byte(i)
+		if i == window(PriorityBulk) {
+			want = 0xff
+		}
+		if data[1] != want {
+			t.Fatalf("read message %d, want %d", data[1], want)
+		}
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	dialer, acceptor := muxPair(t)
+	next := acceptNext(t, dialer)
+
+	c, err := acceptor.Open("clipboard", PriorityUrgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID()%2 != 0 {
+		t.Fatalf("acceptor opened odd channel %d", c.ID())
+	}
+	if err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write([]byte("again")); !errors.Is(err, ErrChannelClosed) {
+		t.Fatalf("write after close: %v", err)
+	}
+
+	accepted := <-next
+	if data, err := accepted.Read(); err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if _, err := accepted.Read(); err != io.EOF {
+		t.Fatalf("read after close: %v", err)
+	}
+}
+
+func TestMuxProtocolError(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	m := NewMux(protocol.NewPacketReader(a), protocol.NewPacketWriter(a), true)
+	go protocol.NewPacketWriter(b).WriteMessage(protocol.Chunk{Channel: 99, Last: true, Data: []byte{1}})
+
+	var protoErr *protocol.ProtocolError
+	if _, err := m.Read(); !errors.As(err, &protoErr) {
+		t.Fatalf("chunk on unknown channel: %v", err)
+	}
+}
+
+func TestMuxRefusesUnaccepted(t *testing.T) {
+	dialer, _ := muxPair(t)
+
+	c, err := dialer.Open("unwanted", PriorityUrgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(); err != io.EOF {
+		t.Fatalf("read from refused channel: %v", err)
+	}
+	if err := c.Write([]byte("hello")); !errors.Is(err, ErrChannelClosed) {
+		t.Fatalf("write to refused channel: %v", err)
+	}
+}
+
+func TestMuxAcceptBacklog(t *testing.T) {
+	dialer, acceptor := muxPair(t)
+	acceptor.mu.Lock()
+	acceptor.accepting = true
+	acceptor.mu.Unlock()
+
+	var opened []*MuxChannel
+	for i := 0; i <= maxAcceptBacklog; i++ {
+		c, err := dialer.Open("queued", PriorityUrgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened = append(opened, c)
+	}
+
+	// the ones that fit in the backlog are kept, the one after is refused
+	if _, err := opened[maxAcceptBacklog].Read(); err != io.EOF {
+		t.Fatalf("read from channel past the backlog: %v", err)
+	}
+	for _, c := range opened[:maxAcceptBacklog] {
+		accepted, err := acceptor.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted.ID() != c.ID() {
+			t.Fatalf("accepted channel %d, want %d", accepted.ID(), c.ID())
+		}
+	}
+}
+
+func TestMuxChannelLimits(t *testing.T) {
+	dialer, _ := muxPair(t)
+
+	c, err := dialer.Open("bulk", PriorityBulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(make([]byte, maxMessage(PriorityBulk)+1)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversized message: %v", err)
+	}
+
+	for i := 1; i < maxOpenedChannels; i++ {
+		if _, err := dialer.Open("more", PriorityUrgent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dialer.Open("one too many", PriorityUrgent); err == nil {
+		t.Fatalf("opened more than %d channels", maxOpenedChannels)
+	}
+}
+
+func TestMuxTooManyOpens(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	m := NewMux(protocol.NewPacketReader(a), protocol.NewPacketWriter(a), true)
+	go func() {
+		w := protocol.NewPacketWriter(b)
+		for i := 0; i <= maxOpenedChannels; i++ {
+			open := protocol.Channel{Op: protocol.ChannelOpen, Channel: uint16(firstOpenedChannel + 2*i), Value: uint32(PriorityUrgent)}
+			if err := w.WriteMessage(open); err != nil {
+				return
+			}
+		}
+	}()
+	// the refusals have to go somewhere
+	go io.Copy(io.Discard, b)
+
+	var protoErr *protocol.ProtocolError
+	if _, err := m.Read(); !errors.As(err, &protoErr) {
+		t.Fatalf("%d opens: %v", maxOpenedChannels+1, err)
+	}
+}
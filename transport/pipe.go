@@ -0,0 +1,222 @@
+package transport
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pipeBufferSize is how much each direction of a pipe holds before writes
+// block, like a socket's send buffer.
+const pipeBufferSize = 256 << 10
+
+// PipeListener is an in-memory net.Listener. Dial hands one end of a pipe to
+// Accept and returns the other, so a sharer and viewer can run in one process
+// without sockets.
+type PipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Dial blocks until the other end is accepted.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	local, remote := newPipe()
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		local.Close()
+		remote.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeConn is one end of an in-memory connection. Unlike net.Pipe each
+// direction is buffered, so both ends can write at once as they can over a
+// socket without either waiting for the other to read.
+type pipeConn struct {
+	in        *pipeBuffer
+	out       *pipeBuffer
+	binding   []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipe() (net.Conn, net.Conn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+
+	// nobody can get between the two ends of a pipe, so all the binding has
+	// to do is differ from any other pipe's
+	binding := make([]byte, bindingSize)
+	if _, err := rand.Read(binding); err != nil {
+		panic(err)
+	}
+
+	return &pipeConn{in: a, out: b, binding: binding, closed: make(chan struct{})}, &pipeConn{in: b, out: a, binding: binding, closed: make(chan struct{})}
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.in.read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.out.write(p)
+}
+
+// Close stops both directions. The other end can still read what was
+// written before it, then gets io.EOF.
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.in.close()
+		c.out.close()
+	})
+	return nil
+}
+
+func (c *pipeConn) ChannelBinding() []byte { return c.binding }
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op; writes only block while the reader is behind.
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type pipeBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.data) == 0 && !b.closed {
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	b.cond.Broadcast()
+	return n, nil
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		for len(b.data) >= pipeBufferSize && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			return n, io.ErrClosedPipe
+		}
+
+		k := len(p)
+		if room := pipeBufferSize - len(b.data); k > room {
+			k = room
+		}
+		b.data = append(b.data, p[:k]...)
+		p = p[k:]
+		n += k
+		b.cond.Broadcast()
+	}
+
+	return n, nil
+}
+
+func (b *pipeBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (b *pipeBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
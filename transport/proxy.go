@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const dialTimeout = 10 * time.Second
+
+// proxyEnv lists the variables consulted for an outbound proxy, in order.
+var proxyEnv = []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"}
+
+// ParseProxy parses an http:// or socks5:// proxy URL. Credentials may be
+// given as user:pass@host. A bare host:port is taken as an HTTP proxy. Without
+// a port, HTTP proxies default to 8080 and SOCKS5 ones to 1080.
+func ParseProxy(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", raw, err)
+	}
+
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", raw)
+	}
+
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "8080"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	return u, nil
+}
+
+// ProxyFromEnvironment returns the proxy named by HTTPS_PROXY or ALL_PROXY,
+// or nil if neither is set.
+func ProxyFromEnvironment() (*url.URL, error) {
+	for _, name := range proxyEnv {
+		if raw := os.Getenv(name); raw != "" {
+			return ParseProxy(raw)
+		}
+	}
+
+	return nil, nil
+}
+
+// DialTCP connects to addr through proxy. A nil proxy falls back to the one
+// named in the environment, and to a direct connection if there is none.
+func DialTCP(proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL == nil {
+		var err error
+		if proxyURL, err = ProxyFromEnvironment(); err != nil {
+			return nil, err
+		}
+	}
+
+	if proxyURL == nil {
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	}
+
+	if proxyURL.Scheme == "http" {
+		return dialConnect(proxyURL, addr)
+	}
+
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, &net.Dialer{Timeout: dialTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %w", proxyURL.Host, err)
+	}
+
+	return conn, nil
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialConnect(proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", proxyURL.Host, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s refused tunnel: %s", proxyURL.Host, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn keeps bytes the proxy sent right after its response, which
+// already belong to the tunnelled stream.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func listen(t *testing.T, handle func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func splice(a net.Conn, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
+
+// connectProxy is a stand-in HTTP proxy that requires user:pass.
+func connectProxy(t *testing.T) string {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	return listen(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			conn.Close()
+			return
+		}
+
+		if req.Header.Get("Proxy-Authorization") != want {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			conn.Close()
+			return
+		}
+
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			conn.Close()
+			return
+		}
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		splice(conn, target)
+	})
+}
+
+// socksProxy is a stand-in SOCKS5 proxy that requires user:pass.
+func socksProxy(t *testing.T) string {
+	return listen(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		fail := func() { conn.Close() }
+
+		// greeting: version, methods; pick username/password
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			fail()
+			return
+		}
+		if _, err := io.ReadFull(r, make([]byte, header[1])); err != nil {
+			fail()
+			return
+		}
+		conn.Write([]byte{5, 2})
+
+		// auth: version, user, password
+		readField := func() string {
+			n, _ := r.ReadByte()
+			b := make([]byte, n)
+			io.ReadFull(r, b)
+			return string(b)
+		}
+		r.ReadByte()
+		user, pass := readField(), readField()
+		if user != "user" || pass != "pass" {
+			conn.Write([]byte{1, 1})
+			fail()
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		// request: version, connect, reserved, address type, address, port
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(r, request); err != nil {
+			fail()
+			return
+		}
+
+		var host string
+		switch request[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(r, ip)
+			host = net.IP(ip).String()
+		case 3:
+			host = readField()
+		default:
+			fail()
+			return
+		}
+
+		port := make([]byte, 2)
+		io.ReadFull(r, port)
+
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			fail()
+			return
+		}
+
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		splice(conn, target)
+	})
+}
+
+func roundTrip(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ghost")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "ghost" {
+		t.Fatalf("got %q through tunnel", got)
+	}
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	target := listen(t, echo)
+
+	tests := []struct {
+		scheme string
+		addr   string
+	}{
+		{"http", connectProxy(t)},
+		{"socks5", socksProxy(t)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scheme, func(t *testing.T) {
+			good, _ := url.Parse(test.scheme + "://user:pass@" + test.addr)
+			conn, err := DialTCP(good, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roundTrip(t, conn)
+
+			bad, _ := url.Parse(test.scheme + "://user:wrong@" + test.addr)
+			if conn, err := DialTCP(bad, target); err == nil {
+				conn.Close()
+				t.Fatal("dial succeeded with wrong password")
+			}
+		})
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	target := listen(t, echo)
+	proxy := socksProxy(t)
+
+	for _, name := range proxyEnv {
+		t.Setenv(name, "")
+	}
+
+	if u, err := ProxyFromEnvironment(); u != nil || err != nil {
+		t.Fatalf("got %v, %v with no proxy set", u, err)
+	}
+
+	t.Setenv("ALL_PROXY", "socks5://user:pass@"+proxy)
+	conn, err := DialTCP(nil, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+
+	// HTTPS_PROXY wins over ALL_PROXY
+	t.Setenv("HTTPS_PROXY", connectProxy(t))
+	u, err := ProxyFromEnvironment()
+	if err != nil || u.Scheme != "http" {
+		t.Fatalf("got %v, %v", u, err)
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"proxy.corp:3128", "http://proxy.corp:3128"},
+		{"socks5://u:p@10.0.0.1", "socks5://u:p@10.0.0.1:1080"},
+		{"socks5h://proxy.corp", "socks5h://proxy.corp:1080"},
+		{"http://proxy.corp", "http://proxy.corp:8080"},
+		{"proxy.corp", "http://proxy.corp:8080"},
+	}
+
+	for _, test := range tests {
+		u, err := ParseProxy(test.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u.String() != test.want {
+			t.Errorf("ParseProxy(%q) = %s, want %s", test.raw, u, test.want)
+		}
+	}
+
+	if _, err := ParseProxy("ftp://proxy"); err == nil {
+		t.Error("accepted ftp proxy")
+	}
+}
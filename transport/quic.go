@@ -0,0 +1,274 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"ghostviewer/protocol"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// A QUIC connection carries one stream per kind of traffic, so a large frame
+// queued on the video stream never holds up a click on the input stream. The
+// dialer opens all three and announces each with a single kind byte.
+const (
+	streamControl uint8 = iota + 1
+	streamInput
+	streamVideo
+)
+
+const quicALPN = "ghostviewer"
+
+const quicSetupTimeout = 10 * time.Second
+
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:             30 * time.Second,
+	KeepAlivePeriod:            5 * time.Second,
+	MaxStreamReceiveWindow:     protocol.MaxFrameSize,
+	MaxConnectionReceiveWindow: 2 * protocol.MaxFrameSize,
+}
+
+var ErrQUICClosed = errors.New("quic connection closed")
+
+// QUICConn exchanges encoded messages over a QUIC connection, picking the
+// stream for each message from its type.
+type QUICConn struct {
+	conn     quic.Connection
+	writers  map[uint8]*protocol.PacketWriter
+	incoming chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+}
+
+func newQUICConn(conn quic.Connection, streams map[uint8]quic.Stream) *QUICConn {
+	c := &QUICConn{
+		conn:     conn,
+		writers:  make(map[uint8]*protocol.PacketWriter),
+		incoming: make(chan []byte, 64),
+		closed:   make(chan struct{}),
+	}
+
+	for kind, stream := range streams {
+		c.writers[kind] = protocol.NewPacketWriter(stream)
+		go c.readLoop(protocol.NewPacketReader(stream))
+	}
+
+	return c
+}
+
+// withALPN copies conf with the ghostviewer protocol name set, which QUIC
+// requires on both ends.
+func withALPN(conf *tls.Config) *tls.Config {
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+
+	conf = conf.Clone()
+	conf.NextProtos = []string{quicALPN}
+	return conf
+}
+
+// DialQUIC connects to addr and opens the control, input and video streams.
+func DialQUIC(addr string, tlsConf *tls.Config) (*QUICConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicSetupTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, addr, withALPN(tlsConf), quicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make(map[uint8]quic.Stream)
+	for _, kind := range []uint8{streamControl, streamInput, streamVideo} {
+		stream, err := conn.OpenStreamSync(ctx)
+		if err == nil {
+			_, err = stream.Write([]byte{kind})
+		}
+
+		if err != nil {
+			conn.CloseWithError(0, "")
+			return nil, err
+		}
+
+		streams[kind] = stream
+	}
+
+	return newQUICConn(conn, streams), nil
+}
+
+// QUICListener accepts QUIC connections from sharers.
+type QUICListener struct {
+	ln *quic.Listener
+}
+
+func ListenQUIC(addr string, tlsConf *tls.Config) (*QUICListener, error) {
+	ln, err := quic.ListenAddr(addr, withALPN(tlsConf), quicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QUICListener{ln: ln}, nil
+}
+
+// Accept waits for a peer that opens all three streams. Peers that don't are
+// dropped, so only listener failures are returned.
+func (l *QUICListener) Accept() (*QUICConn, error) {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		streams, err := acceptStreams(conn)
+		if err != nil {
+			conn.CloseWithError(0, err.Error())
+			continue
+		}
+
+		return newQUICConn(conn, streams), nil
+	}
+}
+
+func acceptStreams(conn quic.Connection) (map[uint8]quic.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicSetupTimeout)
+	defer cancel()
+
+	streams := make(map[uint8]quic.Stream)
+	for len(streams) < 3 {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		kind := make([]byte, 1)
+		stream.SetReadDeadline(time.Now().Add(quicSetupTimeout))
+		if _, err := stream.Read(kind); err != nil {
+			return nil, err
+		}
+		stream.SetReadDeadline(time.Time{})
+
+		if kind[0] < streamControl || kind[0] > streamVideo || streams[kind[0]] != nil {
+			return nil, fmt.Errorf("unexpected stream kind %d", kind[0])
+		}
+
+		streams[kind[0]] = stream
+	}
+
+	return streams, nil
+}
+
+func (l *QUICListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *QUICListener) Close() error {
+	return l.ln.Close()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Read returns the next message from any stream.
+func (c *QUICConn) Read() ([]byte, error) {
+	c.deadlineMu.Lock()
+	deadline := c.readDeadline
+	c.deadlineMu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case data := <-c.incoming:
+		return data, nil
+	case <-c.closed:
+		return nil, c.err
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// SetReadDeadline makes Read calls started after it fail with
+// os.ErrDeadlineExceeded once t has passed. A zero t means no deadline.
+func (c *QUICConn) SetReadDeadline(t time.Time) {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+}
+
+// Write sends data on the stream for its message type.
+func (c *QUICConn) Write(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("refusing to write empty packet")
+	}
+
+	kind := streamControl
+	switch protocol.MessageType(data[0]) {
+	case protocol.TypeFrame:
+		kind = streamVideo
+	case protocol.TypePointer, protocol.TypeKey, protocol.TypeScroll:
+		kind = streamInput
+	}
+
+	return c.writers[kind].WritePacket(data)
+}
+
+// Linger gives the peer up to timeout to read what was written and hang up,
+// then closes. Closing straight away can discard data still in flight.
+func (c *QUICConn) Linger(timeout time.Duration) {
+	select {
+	case <-c.conn.Context().Done():
+	case <-time.After(timeout):
+	}
+
+	c.Close()
+}
+
+// ChannelBinding is the TLS exporter's binding for the connection.
+func (c *QUICConn) ChannelBinding() []byte {
+	state := c.conn.ConnectionState().TLS
+	return exportBinding(&state)
+}
+
+func (c *QUICConn) Close() error {
+	c.closeWith(ErrQUICClosed)
+	return c.conn.CloseWithError(0, "")
+}
+
+func (c *QUICConn) closeWith(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.closed)
+	})
+}
+
+func (c *QUICConn) readLoop(r *protocol.PacketReader) {
+	for {
+		data, err := r.ReadPacket()
+		if err != nil {
+			c.closeWith(err)
+			return
+		}
+
+		select {
+		case c.incoming <- data:
+		case <-c.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"ghostviewer/protocol"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func selfSignedConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestQUICLoopback(t *testing.T) {
+	l, err := ListenQUIC("127.0.0.1:0", selfSignedConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *QUICConn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	client, err := DialQUIC(l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+
+	// the frame and the click go out on different streams and both arrive
+	frame, _ := protocol.Marshal(protocol.Frame{Width: 1024, Height: 1024, Pix: make([]byte, 4<<20)})
+	click, _ := protocol.Marshal(protocol.Pointer{X: 5, Y: 6, Button: protocol.ButtonLeft, Action: protocol.PointerDown})
+
+	go client.Write(frame)
+	if err := client.Write(click); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[protocol.MessageType]bool{}
+	for len(got) < 2 {
+		data, err := server.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[protocol.MessageType(data[0])] = true
+	}
+
+	ping, _ := protocol.Marshal(protocol.Control{Code: protocol.ControlPing, Value: 1})
+	if err := server.Write(ping); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := client.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := protocol.Decode(data); err != nil || msg != (protocol.Control{Code: protocol.ControlPing, Value: 1}) {
+		t.Fatalf("got %v, %v", msg, err)
+	}
+
+	server.Close()
+	if _, err := client.Read(); err == nil {
+		t.Fatal("Read succeeded after peer closed")
+	}
+}
@@ -0,0 +1,344 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Both peers dial the relay and send a join packet naming their role and the
+// session ID from the invite code:
+//
+//	"GVR1" | role u8 | id length u8 | id
+//
+// The relay answers with a status byte once the pair is complete, or with a
+// refusal and a u8 length-prefixed reason, then splices the two connections
+// together without looking at what they carry.
+const relayMagic = "GVR1"
+
+const (
+	RelaySharer byte = 's'
+	RelayViewer byte = 'v'
+)
+
+const (
+	relayPaired byte = iota
+	relayRefused
+)
+
+const (
+	maxRelayIDLength = 64
+	maxWaitingPeers  = 4096
+	relayJoinTimeout = 10 * time.Second
+)
+
+var (
+	ErrInviteCode   = errors.New("invalid invite code, expected <id>-<secret>")
+	ErrRelayRefused = errors.New("relay refused")
+)
+
+var inviteEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewInviteCode returns a fresh "<id>-<secret>" code. The relay only ever
+// sees the ID; the secret keys the end to end encryption between the peers.
+func NewInviteCode() string {
+	id := make([]byte, 4)
+	secret := make([]byte, 10)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id) + "-" + strings.ToLower(inviteEncoding.EncodeToString(secret))
+}
+
+func parseInviteCode(code string) (id string, secret []byte, err error) {
+	id, encoded, ok := strings.Cut(code, "-")
+	if !ok || id == "" || len(id) > maxRelayIDLength {
+		return "", nil, ErrInviteCode
+	}
+
+	secret, err = inviteEncoding.DecodeString(strings.ToUpper(encoded))
+	if err != nil || len(secret) == 0 {
+		return "", nil, ErrInviteCode
+	}
+
+	return id, secret, nil
+}
+
+// DialRelay joins the session named by code on the relay at addr, waits for
+// the other side to join and returns an end to end encrypted connection to
+// it. The relay is reached through proxy, as with DialTCP.
+func DialRelay(proxy *url.URL, addr string, role byte, code string) (net.Conn, error) {
+	id, secret, err := parseInviteCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := DialTCP(proxy, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	join := append([]byte(relayMagic), role, byte(len(id)))
+	join = append(join, id...)
+	if _, err := conn.Write(join); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("relay %s: %w", addr, unexpected(err))
+	}
+
+	if status[0] != relayPaired {
+		reason, _ := readShortString(conn)
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrRelayRefused, reason)
+	}
+
+	secure, err := secureHandshake(conn, role, secret)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("relay %s: secure handshake: %w", addr, err)
+	}
+
+	return secure, nil
+}
+
+func readShortString(r io.Reader) (string, error) {
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return "", err
+	}
+
+	s := make([]byte, n[0])
+	_, err := io.ReadFull(r, s)
+	return string(s), err
+}
+
+// Relay pairs sharers with viewers that can't reach each other directly.
+type Relay struct {
+	Addr    string
+	MaxRate int // bytes per second in each direction of a pair, 0 for no cap
+
+	mu      sync.Mutex
+	waiting map[string]*relayPeer
+}
+
+type relayPeer struct {
+	conn   net.Conn
+	role   byte
+	paired chan net.Conn
+}
+
+func (r *Relay) ListenAndServe() error {
+	l, err := net.Listen("tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+
+	return r.Serve(l)
+}
+
+func (r *Relay) Serve(l net.Listener) error {
+	defer l.Close()
+
+	r.mu.Lock()
+	r.waiting = make(map[string]*relayPeer)
+	r.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go r.handle(conn)
+	}
+}
+
+func refuse(conn net.Conn, reason string) {
+	conn.Write(append([]byte{relayRefused, byte(len(reason))}, reason...))
+	conn.Close()
+}
+
+func (r *Relay) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(relayJoinTimeout))
+	header := make([]byte, len(relayMagic)+2)
+	if _, err := io.ReadFull(conn, header); err != nil || string(header[:len(relayMagic)]) != relayMagic {
+		conn.Close()
+		return
+	}
+
+	role := header[len(relayMagic)]
+	id := make([]byte, header[len(relayMagic)+1])
+	if _, err := io.ReadFull(conn, id); err != nil {
+		conn.Close()
+		return
+	}
+
+	if role != RelaySharer && role != RelayViewer {
+		refuse(conn, "unknown role")
+		return
+	}
+
+	r.mu.Lock()
+	other := r.waiting[string(id)]
+	if other == nil {
+		if len(r.waiting) >= maxWaitingPeers {
+			r.mu.Unlock()
+			refuse(conn, "relay is full")
+			return
+		}
+
+		self := &relayPeer{conn: conn, role: role, paired: make(chan net.Conn, 1)}
+		r.waiting[string(id)] = self
+		r.mu.Unlock()
+		r.wait(string(id), self)
+		return
+	}
+
+	if other.role == role {
+		r.mu.Unlock()
+		refuse(conn, "session already has a "+roleName(role))
+		return
+	}
+
+	delete(r.waiting, string(id))
+	r.mu.Unlock()
+
+	conn.SetReadDeadline(time.Time{})
+	other.paired <- conn
+}
+
+// wait holds a peer until its partner arrives, dropping it if it hangs up
+// first. The peer sends nothing until it hears back, so any read returning
+// means it has gone.
+func (r *Relay) wait(id string, self *relayPeer) {
+	self.conn.SetReadDeadline(time.Time{})
+
+	gone := make(chan struct{})
+	go func() {
+		self.conn.Read(make([]byte, 1))
+		close(gone)
+	}()
+
+	select {
+	case partner := <-self.paired:
+		// stop the watcher before the spliced stream starts
+		self.conn.SetReadDeadline(time.Now())
+		<-gone
+		self.conn.SetReadDeadline(time.Time{})
+		r.splice(id, self.conn, partner)
+	case <-gone:
+		r.mu.Lock()
+		if r.waiting[id] == self {
+			delete(r.waiting, id)
+			r.mu.Unlock()
+			self.conn.Close()
+			return
+		}
+		r.mu.Unlock()
+
+		// a partner claimed us as we hung up
+		self.conn.Close()
+		(<-self.paired).Close()
+	}
+}
+
+func (r *Relay) splice(id string, a net.Conn, b net.Conn) {
+	fmt.Printf("Relay: paired session %s (%s <-> %s)\n", id, a.RemoteAddr(), b.RemoteAddr())
+
+	for _, conn := range []net.Conn{a, b} {
+		if _, err := conn.Write([]byte{relayPaired}); err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	forward := func(dst net.Conn, src net.Conn) {
+		r.copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+
+	go forward(a, b)
+	go forward(b, a)
+	<-done
+	<-done
+	fmt.Printf("Relay: session %s ended\n", id)
+}
+
+func (r *Relay) copy(dst io.Writer, src io.Reader) {
+	if r.MaxRate <= 0 {
+		if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
+			fmt.Fprintf(os.Stderr, "Relay: %s\n", err)
+		}
+		return
+	}
+
+	limiter := newRateLimiter(r.MaxRate)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			limiter.wait(n)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func roleName(role byte) string {
+	if role == RelaySharer {
+		return "sharer"
+	}
+	return "viewer"
+}
+
+// rateLimiter is a token bucket holding up to one second's worth of bytes.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+}
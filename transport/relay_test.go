@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapListener records every byte the relay reads.
+type tapListener struct {
+	net.Listener
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+type tapConn struct {
+	net.Conn
+	l *tapListener
+}
+
+func (l *tapListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tapConn{Conn: conn, l: l}, nil
+}
+
+func (c *tapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.l.mu.Lock()
+	c.l.buf.Write(p[:n])
+	c.l.mu.Unlock()
+	return n, err
+}
+
+func startRelay(t *testing.T, maxRate int) (*tapListener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tap := &tapListener{Listener: l}
+	t.Cleanup(func() { tap.Close() })
+
+	relay := &Relay{MaxRate: maxRate}
+	go relay.Serve(tap)
+	return tap, l.Addr().String()
+}
+
+// pair dials both roles and returns the sharer and viewer ends.
+func pair(t *testing.T, addr string, sharerCode string, viewerCode string) (net.Conn, net.Conn) {
+	viewer := make(chan net.Conn, 1)
+	go func() {
+		conn, err := DialRelay(nil, addr, RelayViewer, viewerCode)
+		if err != nil {
+			t.Error(err)
+		}
+		viewer <- conn
+	}()
+
+	// let the viewer reach the relay first, as it normally would
+	time.Sleep(50 * time.Millisecond)
+	sharer, err := DialRelay(nil, addr, RelaySharer, sharerCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := <-viewer
+	if v == nil {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		sharer.Close()
+		v.Close()
+	})
+	return sharer, v
+}
+
+func TestRelayPairsAndEncrypts(t *testing.T) {
+	tap, addr := startRelay(t, 0)
+	code := NewInviteCode()
+	sharer, viewer := pair(t, addr, code, code)
+
+	secret := []byte("ghost frame payload")
+	if _, err := sharer.Write(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(secret))
+	if _, err := io.ReadFull(viewer, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, secret) {
+		t.Fatalf("viewer got %q", got)
+	}
+
+	if _, err := viewer.Write([]byte("click")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(sharer, got[:5]); err != nil || string(got[:5]) != "click" {
+		t.Fatalf("sharer got %q, %v", got[:5], err)
+	}
+
+	tap.mu.Lock()
+	seen := tap.buf.String()
+	tap.mu.Unlock()
+
+	id, _, _ := strings.Cut(code, "-")
+	if !strings.Contains(seen, id) {
+		t.Fatal("relay never saw the session id")
+	}
+
+	if strings.Contains(seen, string(secret)) || strings.Contains(seen, code) {
+		t.Fatal("relay saw plaintext or the invite secret")
+	}
+
+	binding := ChannelBinding(sharer)
+	if len(binding) != bindingSize || !bytes.Equal(binding, ChannelBinding(viewer)) {
+		t.Fatalf("sharer's channel binding %x, viewer's %x", binding, ChannelBinding(viewer))
+	}
+	if strings.Contains(seen, string(binding)) {
+		t.Fatal("relay saw the channel binding")
+	}
+}
+
+func TestRelayWrongSecret(t *testing.T) {
+	_, addr := startRelay(t, 0)
+	code := NewInviteCode()
+	id, _, _ := strings.Cut(code, "-")
+	_, forged, _ := strings.Cut(NewInviteCode(), "-")
+
+	sharer, viewer := pair(t, addr, id+"-"+forged, code)
+	if _, err := sharer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := viewer.Read(make([]byte, 5)); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("got %v, want ErrBadRecord", err)
+	}
+}
+
+func TestRelayRefusesSecondViewer(t *testing.T) {
+	_, addr := startRelay(t, 0)
+	code := NewInviteCode()
+
+	go DialRelay(nil, addr, RelayViewer, code)
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := DialRelay(nil, addr, RelayViewer, code); !errors.Is(err, ErrRelayRefused) {
+		t.Fatalf("got %v, want ErrRelayRefused", err)
+	}
+}
+
+func TestRelayRateLimit(t *testing.T) {
+	const rate = 50 << 10
+	_, addr := startRelay(t, rate)
+	code := NewInviteCode()
+	sharer, viewer := pair(t, addr, code, code)
+
+	// the bucket starts with a second's worth, so twice the rate takes
+	// about a second to get through
+	data := make([]byte, 2*rate)
+	start := time.Now()
+	go sharer.Write(data)
+
+	if _, err := io.ReadFull(viewer, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Fatalf("%d bytes arrived in %s despite a %d B/s cap", len(data), elapsed, rate)
+	}
+}
@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const maxRecordPayload = 64 << 10
+
+var ErrBadRecord = errors.New("secure channel: record failed authentication")
+
+// secureConn encrypts a stream end to end as length-prefixed
+// ChaCha20-Poly1305 records, each direction with its own key.
+type secureConn struct {
+	net.Conn
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+	pending []byte
+	binding []byte
+}
+
+// secureHandshake runs an X25519 exchange over conn and derives the record
+// keys from the result and secret. Someone in the middle without the secret
+// ends up with different keys, so the first record fails to open.
+func secureHandshake(conn net.Conn, role byte, secret []byte) (net.Conn, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	local := key.PublicKey().Bytes()
+	if _, err := conn.Write(local); err != nil {
+		return nil, err
+	}
+
+	remote := make([]byte, len(local))
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, err
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := key.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// both sides must feed the keys in the same order
+	sharerKey, viewerKey := local, remote
+	if role == RelayViewer {
+		sharerKey, viewerKey = remote, local
+	}
+
+	expand := func(label string, size int) ([]byte, error) {
+		info := append([]byte("ghostviewer relay "), label...)
+		info = append(append(info, sharerKey...), viewerKey...)
+
+		k := make([]byte, size)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, shared, secret, info), k); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	derive := func(direction byte) (cipher.AEAD, error) {
+		k, err := expand(string([]byte{direction}), chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		return chacha20poly1305.New(k)
+	}
+
+	c := &secureConn{Conn: conn}
+	if c.binding, err = expand("binding", bindingSize); err != nil {
+		return nil, err
+	}
+	peer := RelayViewer
+	if role == RelayViewer {
+		peer = RelaySharer
+	}
+
+	if c.send, err = derive(role); err != nil {
+		return nil, err
+	}
+
+	if c.recv, err = derive(peer); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ChannelBinding is derived with the record keys, so only the two ends holding
+// them agree on it.
+func (c *secureConn) ChannelBinding() []byte {
+	return c.binding
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordPayload {
+			chunk = chunk[:maxRecordPayload]
+		}
+
+		record := make([]byte, 4, 4+len(chunk)+c.send.Overhead())
+		record = c.send.Seal(record, nonce(c.sendSeq), chunk, nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+		c.sendSeq++
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size < uint32(c.recv.Overhead()) || size > uint32(maxRecordPayload+c.recv.Overhead()) {
+			return 0, fmt.Errorf("secure channel: bad record size %d", size)
+		}
+
+		record := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, unexpected(err)
+		}
+
+		plain, err := c.recv.Open(record[:0], nonce(c.recvSeq), record, nil)
+		if err != nil {
+			return 0, ErrBadRecord
+		}
+
+		c.recvSeq++
+		c.pending = plain
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ErrStreamClosed is returned when asked to reconnect a stream that can only
+// be used once, such as our own stdin and stdout.
+var ErrStreamClosed = errors.New("stream closed, cannot reconnect")
+
+// StreamConn is a net.Conn made of a separate reader and writer, such as a
+// process's stdin and stdout or the pipes to a child process. Deadlines work
+// if the reader supports them, as pipes do.
+type StreamConn struct {
+	r         io.ReadCloser
+	w         io.WriteCloser
+	name      string
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func NewStreamConn(r io.ReadCloser, w io.WriteCloser, name string) *StreamConn {
+	return &StreamConn{r: r, w: w, name: name}
+}
+
+// Stdio speaks over our own stdin and stdout. Anything else written to stdout
+// would corrupt the stream, so callers should send their output elsewhere.
+func Stdio() *StreamConn {
+	return NewStreamConn(os.Stdin, os.Stdout, "stdio")
+}
+
+// DialCommand starts name with args and speaks over its stdin and stdout, as
+// ssh's ProxyCommand does. Its stderr goes to ours. Closing the connection
+// kills the command.
+func DialCommand(name string, args ...string) (*StreamConn, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	conn := NewStreamConn(stdout, stdin, name)
+	conn.onClose = func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	return conn, nil
+}
+
+func (c *StreamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *StreamConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *StreamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.w.Close()
+		if rerr := c.r.Close(); err == nil {
+			err = rerr
+		}
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+func (c *StreamConn) LocalAddr() net.Addr  { return streamAddr(c.name) }
+func (c *StreamConn) RemoteAddr() net.Addr { return streamAddr(c.name) }
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// Stream opens the connection for a stdio transport. With Command set, each
+// Open runs it afresh, so a dropped tunnel can be dialed again. Otherwise it
+// speaks over In and Out, or our own stdin and stdout if they are nil, and
+// only the first Open succeeds.
+type Stream struct {
+	In      io.ReadCloser
+	Out     io.WriteCloser
+	Command []string
+
+	mu     sync.Mutex
+	opened bool
+}
+
+func (s *Stream) Open() (net.Conn, error) {
+	if len(s.Command) > 0 {
+		return DialCommand(s.Command[0], s.Command[1:]...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opened {
+		return nil, ErrStreamClosed
+	}
+	s.opened = true
+
+	if s.In == nil || s.Out == nil {
+		return Stdio(), nil
+	}
+	return NewStreamConn(s.In, s.Out, "stdio"), nil
+}
+
+type streamAddr string
+
+func (streamAddr) Network() string  { return "stream" }
+func (a streamAddr) String() string { return string(a) }
+
+// ListenUnix listens on a Unix socket at path, replacing a stale socket left
+// behind by a viewer that didn't shut down cleanly.
+func ListenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
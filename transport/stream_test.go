@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStreamOpensOnce(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &Stream{In: r, Out: w}
+	conn, err := stream.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := stream.Open(); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("second open: %v", err)
+	}
+
+	// a pipe supports read deadlines, so heartbeats and handshake timeouts
+	// work over stdio too
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: %v", err)
+	}
+}
+
+func TestDialCommand(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("no cat to echo through")
+	}
+
+	stream := &Stream{Command: []string{"cat"}}
+	for i := 0; i < 2; i++ {
+		conn, err := stream.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ghostviewer.sock")
+
+	l, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a live socket is left alone
+	if _, err := ListenUnix(path); err == nil {
+		t.Fatal("listened over a live socket")
+	}
+
+	// while one left behind by a crash is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// TLSClient wraps conn in TLS 1.3, checking the viewer's certificate with
+// conf, typically from PinnedTLSConfig. It closes conn if the handshake fails.
+func TLSClient(conn net.Conn, conf *tls.Config) (net.Conn, error) {
+	conf = conf.Clone()
+	conf.MinVersion = tls.VersionTLS13
+	return handshakeTLS(conn, tls.Client(conn, conf))
+}
+
+// TLSServer wraps conn in TLS 1.3 with the certificate in conf. It closes conn
+// if the handshake fails.
+func TLSServer(conn net.Conn, conf *tls.Config) (net.Conn, error) {
+	conf = conf.Clone()
+	conf.MinVersion = tls.VersionTLS13
+	return handshakeTLS(conn, tls.Server(conn, conf))
+}
+
+// handshakeTLS runs the handshake up front rather than on the first read or
+// write, so a peer that never finishes it can't hold up an accept loop.
+func handshakeTLS(conn net.Conn, tlsConn *tls.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
@@ -0,0 +1,149 @@
+package ui
+
+import (
+	"fmt"
+	"ghostviewer/io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+var sessionKeys = []ebiten.Key{
+	ebiten.KeyF1, ebiten.KeyF2, ebiten.KeyF3, ebiten.KeyF4, ebiten.KeyF5, ebiten.KeyF6,
+	ebiten.KeyF7, ebiten.KeyF8, ebiten.KeyF9, ebiten.KeyF10, ebiten.KeyF11, ebiten.KeyF12,
+}
+
+// Deck shows one of several sessions in a single window. F1-F12 switch
+// between the first twelve, and only the session on screen gets input. A
+// session that has ended stays until the user has seen why: it goes once
+// they switch away from it or dismiss it with Escape.
+type Deck struct {
+	mu        sync.Mutex
+	renderers map[int]*GRenderer
+	labels    map[int]string
+	ended     map[int]bool
+	active    int
+	kb        *io.KbInputHandler // shared, as the keyboard hook can only be installed once
+}
+
+func NewDeck() *Deck {
+	return &Deck{renderers: make(map[int]*GRenderer), labels: make(map[int]string), ended: make(map[int]bool), kb: &io.KbInputHandler{}}
+}
+
+// Add creates the renderer for a new session. The first session is shown
+// straight away; later ones wait to be switched to.
+func (d *Deck) Add(id int, label string) *GRenderer {
+	gr := NewGRenderer()
+	gr.KBHandler = d.kb
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.renderers[id] = gr
+	d.labels[id] = label
+	if d.renderers[d.active] == nil {
+		d.active = id
+	}
+
+	return gr
+}
+
+// Close marks a session as ended, leaving its tab until the user moves on.
+func (d *Deck) Close(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.renderers[id] != nil {
+		d.ended[id] = true
+	}
+}
+
+func (d *Deck) Remove(id int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(id)
+}
+
+func (d *Deck) remove(id int) {
+	delete(d.renderers, id)
+	delete(d.labels, id)
+	delete(d.ended, id)
+	if d.active == id {
+		d.active = 0
+		if ids := d.ids(); len(ids) > 0 {
+			d.active = ids[0]
+		}
+	}
+}
+
+func (d *Deck) ids() []int {
+	ids := make([]int, 0, len(d.renderers))
+	for id := range d.renderers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (d *Deck) current() *GRenderer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.renderers[d.active]
+}
+
+func (d *Deck) Update() error {
+	d.mu.Lock()
+	ids := d.ids()
+	prev := d.active
+	for i, key := range sessionKeys {
+		if i < len(ids) && inpututil.IsKeyJustPressed(key) {
+			d.active = ids[i]
+		}
+	}
+	if d.ended[prev] && (d.active != prev || inpututil.IsKeyJustPressed(ebiten.KeyEscape)) {
+		d.remove(prev)
+	}
+	d.mu.Unlock()
+
+	if gr := d.current(); gr != nil {
+		return gr.Update()
+	}
+	return nil
+}
+
+func (d *Deck) Draw(screen *ebiten.Image) {
+	gr := d.current()
+	if gr == nil {
+		ebitenutil.DebugPrint(screen, "Waiting for clients...")
+		return
+	}
+
+	gr.Draw(screen)
+
+	d.mu.Lock()
+	var tabs []string
+	for i, id := range d.ids() {
+		tab := fmt.Sprintf("F%d %s", i+1, d.labels[id])
+		if d.ended[id] {
+			tab += " (ended)"
+		}
+		if id == d.active {
+			tab = "[" + tab + "]"
+		}
+		tabs = append(tabs, tab)
+	}
+	d.mu.Unlock()
+
+	ebitenutil.DebugPrintAt(screen, strings.Join(tabs, "  "), 0, screen.Bounds().Dy()-16)
+}
+
+func (d *Deck) Layout(outsideWidth int, outsideHeight int) (int, int) {
+	if gr := d.current(); gr != nil {
+		return gr.Layout(outsideWidth, outsideHeight)
+	}
+	return 1280, 720
+}
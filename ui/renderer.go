@@ -2,21 +2,18 @@ package ui
 
 import (
 	"ghostviewer/io"
+	"ghostviewer/protocol"
 	"image"
-	"strconv"
+	"sync"
 
 	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 )
 
-type Message struct {
-	Cmd  string
-	Data []byte
-}
-
 type GRenderer struct {
 	CurFrame     *ebiten.Image
 	KBHandler    *io.KbInputHandler
-	Messages     chan Message
+	Messages     chan protocol.Message
 	RemoteWidth  int
 	RemoteHeight int
 	LocalWidth   int
@@ -25,13 +22,25 @@ type GRenderer struct {
 	RemoteMouseY int
 	LocalMouseX  int
 	LocalMouseY  int
+	Status       string
+
+	statusMutex sync.Mutex // guards Status, set from the session's goroutine
 }
 
-func EncodeEvent(msg Message) []byte {
-	return append([]byte(msg.Cmd), ';')
+var keyCounter uint32 = 0
+
+// send queues msg without blocking the game loop. Events are dropped if
+// nobody is draining Messages.
+func (gr *GRenderer) send(msg protocol.Message) {
+	select {
+	case gr.Messages <- msg:
+	default:
+	}
 }
 
-var keyCounter = 0
+func (gr *GRenderer) pointer(button protocol.Button, action protocol.PointerAction) protocol.Pointer {
+	return protocol.Pointer{X: int32(gr.RemoteMouseX), Y: int32(gr.RemoteMouseY), Button: button, Action: action}
+}
 
 func (gr *GRenderer) Update() error {
 	if gr.CurFrame != nil {
@@ -41,16 +50,16 @@ func (gr *GRenderer) Update() error {
 		gr.RemoteMouseY = y * gr.RemoteHeight / gr.LocalHeight
 		gr.RemoteMouseX = x * gr.RemoteWidth / gr.LocalWidth
 		if gr.LocalMouseX != x || gr.LocalMouseY != y {
-			go func() {
-				gr.Messages <- Message{"MOUSE:" + strconv.Itoa(gr.RemoteMouseX) + ":" + strconv.Itoa(gr.RemoteMouseY), nil}
-			}()
+			gr.send(gr.pointer(protocol.ButtonNone, protocol.PointerMove))
 		}
 		gr.LocalMouseX, gr.LocalMouseY = x, y
 
+		if dx, dy := ebiten.Wheel(); dx != 0 || dy != 0 {
+			gr.send(protocol.Scroll{DX: int32(dx), DY: int32(dy)})
+		}
+
 		for _, e := range gr.KBHandler.GetEvents() {
-			go func() {
-				gr.Messages <- Message{"KEY:" + strconv.Itoa(int(e.Kind)) + ":" + strconv.Itoa(keyCounter) + ":" + string(e.Keychar), nil}
-			}()
+			gr.send(protocol.Key{Kind: e.Kind, Index: keyCounter, Char: e.Keychar, Code: e.Rawcode})
 			keyCounter++
 		}
 	}
@@ -65,30 +74,22 @@ func (gr *GRenderer) HandleMouse() {
 	if ebiten.IsMouseButtonPressed(ebiten.MouseButtonLeft) {
 		if !leftPressedLast {
 			leftPressedLast = true
-			go func() {
-				gr.Messages <- Message{"LDMOUSE:" + strconv.Itoa(gr.RemoteMouseX) + ":" + strconv.Itoa(gr.RemoteMouseY), nil}
-			}()
+			gr.send(gr.pointer(protocol.ButtonLeft, protocol.PointerDown))
 		}
 	} else {
 		if leftPressedLast {
-			go func() {
-				gr.Messages <- Message{"LUMOUSE:" + strconv.Itoa(gr.RemoteMouseX) + ":" + strconv.Itoa(gr.RemoteMouseY), nil}
-			}()
+			gr.send(gr.pointer(protocol.ButtonLeft, protocol.PointerUp))
 		}
 		leftPressedLast = false
 	}
 	if ebiten.IsMouseButtonPressed(ebiten.MouseButtonRight) {
 		if !rightPressedLast {
 			rightPressedLast = true
-			go func() {
-				gr.Messages <- Message{"RDMOUSE:" + strconv.Itoa(gr.RemoteMouseX) + ":" + strconv.Itoa(gr.RemoteMouseY), nil}
-			}()
+			gr.send(gr.pointer(protocol.ButtonRight, protocol.PointerDown))
 		}
 	} else {
 		if rightPressedLast {
-			go func() {
-				gr.Messages <- Message{"RUMOUSE:" + strconv.Itoa(gr.RemoteMouseX) + ":" + strconv.Itoa(gr.RemoteMouseY), nil}
-			}()
+			gr.send(gr.pointer(protocol.ButtonRight, protocol.PointerUp))
 		}
 		rightPressedLast = false
 	}
@@ -99,6 +100,13 @@ func (gr *GRenderer) Draw(screen *ebiten.Image) {
 		screen.DrawImage(gr.CurFrame, nil)
 		gr.HandleMouse()
 	}
+
+	gr.statusMutex.Lock()
+	status := gr.Status
+	gr.statusMutex.Unlock()
+	if status != "" {
+		ebitenutil.DebugPrint(screen, status)
+	}
 }
 
 func (gr *GRenderer) Layout(outsideWidth int, outsideHeight int) (screenWidth int, screenHeight int) {
@@ -109,10 +117,23 @@ func (gr *GRenderer) Layout(outsideWidth int, outsideHeight int) (screenWidth in
 }
 
 func NewGRenderer() *GRenderer {
-	gr := &GRenderer{LocalWidth: 1920, LocalHeight: 1080, Messages: make(chan Message), KBHandler: &io.KbInputHandler{}}
+	gr := &GRenderer{LocalWidth: 1920, LocalHeight: 1080, Messages: make(chan protocol.Message, 256), KBHandler: &io.KbInputHandler{}}
 	return gr
 }
 
+// SetStatus overlays a message on the frame, e.g. while the sharer is
+// reconnecting. An empty string clears it.
+func (gr *GRenderer) SetStatus(status string) {
+	gr.statusMutex.Lock()
+	gr.Status = status
+	gr.statusMutex.Unlock()
+}
+
+// Input delivers the mouse and keyboard events captured by the window.
+func (gr *GRenderer) Input() <-chan protocol.Message {
+	return gr.Messages
+}
+
 func (gr *GRenderer) UpdateFrame(frame *image.RGBA) {
 	img := ebiten.NewImageFromImage(frame)
 	gr.CurFrame = img
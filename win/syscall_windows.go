@@ -47,6 +47,35 @@ type BITMAPINFO struct {
 	BmiColors *RGBQUAD
 }
 
+type WNDCLASSEX struct {
+	CbSize        uint32
+	Style         uint32
+	LpfnWndProc   uintptr
+	CbClsExtra    int32
+	CbWndExtra    int32
+	HInstance     HANDLE
+	HIcon         HANDLE
+	HCursor       HANDLE
+	HbrBackground HANDLE
+	LpszMenuName  *uint16
+	LpszClassName *uint16
+	HIconSm       HANDLE
+}
+
+type POINT struct {
+	X int32
+	Y int32
+}
+
+type MSG struct {
+	Hwnd    HWND
+	Message uint32
+	WParam  uintptr
+	LParam  uintptr
+	Time    uint32
+	Pt      POINT
+}
+
 const (
 	OBJ_BITMAP = 7
 )
@@ -76,6 +105,41 @@ const (
 
 //sys	dragQueryFile(hDrop syscall.Handle, iFile int, buf *uint16, len uint32) (n int, err error) = Shell32.DragQueryFileW
 
+const (
+	WS_POPUP         = 0x80000000
+	WS_VISIBLE       = 0x10000000
+	WS_CHILD         = 0x40000000
+	WS_CAPTION       = 0x00C00000
+	WS_EX_TOPMOST    = 0x00000008
+	WS_EX_TOOLWINDOW = 0x00000080
+	BS_PUSHBUTTON    = 0x00000000
+	WM_DESTROY       = 0x0002
+	WM_CLOSE         = 0x0010
+	WM_APP           = 0x8000
+	WM_COMMAND       = 0x0111
+	SM_CXSCREEN      = 0
+	COLOR_WINDOW     = 5
+	MB_YESNO         = 0x00000004
+	MB_YESNOCANCEL   = 0x00000003
+	MB_ICONQUESTION  = 0x00000020
+	MB_TOPMOST       = 0x00040000
+	MB_SETFOREGROUND = 0x00010000
+	IDYES            = 6
+	IDNO             = 7
+)
+
+//sys	CreateWindowEx(exStyle uint32, className *uint16, windowName *uint16, style uint32, x int32, y int32, width int32, height int32, parent HWND, menu HANDLE, instance HANDLE, param uintptr) (h HWND, err error) = User32.CreateWindowExW
+//sys	DefWindowProc(hwnd HWND, msg uint32, wParam uintptr, lParam uintptr) (r uintptr) = User32.DefWindowProcW
+//sys	DestroyWindow(hwnd HWND) (err error) = User32.DestroyWindow
+//sys	DispatchMessage(msg *MSG) (r uintptr) = User32.DispatchMessageW
+//sys	GetMessage(msg *MSG, hwnd HWND, msgFilterMin uint32, msgFilterMax uint32) (r int32, err error) [failretval==-1] = User32.GetMessageW
+//sys	GetSystemMetrics(index int32) (n int32) = User32.GetSystemMetrics
+//sys	MessageBox(hwnd HWND, text *uint16, caption *uint16, boxType uint32) (r int32, err error) = User32.MessageBoxW
+//sys	PostMessage(hwnd HWND, msg uint32, wParam uintptr, lParam uintptr) (err error) = User32.PostMessageW
+//sys	PostQuitMessage(exitCode int32) = User32.PostQuitMessage
+//sys	RegisterClassEx(class *WNDCLASSEX) (atom uint16, err error) = User32.RegisterClassExW
+//sys	TranslateMessage(msg *MSG) (translated bool) = User32.TranslateMessage
+
 const (
 	DpiAwarenessContextUndefined         = 0
 	DpiAwarenessContextUnaware           = -1
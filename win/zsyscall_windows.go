@@ -52,19 +52,30 @@ var (
 	procDragQueryFileW                = modShell32.NewProc("DragQueryFileW")
 	procAddClipboardFormatListener    = modUser32.NewProc("AddClipboardFormatListener")
 	procCloseClipboard                = modUser32.NewProc("CloseClipboard")
+	procCreateWindowExW               = modUser32.NewProc("CreateWindowExW")
+	procDefWindowProcW                = modUser32.NewProc("DefWindowProcW")
+	procDestroyWindow                 = modUser32.NewProc("DestroyWindow")
+	procDispatchMessageW              = modUser32.NewProc("DispatchMessageW")
 	procEmptyClipboard                = modUser32.NewProc("EmptyClipboard")
 	procEnumClipboardFormats          = modUser32.NewProc("EnumClipboardFormats")
 	procGetClipboardData              = modUser32.NewProc("GetClipboardData")
 	procGetClipboardFormatNameW       = modUser32.NewProc("GetClipboardFormatNameW")
 	procGetDesktopWindow              = modUser32.NewProc("GetDesktopWindow")
+	procGetMessageW                   = modUser32.NewProc("GetMessageW")
+	procGetSystemMetrics              = modUser32.NewProc("GetSystemMetrics")
 	procIsClipboardFormatAvailable    = modUser32.NewProc("IsClipboardFormatAvailable")
 	procIsValidDpiAwarenessContext    = modUser32.NewProc("IsValidDpiAwarenessContext")
+	procMessageBoxW                   = modUser32.NewProc("MessageBoxW")
 	procOpenClipboard                 = modUser32.NewProc("OpenClipboard")
+	procPostMessageW                  = modUser32.NewProc("PostMessageW")
+	procPostQuitMessage               = modUser32.NewProc("PostQuitMessage")
+	procRegisterClassExW              = modUser32.NewProc("RegisterClassExW")
 	procRegisterClipboardFormatW      = modUser32.NewProc("RegisterClipboardFormatW")
 	procRemoveClipboardFormatListener = modUser32.NewProc("RemoveClipboardFormatListener")
 	procSetClipboardData              = modUser32.NewProc("SetClipboardData")
 	procSetThreadDpiAwarenessContext  = modUser32.NewProc("SetThreadDpiAwarenessContext")
 	procSetWindowsHookExW             = modUser32.NewProc("SetWindowsHookExW")
+	procTranslateMessage              = modUser32.NewProc("TranslateMessage")
 )
 
 func GetCurrentObject(hdc syscall.Handle, typ uint16) (h syscall.Handle) {
@@ -142,6 +153,35 @@ func closeClipboard() (err error) {
 	return
 }
 
+func CreateWindowEx(exStyle uint32, className *uint16, windowName *uint16, style uint32, x int32, y int32, width int32, height int32, parent HWND, menu HANDLE, instance HANDLE, param uintptr) (h HWND, err error) {
+	r0, _, e1 := syscall.Syscall12(procCreateWindowExW.Addr(), 12, uintptr(exStyle), uintptr(unsafe.Pointer(className)), uintptr(unsafe.Pointer(windowName)), uintptr(style), uintptr(x), uintptr(y), uintptr(width), uintptr(height), uintptr(parent), uintptr(menu), uintptr(instance), uintptr(param))
+	h = HWND(r0)
+	if h == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+func DefWindowProc(hwnd HWND, msg uint32, wParam uintptr, lParam uintptr) (r uintptr) {
+	r0, _, _ := syscall.Syscall6(procDefWindowProcW.Addr(), 4, uintptr(hwnd), uintptr(msg), uintptr(wParam), uintptr(lParam), 0, 0)
+	r = uintptr(r0)
+	return
+}
+
+func DestroyWindow(hwnd HWND) (err error) {
+	r1, _, e1 := syscall.Syscall(procDestroyWindow.Addr(), 1, uintptr(hwnd), 0, 0)
+	if r1 == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+func DispatchMessage(msg *MSG) (r uintptr) {
+	r0, _, _ := syscall.Syscall(procDispatchMessageW.Addr(), 1, uintptr(unsafe.Pointer(msg)), 0, 0)
+	r = uintptr(r0)
+	return
+}
+
 func emptyClipboard() (err error) {
 	r1, _, e1 := syscall.Syscall(procEmptyClipboard.Addr(), 0, 0, 0, 0)
 	if r1 == 0 {
@@ -183,6 +223,21 @@ func GetDesktopWindow() (h HWND) {
 	return
 }
 
+func GetMessage(msg *MSG, hwnd HWND, msgFilterMin uint32, msgFilterMax uint32) (r int32, err error) {
+	r0, _, e1 := syscall.Syscall6(procGetMessageW.Addr(), 4, uintptr(unsafe.Pointer(msg)), uintptr(hwnd), uintptr(msgFilterMin), uintptr(msgFilterMax), 0, 0)
+	r = int32(r0)
+	if r == -1 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+func GetSystemMetrics(index int32) (n int32) {
+	r0, _, _ := syscall.Syscall(procGetSystemMetrics.Addr(), 1, uintptr(index), 0, 0)
+	n = int32(r0)
+	return
+}
+
 func isClipboardFormatAvailable(uFormat uint32) (err error) {
 	r1, _, e1 := syscall.Syscall(procIsClipboardFormatAvailable.Addr(), 1, uintptr(uFormat), 0, 0)
 	if r1 == 0 {
@@ -197,6 +252,15 @@ func IsValidDpiAwarenessContext(value int32) (n bool) {
 	return
 }
 
+func MessageBox(hwnd HWND, text *uint16, caption *uint16, boxType uint32) (r int32, err error) {
+	r0, _, e1 := syscall.Syscall6(procMessageBoxW.Addr(), 4, uintptr(hwnd), uintptr(unsafe.Pointer(text)), uintptr(unsafe.Pointer(caption)), uintptr(boxType), 0, 0)
+	r = int32(r0)
+	if r == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
 func openClipboard(h syscall.Handle) (err error) {
 	r1, _, e1 := syscall.Syscall(procOpenClipboard.Addr(), 1, uintptr(h), 0, 0)
 	if r1 == 0 {
@@ -205,6 +269,28 @@ func openClipboard(h syscall.Handle) (err error) {
 	return
 }
 
+func PostMessage(hwnd HWND, msg uint32, wParam uintptr, lParam uintptr) (err error) {
+	r1, _, e1 := syscall.Syscall6(procPostMessageW.Addr(), 4, uintptr(hwnd), uintptr(msg), uintptr(wParam), uintptr(lParam), 0, 0)
+	if r1 == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+func PostQuitMessage(exitCode int32) {
+	syscall.Syscall(procPostQuitMessage.Addr(), 1, uintptr(exitCode), 0, 0)
+	return
+}
+
+func RegisterClassEx(class *WNDCLASSEX) (atom uint16, err error) {
+	r0, _, e1 := syscall.Syscall(procRegisterClassExW.Addr(), 1, uintptr(unsafe.Pointer(class)), 0, 0)
+	atom = uint16(r0)
+	if atom == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
 func registerClipboardFormat(name string) (id uint32, err error) {
 	var _p0 *uint16
 	_p0, err = syscall.UTF16PtrFromString(name)
@@ -257,3 +343,9 @@ func setWindowsHookExW(idHook int32, lpfn unsafe.Pointer, hmod syscall.Handle, d
 	}
 	return
 }
+
+func TranslateMessage(msg *MSG) (translated bool) {
+	r0, _, _ := syscall.Syscall(procTranslateMessage.Addr(), 1, uintptr(unsafe.Pointer(msg)), 0, 0)
+	translated = r0 != 0
+	return
+}